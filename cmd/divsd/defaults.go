@@ -4,3 +4,6 @@ import "time"
 
 // default timeout for network operations
 const DEFAULT_TIMEOUT = 10 * time.Second
+
+// default timeout for a graceful shutdown
+const DEFAULT_SHUTDOWN_TIMEOUT = 15 * time.Second
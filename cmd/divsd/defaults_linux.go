@@ -1 +1,4 @@
 package main
+
+// default directory where the node state is saved
+const DEFAULT_STATE_DIR = "/var/lib/divs"
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/inercia/divs/divsd"
+)
+
+// The state directory has already been initialized
+var ERR_ALREADY_INITIALIZED = fmt.Errorf("State directory already initialized (use --force for overwriting it)")
+
+// Joining a switch by its serial leaves the node without the switch keys
+var ERR_JOIN_WITHOUT_KEYS = fmt.Errorf("joining a switch with --join does not provide its encryption keys: use --join-token (or set the keys in the [crypto] section)")
+
+// Create a new switch (and node) identity in the state directory
+func initIdentity(stateDir string, nodeName string, force bool) (*divsd.State, error) {
+	if _, err := divsd.LoadState(stateDir); err == nil && !force {
+		return nil, ERR_ALREADY_INITIALIZED
+	}
+
+	st, err := divsd.NewState(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.Save(stateDir); err != nil {
+		return nil, fmt.Errorf("could not save state: %s", err)
+	}
+	return st, nil
+}
+
+// Load the switch and node identity from the state directory
+// A new switch is created when requested (or when there is no identity yet),
+// and the identity is updated when joining a different switch. Switches can
+// only be joined by their serial when the keys are configured (haveKeys), or
+// when the state already holds the keys for that switch.
+func loadIdentity(stateDir string, create bool, join string, joinToken string, haveKeys bool) (*divsd.State, error) {
+	st, err := divsd.LoadState(stateDir)
+	switch err {
+	case nil:
+		log.Info("Loaded identity from %s", stateDir)
+	case divsd.ERR_NO_STATE:
+		log.Info("No identity found in %s", stateDir)
+		create = create || (len(join) == 0 && len(joinToken) == 0)
+		if st, err = divsd.NewState(""); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	switch {
+	case create:
+		if err := st.ResetSwitch(divsd.NewSwitchId()); err != nil {
+			return nil, err
+		}
+		log.Info("Creating virtual switch ID:%s", st.Serial)
+	case len(joinToken) > 0:
+		token, err := divsd.ParseJoinToken(joinToken)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Will join virtual switch %s (with token)", token.Serial)
+		st.JoinSwitchWithToken(token)
+	case len(join) > 0:
+		serial := divsd.NewSwitchFromString(join)
+		if serial.Empty() {
+			return nil, fmt.Errorf("invalid switch serial '%s'", join)
+		}
+		if !haveKeys {
+			// the state holds the keys if we are already in that switch
+			keys, _ := st.ClusterKeys()
+			if serial.String() != st.Serial || len(keys) == 0 {
+				return nil, ERR_JOIN_WITHOUT_KEYS
+			}
+		}
+		log.Info("Will join virtual switch %s", serial)
+		if serial.String() != st.Serial {
+			st.JoinSwitch(serial)
+		}
+	default:
+		log.Info("Using virtual switch %s", st.Serial)
+		return st, nil
+	}
+
+	if err := st.Save(stateDir); err != nil {
+		return nil, fmt.Errorf("could not save state: %s", err)
+	}
+	return st, nil
+}
+
+// Apply the identity to the configuration: the switch serial, the node
+// name, the keyring and the bootstrap peers (unless they have been configured)
+func applyIdentity(config *divsd.Config, st *divsd.State) error {
+	config.Global.Serial = st.SwitchId()
+	if len(config.Global.Name) == 0 {
+		config.Global.Name = st.NodeName
+	}
+	if len(config.Crypto.Key) == 0 {
+		keys, err := st.ClusterKeys()
+		if err != nil {
+			return err
+		}
+		config.Crypto.Key = keys
+	}
+	for _, peer := range st.Peers {
+		if !containsString(config.Discover.Peer, peer) {
+			config.Discover.Peer = append(config.Discover.Peer, peer)
+		}
+	}
+	return nil
+}
+
+// Create a new encoded join token for the switch
+func newJoinToken(st *divsd.State, config *divsd.Config, peers []string, ttl time.Duration) (string, error) {
+	keys := config.Crypto.Key
+	if len(keys) == 0 {
+		var err error
+		if keys, err = st.ClusterKeys(); err != nil {
+			return "", err
+		}
+	}
+	token, err := divsd.NewJoinToken(st.SwitchId(), keys, peers, ttl)
+	if err != nil {
+		return "", err
+	}
+	return token.Encode()
+}
+
+// Print the information needed for joining the switch from other nodes
+func printJoinInfo(st *divsd.State, token string, ttl time.Duration) {
+	fmt.Printf("Virtual switch: %s\n", st.Serial)
+	fmt.Printf("Node:           %s (%s)\n", st.NodeName, st.NodeId)
+	fmt.Printf("\n")
+	if ttl > 0 {
+		fmt.Printf("Join this switch from other nodes (in the next %s) with:\n", ttl)
+	} else {
+		fmt.Printf("Join this switch from other nodes with:\n")
+	}
+	fmt.Printf("\n")
+	fmt.Printf("  divsd --join-token %s\n", token)
+}
+
+// check if a string is in a list of strings
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"github.com/facebookgo/pidfile"
 	"github.com/inercia/divs/divsd"
 	"github.com/inercia/goptions"
 	logging "github.com/op/go-logging"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -14,7 +16,8 @@ func main() {
 	// command line options
 	// note: do not break lines in goptions [alvaro]
 	options := struct {
-		ConfigPath string `goptions:"-c, --config, config, description='config file name'"`
+		ConfigPath  string `goptions:"-c, --config, config, description='config file name'"`
+		CheckConfig bool   `goptions:"--check-config, description='validate the configuration and exit'"`
 
 		BindIP string `goptions:"--bind, maps='Global/BindIP', description='IP address to bind to'"`
 
@@ -23,27 +26,44 @@ func main() {
 		Port int    `goptions:"--port, maps='Global/Port', description='forced external port to announce to peers'"`
 
 		// switch
-		Create bool   `goptions:"--create, description='create a new virtual switch'"`
-		Serial string `goptions:"--join, description='virtual switch serial number to join'"`
+		Create    bool   `goptions:"--create, description='create a new virtual switch'"`
+		Serial    string `goptions:"--join, description='virtual switch serial number to join (with the keys in [crypto] or in the state)'"`
+		JoinToken string `goptions:"--join-token, description='join token for the virtual switch to join'"`
+		StateDir  string `goptions:"--statedir, maps='Global/StateDir', description='directory where the switch and node identity are saved'"`
 
 		// discovery
 		DiscoverPort int `goptions:"--dhtport, maps='Discover/Port', description='discovery protocol port'"`
 
 		// other
 		Timeout time.Duration `goptions:"-t, --timeout, description='connection timeout in seconds'"`
-		Pidfile string        `goptions:"--pidfile, description='file where the PID will be saved'"`
+		Pidfile string        `goptions:"--pidfile, maps='Global/Pidfile', description='file where the PID will be saved'"`
 
 		// aux
 		Help    goptions.Help `goptions:"-h, --help, description='show this help'"`
 		Verbose bool          `goptions:"-v, --verbose"`
+
+		// verbs
+		goptions.Verbs
+		Init struct {
+			Name   string        `goptions:"--name, description='node name (default: the hostname)'"`
+			Force  bool          `goptions:"--force, description='overwrite any existing identity'"`
+			Expire time.Duration `goptions:"--expire, description='validity of the join token (0 for no expiration)'"`
+			Peers  []string      `goptions:"--peer, description='bootstrap address (host:port) included in the join token'"`
+		} `goptions:"init"`
+		Token struct {
+			Expire time.Duration `goptions:"--expire, description='validity of the join token (0 for no expiration)'"`
+			Peers  []string      `goptions:"--peer, description='bootstrap address (host:port) included in the join token'"`
+		} `goptions:"token"`
 	}{ // Default values goes here
 		Create:  false,
-		BindIP:  "0.0.0.0",
+		BindIP:  "",
 		Serial:  "",
 		Timeout: DEFAULT_TIMEOUT,
 		Host:    "",
 		Pidfile: "",
 	}
+	options.Init.Expire = divsd.DEFAULT_JOIN_TOKEN_TTL
+	options.Token.Expire = divsd.DEFAULT_JOIN_TOKEN_TTL
 
 	goptions.ParseAndFail(&options)
 	config := divsd.NewConfig()
@@ -52,30 +72,108 @@ func main() {
 		log.Critical("# Error: when loading config file: %s", err)
 		os.Exit(1)
 	}
+	if err := config.Validate(); err != nil {
+		log.Critical("# Error: invalid configuration:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			log.Critical("#   %s", line)
+		}
+		os.Exit(1)
+	}
+	if options.CheckConfig {
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+	if len(config.Global.StateDir) == 0 {
+		config.Global.StateDir = DEFAULT_STATE_DIR
+	}
+
+	switch options.Verbs {
+	case "init":
+		st, err := initIdentity(config.Global.StateDir, options.Init.Name, options.Init.Force)
+		if err != nil {
+			log.Critical("# Error: could not initialize the switch: %s", err)
+			os.Exit(1)
+		}
+		token, err := newJoinToken(st, config, options.Init.Peers, options.Init.Expire)
+		if err != nil {
+			log.Critical("# Error: could not create a join token: %s", err)
+			os.Exit(1)
+		}
+		printJoinInfo(st, token, options.Init.Expire)
+		os.Exit(0)
+	case "token":
+		st, err := divsd.LoadState(config.Global.StateDir)
+		if err != nil {
+			log.Critical("# Error: could not load the switch identity: %s", err)
+			os.Exit(1)
+		}
+		token, err := newJoinToken(st, config, options.Token.Peers, options.Token.Expire)
+		if err != nil {
+			log.Critical("# Error: could not create a join token: %s", err)
+			os.Exit(1)
+		}
+		printJoinInfo(st, token, options.Token.Expire)
+		os.Exit(0)
+	}
 
 	if len(options.Pidfile) > 0 {
 		pidfile.SetPidfilePath(options.Pidfile)
 		if err := pidfile.Write(); err != nil {
 			log.Fatal(err)
 		}
+		config.Global.Pidfile = options.Pidfile
 	}
 
+	if err := divsd.SetLogLevel(config.Global.LogLevel); err != nil {
+		log.Critical("# Error: invalid log level: %s", err)
+		os.Exit(1)
+	}
 	if options.Verbose {
 		log.Info("Verbose logging enabled.")
 		logging.SetLevel(logging.DEBUG, divsd.LOG_MODULE)
+		config.Global.LogLevel = "debug"
 	}
 
 	// check if we are creating a new switch or just joining an existing one.
-	// if we are creating one, we must create a new serial...
-	if options.Create || len(options.Serial) == 0 {
-		config.Global.Serial = divsd.NewSwitchId()
-		log.Info("Creating virtual switch ID:%s", config.Global.Serial)
-	} else {
-		log.Info("Will join virtual switch %s", options.Serial)
-		config.Global.Serial = divsd.NewSwitchFromString(options.Serial)
+	// otherwise, we use the identity saved in the state directory
+	st, err := loadIdentity(config.Global.StateDir, options.Create, options.Serial, options.JoinToken, len(config.Crypto.Key) > 0)
+	if err != nil {
+		log.Critical("# Error: could not load the switch identity: %s", err)
+		os.Exit(1)
+	}
+	if err := applyIdentity(config, st); err != nil {
+		log.Critical("# Error: could not use the switch identity: %s", err)
+		os.Exit(1)
 	}
 	rand.Seed(time.Now().UnixNano())
 
 	s, err := divsd.New(config)
-	log.Fatal(s.ListenAndServe())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the configuration file is loaded again on reloads, keeping the settings
+	// that can only be set from the command line
+	loadConfig := func() (*divsd.Config, error) {
+		newConfig := divsd.NewConfig()
+		if err := goptions.LoadConf(newConfig); err != nil {
+			return nil, err
+		}
+		newConfig.Global.Pidfile = config.Global.Pidfile
+		if len(newConfig.Global.StateDir) == 0 {
+			newConfig.Global.StateDir = DEFAULT_STATE_DIR
+		}
+		if err := applyIdentity(newConfig, st); err != nil {
+			return nil, err
+		}
+		if options.Verbose {
+			newConfig.Global.LogLevel = "debug"
+		}
+		return newConfig, nil
+	}
+
+	go handleSignals(s, loadConfig)
+	if err := s.ListenAndServe(); err != divsd.ERR_SERVER_CLOSED {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/inercia/divs/divsd"
+)
+
+// Wait for signals: shutdown the server gracefully on termination signals
+// and reload the configuration on SIGHUP
+func handleSignals(s *divsd.Server, loadConfig func() (*divsd.Config, error)) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			reloadConfig(s, loadConfig)
+			continue
+		}
+
+		log.Info("Signal %s received: shutting down", sig)
+		signal.Stop(sigChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_SHUTDOWN_TIMEOUT)
+		if err := s.Shutdown(ctx); err != nil {
+			log.Error("Error during shutdown: %s", err)
+		}
+		cancel()
+		return
+	}
+}
+
+// reload the configuration file and apply it to the server
+func reloadConfig(s *divsd.Server, loadConfig func() (*divsd.Config, error)) {
+	log.Info("SIGHUP received: reloading configuration")
+	config, err := loadConfig()
+	if err != nil {
+		log.Error("Could not load the configuration: %s", err)
+		return
+	}
+
+	restart, err := s.Reload(config)
+	if err != nil {
+		log.Error("Could not reload the configuration: %s", err)
+	}
+	for _, key := range restart {
+		log.Warning("Setting '%s' has changed: a restart is required for applying it", key)
+	}
+}
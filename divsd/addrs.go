@@ -0,0 +1,73 @@
+package divsd
+
+import (
+	"net"
+
+	"github.com/inercia/divs/divsd/nat"
+)
+
+// Check if IPv6 sockets can be used in this host
+func ipv6Available() bool {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Get the IP we must bind to: the configured one or, when empty, all the
+// addresses (dual-stack when IPv6 is available)
+func bindIP(configured string) string {
+	if len(configured) > 0 {
+		return configured
+	}
+	if ipv6Available() {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+// Check if we can use IPv6 when bound to some IP
+func bindSupportsIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// Get the addresses of the local interfaces
+func localAddrs() []net.IP {
+	res := []net.IP{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Debug("Could not get the local addresses: %s", err)
+		return res
+	}
+	for _, a := range addrs {
+		if ip, _, err := net.ParseCIDR(a.String()); err == nil {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
+
+// Get the first global IPv6 address of this host (or nil if there is none)
+func globalIPv6() net.IP {
+	for _, ip := range localAddrs() {
+		if nat.IsGlobalIPv6(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Get the IP we advertise when we are bound to all the addresses and we do
+// not know our external address: the first IPv4 address or, if there is
+// none, the first global IPv6 address
+func localAdvertiseIP() net.IP {
+	for _, ip := range localAddrs() {
+		if ip.To4() != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			return ip
+		}
+	}
+	return globalIPv6()
+}
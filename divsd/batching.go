@@ -0,0 +1,111 @@
+package divsd
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// The protocol feature published by nodes that accept batches of frames
+const FEATURE_BATCH = "batch"
+
+// the path MTU batches should fit in (the usual Ethernet MTU), as fragmented
+// datagrams are often dropped
+const BATCH_PATH_MTU = 1500
+
+// the overhead added to a batch in the wire: the IPv6 and UDP headers, the
+// memberlist message type and CRC header, and the encryption (version, nonce
+// and GCM tag)
+const BATCH_WIRE_OVERHEAD = 40 + 8 + 1 + 5 + 1 + 12 + 16
+
+// limits for the size of a batch (the largest fits in the path MTU once
+// memberlist has encrypted it)
+const (
+	BATCH_MIN_MTU = 576
+	BATCH_MAX_MTU = BATCH_PATH_MTU - BATCH_WIRE_OVERHEAD
+)
+
+// the default maximum size (in bytes) of a batch
+const DEFAULT_BATCH_MTU = BATCH_MAX_MTU
+
+// the default time (in microseconds) a frame can wait for other frames
+const DEFAULT_BATCH_DELAY = 100
+
+// the overhead of each message in a batch (the length)
+const BATCH_MSG_OVERHEAD = 2
+
+// A batch of messages for a node, sent as a single datagram
+// A batch is the message type followed by the messages, each one prefixed by
+// its length (16 bits, big endian). It is not encoded with msgpack, so its size
+// can be computed while messages are added.
+type Batch struct {
+	buf     []byte
+	count   int
+	mtu     int
+	started time.Time // when the first message was added
+}
+
+// Create a new, empty batch, with some maximum size
+func NewBatch(mtu int) *Batch {
+	b := &Batch{mtu: mtu}
+	b.Reset()
+	return b
+}
+
+// Add a (encoded) message to the batch, returning `false` if it does not fit
+func (b *Batch) Add(msg []byte) bool {
+	if len(b.buf)+BATCH_MSG_OVERHEAD+len(msg) > b.mtu {
+		return false
+	}
+	if b.count == 0 {
+		b.started = time.Now()
+	}
+	var hdr [BATCH_MSG_OVERHEAD]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(msg)))
+	b.buf = append(b.buf, hdr[:]...)
+	b.buf = append(b.buf, msg...)
+	b.count++
+	return true
+}
+
+// Get the number of messages in the batch
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Get the time left before the batch must be sent, for some maximum delay
+func (b *Batch) Remaining(delay time.Duration) time.Duration {
+	return delay - time.Since(b.started)
+}
+
+// Get the buffer to send: the batch, or the message itself when there is only
+// one message
+func (b *Batch) Bytes() []byte {
+	if b.count == 1 {
+		return b.buf[1+BATCH_MSG_OVERHEAD:]
+	}
+	return b.buf
+}
+
+// Empty the batch
+func (b *Batch) Reset() {
+	b.buf = append(make([]byte, 0, b.mtu), byte(MSG_DIVS_BATCH))
+	b.count = 0
+}
+
+// Get the messages in a batch (without the message type)
+func unpackBatch(buf []byte) ([][]byte, error) {
+	msgs := [][]byte{}
+	for len(buf) > 0 {
+		if len(buf) < BATCH_MSG_OVERHEAD {
+			return nil, ERR_MALFORMED_MSG
+		}
+		size := int(binary.BigEndian.Uint16(buf))
+		buf = buf[BATCH_MSG_OVERHEAD:]
+		if size == 0 || size > len(buf) {
+			return nil, ERR_MALFORMED_MSG
+		}
+		msgs = append(msgs, buf[:size])
+		buf = buf[size:]
+	}
+	return msgs, nil
+}
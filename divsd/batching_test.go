@@ -0,0 +1,65 @@
+package divsd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	b := NewBatch(100)
+	msg1 := bytes.Repeat([]byte{byte(MSG_DIVS_PKG_ETH)}, 40)
+	msg2 := bytes.Repeat([]byte{byte(MSG_DIVS_RELAY)}, 40)
+
+	// a single message is sent as it is
+	if !b.Add(msg1) {
+		t.Fatalf("message not added")
+	}
+	if !bytes.Equal(b.Bytes(), msg1) {
+		t.Errorf("single message batched")
+	}
+
+	// messages are added until the batch is full
+	if !b.Add(msg2) {
+		t.Fatalf("message not added")
+	}
+	if b.Add(msg1) {
+		t.Fatalf("message added to a full batch")
+	}
+	buf := b.Bytes()
+	if len(buf) > 100 || messageType(buf[0]) != MSG_DIVS_BATCH {
+		t.Fatalf("unexpected batch: %d bytes, type %d", len(buf), buf[0])
+	}
+	msgs, err := unpackBatch(buf[1:])
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if len(msgs) != 2 || !bytes.Equal(msgs[0], msg1) || !bytes.Equal(msgs[1], msg2) {
+		t.Errorf("unexpected messages in batch: %v", msgs)
+	}
+
+	b.Reset()
+	if b.Len() != 0 || len(b.Bytes()) != 1 {
+		t.Errorf("batch not empty after a reset")
+	}
+
+	// truncated batches are rejected
+	if _, err := unpackBatch(buf[1 : len(buf)-1]); err != ERR_MALFORMED_MSG {
+		t.Errorf("truncated batch accepted")
+	}
+}
+
+func TestSendQueuePopTimeout(t *testing.T) {
+	q := NewSendQueue(NewConfig().Qos)
+	if _, ok := q.PopTimeout(time.Millisecond); ok {
+		t.Fatalf("data popped from an empty queue")
+	}
+	q.Push(&Keepalive{From: "node1"})
+	if data, ok := q.PopTimeout(time.Millisecond); !ok || data.(*Keepalive).From != "node1" {
+		t.Fatalf("data not popped")
+	}
+	q.Close()
+	if _, ok := q.PopTimeout(time.Second); ok {
+		t.Fatalf("data popped from a closed queue")
+	}
+}
@@ -0,0 +1,37 @@
+package divsd
+
+import (
+	"github.com/hashicorp/memberlist"
+)
+
+// number of retransmissions (multiplied by log(N+1)) for gossip broadcasts
+const BROADCASTS_RETRANSMIT_MULT = 3
+
+// A message broadcasted with the gossip protocol
+// Broadcasts with the same (non-empty) key invalidate previous ones.
+type broadcast struct {
+	key string
+	msg []byte
+}
+
+func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*broadcast)
+	return ok && len(b.key) > 0 && b.key == o.key
+}
+
+func (b *broadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *broadcast) Finished() {
+}
+
+// Enqueue some data for broadcasting it to all the nodes
+func (nm *NodesManager) Broadcast(key string, data Encodeable) error {
+	msg, err := data.Encode()
+	if err != nil {
+		return err
+	}
+	nm.broadcasts.QueueBroadcast(&broadcast{key: key, msg: msg})
+	return nil
+}
@@ -0,0 +1,284 @@
+package divsd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Capture points
+const (
+	CAPTURE_TAP_IN      = "tap-in"      // frames read from the TAP device
+	CAPTURE_OVERLAY_OUT = "overlay-out" // packets sent to other nodes
+	CAPTURE_OVERLAY_IN  = "overlay-in"  // packets received from other nodes
+	CAPTURE_TAP_OUT     = "tap-out"     // frames written to the TAP device
+)
+
+// all the capture points, in the order used for the pcapng interfaces
+var capturePoints = []string{CAPTURE_TAP_IN, CAPTURE_OVERLAY_OUT, CAPTURE_OVERLAY_IN, CAPTURE_TAP_OUT}
+
+// the queue length for packets waiting to be written to a capture
+const CAPTURE_QUEUE_LEN = 1000
+
+// Unknown capture
+var ERR_UNKNOWN_CAPTURE = fmt.Errorf("Unknown capture")
+
+// The options for a capture
+type CaptureOptions struct {
+	Points []string `json:"points"`         // capture points (all of them if empty)
+	Filter string   `json:"filter"`         // capture filter (see parseCaptureFilter)
+	Peer   string   `json:"peer,omitempty"` // only packets from/to this node in the overlay points
+	Count  int      `json:"count"`          // stop after capturing some packets (0 for no limit)
+	File   string   `json:"file,omitempty"` // the file in the captures directory (empty for a stream)
+}
+
+// a packet captured, waiting to be written
+type capturedPacket struct {
+	iface int
+	ts    time.Time
+	frame []byte
+	peer  string
+}
+
+// A capture session: packets matching the options are written, in pcapng
+// format, to a file or a stream
+type CaptureSession struct {
+	ID      int
+	Options CaptureOptions
+	Started time.Time
+
+	filter   captureFilter
+	points   map[string]int // capture point -> pcapng interface
+	writer   *PcapngWriter
+	output   io.Closer
+	queue    chan capturedPacket
+	done     chan struct{} // closed when everything has been written
+	captured uint64
+	dropped  uint64
+}
+
+// The information about a capture session, as exposed in the control API
+type CaptureInfo struct {
+	ID       int            `json:"id"`
+	Options  CaptureOptions `json:"options"`
+	Started  time.Time      `json:"started"`
+	Captured uint64         `json:"captured"`
+	Dropped  uint64         `json:"dropped"`
+}
+
+// Get a channel that is closed when the session has finished
+func (s *CaptureSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Get the information about this session
+func (s *CaptureSession) Info() CaptureInfo {
+	return CaptureInfo{
+		ID:       s.ID,
+		Options:  s.Options,
+		Started:  s.Started,
+		Captured: atomic.LoadUint64(&s.captured),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+	}
+}
+
+// The captures manager: it keeps the capture sessions, and it passes them the
+// packets seen at the capture points
+type CaptureManager struct {
+	dir      string // the directory for the capture files
+	sessions map[int]*CaptureSession
+	active   int32 // number of sessions (for a fast check in the packets path)
+	nextID   int
+	mutex    sync.RWMutex
+}
+
+// Create a new captures manager, with capture files in some directory
+func NewCaptureManager(dir string) *CaptureManager {
+	return &CaptureManager{
+		dir:      dir,
+		sessions: make(map[int]*CaptureSession),
+		nextID:   1,
+	}
+}
+
+// Start a capture session, writing to some output (that is closed when the
+// session finishes)
+func (cm *CaptureManager) Start(opts CaptureOptions, output io.WriteCloser) (*CaptureSession, error) {
+	filter, err := parseCaptureFilter(opts.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %s", err)
+	}
+	if len(opts.Points) == 0 {
+		opts.Points = capturePoints
+	}
+	points := make(map[string]int)
+	for _, point := range opts.Points {
+		found := false
+		for i, p := range capturePoints {
+			if p == point {
+				points[point], found = i, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown capture point '%s'", point)
+		}
+	}
+	if opts.Count < 0 {
+		return nil, fmt.Errorf("invalid count %d", opts.Count)
+	}
+	writer, err := NewPcapngWriter(output, capturePoints)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	s := &CaptureSession{
+		ID:      cm.nextID,
+		Options: opts,
+		Started: time.Now(),
+		filter:  filter,
+		points:  points,
+		writer:  writer,
+		output:  output,
+		queue:   make(chan capturedPacket, CAPTURE_QUEUE_LEN),
+		done:    make(chan struct{}),
+	}
+	cm.nextID++
+	cm.sessions[s.ID] = s
+	atomic.AddInt32(&cm.active, 1)
+	log.Info("Capture %d started (points: %s, filter: '%s')", s.ID, strings.Join(opts.Points, ","), opts.Filter)
+
+	go cm.write(s)
+	return s, nil
+}
+
+// Start a capture session writing to a file in the captures directory
+func (cm *CaptureManager) StartFile(opts CaptureOptions) (*CaptureSession, error) {
+	if len(opts.File) == 0 || filepath.Base(opts.File) != opts.File || strings.HasPrefix(opts.File, ".") {
+		return nil, fmt.Errorf("invalid file name '%s'", opts.File)
+	}
+	if err := os.MkdirAll(cm.dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(cm.dir, opts.File))
+	if err != nil {
+		return nil, err
+	}
+	s, err := cm.Start(opts, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Stop a capture session
+// The packets already captured are still written.
+func (cm *CaptureManager) Stop(id int) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	s, found := cm.sessions[id]
+	if !found {
+		return ERR_UNKNOWN_CAPTURE
+	}
+	delete(cm.sessions, id)
+	atomic.AddInt32(&cm.active, -1)
+	close(s.queue)
+	return nil
+}
+
+// Stop all the capture sessions
+func (cm *CaptureManager) StopAll() {
+	for _, info := range cm.Sessions() {
+		cm.Stop(info.ID)
+	}
+}
+
+// Get the information about all the sessions, sorted by ID
+func (cm *CaptureManager) Sessions() []CaptureInfo {
+	cm.mutex.RLock()
+	res := make([]CaptureInfo, 0, len(cm.sessions))
+	for _, s := range cm.sessions {
+		res = append(res, s.Info())
+	}
+	cm.mutex.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Capture a packet at some point, from/to some peer for the overlay points
+// The frame is serialized from the packet when not provided.
+func (cm *CaptureManager) Capture(point string, peer string, pkt *EthernetPacket, frame []byte) {
+	if atomic.LoadInt32(&cm.active) == 0 {
+		return
+	}
+
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	var fp *filterPacket
+	now := time.Now()
+	for _, s := range cm.sessions {
+		iface, found := s.points[point]
+		if !found || (len(s.Options.Peer) > 0 && s.Options.Peer != peer) {
+			continue
+		}
+		if fp == nil {
+			fp = newFilterPacket(pkt)
+		}
+		if !s.filter(fp) {
+			continue
+		}
+		if frame == nil {
+			var err error
+			if frame, err = pkt.Bytes(); err != nil {
+				log.Debug("Could not serialize packet for capture: %s", err)
+				return
+			}
+		}
+		select {
+		case s.queue <- capturedPacket{iface: iface, ts: now, frame: frame, peer: peer}:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			metrics.Inc("capture.dropped")
+		}
+	}
+}
+
+// write the packets captured by a session
+func (cm *CaptureManager) write(s *CaptureSession) {
+	defer close(s.done)
+	defer s.output.Close()
+
+	stopped := false
+	for p := range s.queue {
+		if stopped {
+			continue // drain the queue
+		}
+		comment := ""
+		if len(p.peer) > 0 {
+			comment = "peer=" + p.peer
+		}
+		if err := s.writer.WritePacket(p.iface, p.ts, p.frame, comment); err != nil {
+			log.Info("Capture %d: could not write packet: %s", s.ID, err)
+			stopped = true
+			cm.Stop(s.ID)
+			continue
+		}
+		captured := atomic.AddUint64(&s.captured, 1)
+		if s.Options.Count > 0 && captured >= uint64(s.Options.Count) {
+			stopped = true
+			cm.Stop(s.ID)
+		}
+	}
+	log.Info("Capture %d finished: %d packets captured", s.ID, atomic.LoadUint64(&s.captured))
+}
@@ -0,0 +1,222 @@
+package divsd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/gopacket/layers"
+)
+
+// A capture filter: a function that checks the fields of a packet
+type captureFilter func(fp *filterPacket) bool
+
+// the protocols that can be used in capture filters
+var captureProtocols = map[string]captureFilter{
+	"ip":    func(fp *filterPacket) bool { return fp.etherType == layers.EthernetTypeIPv4 },
+	"ip6":   func(fp *filterPacket) bool { return fp.etherType == layers.EthernetTypeIPv6 },
+	"arp":   func(fp *filterPacket) bool { return fp.etherType == layers.EthernetTypeARP },
+	"tcp":   func(fp *filterPacket) bool { return fp.proto == int(layers.IPProtocolTCP) },
+	"udp":   func(fp *filterPacket) bool { return fp.proto == int(layers.IPProtocolUDP) },
+	"sctp":  func(fp *filterPacket) bool { return fp.proto == int(layers.IPProtocolSCTP) },
+	"icmp":  func(fp *filterPacket) bool { return fp.proto == int(layers.IPProtocolICMPv4) },
+	"icmp6": func(fp *filterPacket) bool { return fp.proto == int(layers.IPProtocolICMPv6) },
+	"igmp":  func(fp *filterPacket) bool { return fp.proto == int(layers.IPProtocolIGMP) },
+	"broadcast": func(fp *filterPacket) bool {
+		return fp.dstMAC == "ff:ff:ff:ff:ff:ff"
+	},
+	"multicast": func(fp *filterPacket) bool {
+		mac, _ := net.ParseMAC(fp.dstMAC)
+		return !isUnicastMac(mac) && fp.dstMAC != "ff:ff:ff:ff:ff:ff"
+	},
+}
+
+// the parser for capture filters
+type captureFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+// Parse a capture filter, written with a subset of the tcpdump/BPF syntax:
+// primitives like "host 10.0.0.1", "src net 10.0.0.0/8", "dst port 80",
+// "portrange 1000-2000", "ether host 02:00:00:00:00:01", "vlan 10", "tcp",
+// "arp" or "multicast", combined with "and", "or", "not" and parenthesis.
+// An empty filter matches all the packets.
+func parseCaptureFilter(expr string) (captureFilter, error) {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	p := &captureFilterParser{tokens: strings.Fields(strings.ToLower(expr))}
+	if len(p.tokens) == 0 {
+		return func(fp *filterPacket) bool { return true }, nil
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// get the next token (or an empty string at the end)
+func (p *captureFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *captureFilterParser) next() string {
+	t := p.peek()
+	if len(t) > 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *captureFilterParser) parseOr() (captureFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(fp *filterPacket) bool { return l(fp) || right(fp) }
+	}
+	return left, nil
+}
+
+func (p *captureFilterParser) parseAnd() (captureFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(fp *filterPacket) bool { return l(fp) && right(fp) }
+	}
+	return left, nil
+}
+
+func (p *captureFilterParser) parseUnary() (captureFilter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(fp *filterPacket) bool { return !f(fp) }, nil
+	case "(":
+		p.next()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return f, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *captureFilterParser) parsePrimitive() (captureFilter, error) {
+	tok := p.next()
+	if len(tok) == 0 {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	if f, found := captureProtocols[tok]; found {
+		return f, nil
+	}
+
+	switch tok {
+	case "vlan":
+		vlan, err := strconv.ParseUint(p.peek(), 10, 16)
+		if err != nil {
+			return func(fp *filterPacket) bool { return fp.tagged }, nil
+		}
+		p.next()
+		if !validVlan(int(vlan)) {
+			return nil, ERR_INVALID_VLAN
+		}
+		return func(fp *filterPacket) bool { return fp.vlan == uint16(vlan) }, nil
+
+	case "ether":
+		dir := p.parseDirection()
+		if p.peek() == "host" {
+			p.next()
+		}
+		value := p.next()
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC '%s'", value)
+		}
+		m := mac.String()
+		return directional(dir, func(fp *filterPacket) bool { return fp.srcMAC == m },
+			func(fp *filterPacket) bool { return fp.dstMAC == m }), nil
+	}
+
+	// [src|dst] host/net/port/portrange
+	p.pos--
+	dir := p.parseDirection()
+	switch kind := p.next(); kind {
+	case "host":
+		value := p.next()
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host '%s'", value)
+		}
+		return directional(dir, func(fp *filterPacket) bool { return ip.Equal(fp.src) },
+			func(fp *filterPacket) bool { return ip.Equal(fp.dst) }), nil
+	case "net":
+		prefix, err := parsePrefix(p.next())
+		if err != nil {
+			return nil, err
+		}
+		return directional(dir, func(fp *filterPacket) bool { return fp.src != nil && prefix.Contains(fp.src) },
+			func(fp *filterPacket) bool { return fp.dst != nil && prefix.Contains(fp.dst) }), nil
+	case "port", "portrange":
+		ports, err := parsePortRange(p.next())
+		if err != nil {
+			return nil, err
+		}
+		return directional(dir, func(fp *filterPacket) bool { return fp.sport >= 0 && ports.contains(fp.sport) },
+			func(fp *filterPacket) bool { return fp.dport >= 0 && ports.contains(fp.dport) }), nil
+	case "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	default:
+		return nil, fmt.Errorf("unknown primitive '%s'", kind)
+	}
+}
+
+// parse an optional "src" or "dst" qualifier
+func (p *captureFilterParser) parseDirection() string {
+	switch p.peek() {
+	case "src", "dst":
+		return p.next()
+	}
+	return ""
+}
+
+// get a filter for the source, the destination or any of them
+func directional(dir string, src captureFilter, dst captureFilter) captureFilter {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return func(fp *filterPacket) bool { return src(fp) || dst(fp) }
+}
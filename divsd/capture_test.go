@@ -0,0 +1,145 @@
+package divsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// a buffer that can be used as the output of a capture
+type captureBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *captureBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// get the types of the blocks in a pcapng file
+func pcapngBlocks(t *testing.T, data []byte) []uint32 {
+	blocks := []uint32{}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block")
+		}
+		blockType := binary.LittleEndian.Uint32(data[0:])
+		total := int(binary.LittleEndian.Uint32(data[4:]))
+		if total%4 != 0 || total > len(data) || binary.LittleEndian.Uint32(data[total-4:]) != uint32(total) {
+			t.Fatalf("invalid block length %d", total)
+		}
+		blocks = append(blocks, blockType)
+		data = data[total:]
+	}
+	return blocks
+}
+
+func TestCaptureFilter(t *testing.T) {
+	ssh := newTestTCPPacket(t, 0, "192.168.1.1", 22)
+	tagged := newTestTCPPacket(t, 10, "172.16.1.1", 80)
+
+	for _, test := range []struct {
+		expr   string
+		ssh    bool
+		tagged bool
+	}{
+		{"", true, true},
+		{"tcp", true, true},
+		{"udp", false, false},
+		{"tcp and port 22", true, false},
+		{"dst host 192.168.1.1", true, false},
+		{"src host 192.168.1.1", false, false},
+		{"net 172.16.0.0/12 or dst port 22", true, true},
+		{"not (ip and dst portrange 1-1023) or vlan 10", false, true},
+		{"vlan", false, true},
+		{"ether src 02:00:00:00:00:01 && !arp", true, true},
+		{"multicast or broadcast", false, false},
+	} {
+		f, err := parseCaptureFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected err: %s", test.expr, err)
+			continue
+		}
+		if f(newFilterPacket(ssh)) != test.ssh || f(newFilterPacket(tagged)) != test.tagged {
+			t.Errorf("%q: unexpected result", test.expr)
+		}
+	}
+
+	for _, expr := range []string{"foo", "host", "host 10.0.0", "tcp and", "(tcp", "tcp)", "port 99999", "vlan 5000"} {
+		if _, err := parseCaptureFilter(expr); err == nil {
+			t.Errorf("invalid filter %q not detected", expr)
+		}
+	}
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf, capturePoints)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if err := w.WritePacket(1, time.Now(), []byte("0123456789"), "peer=node1"); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	blocks := pcapngBlocks(t, buf.Bytes())
+	expected := []uint32{PCAPNG_SECTION_HEADER, PCAPNG_INTERFACE_DESC, PCAPNG_INTERFACE_DESC,
+		PCAPNG_INTERFACE_DESC, PCAPNG_INTERFACE_DESC, PCAPNG_ENHANCED_PACKET}
+	if len(blocks) != len(expected) {
+		t.Fatalf("unexpected blocks: %v", blocks)
+	}
+	for i := range blocks {
+		if blocks[i] != expected[i] {
+			t.Errorf("block %d: expected type %x, got %x", i, expected[i], blocks[i])
+		}
+	}
+}
+
+func TestCaptureManager(t *testing.T) {
+	cm := NewCaptureManager(t.TempDir())
+	out := &captureBuffer{}
+	s, err := cm.Start(CaptureOptions{Points: []string{CAPTURE_OVERLAY_OUT}, Filter: "tcp", Peer: "node1", Count: 2}, out)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	pkt := newTestTCPPacket(t, 0, "192.168.1.1", 22)
+	cm.Capture(CAPTURE_TAP_IN, "", pkt, nil)           // other point
+	cm.Capture(CAPTURE_OVERLAY_OUT, "node2", pkt, nil) // other peer
+	cm.Capture(CAPTURE_OVERLAY_OUT, "node1", newTestPacket(), nil)
+	for i := 0; i < 3; i++ {
+		cm.Capture(CAPTURE_OVERLAY_OUT, "node1", pkt, nil)
+	}
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("capture did not finish")
+	}
+	if !out.closed || len(cm.Sessions()) != 0 {
+		t.Fatalf("capture not stopped")
+	}
+	blocks := pcapngBlocks(t, out.Bytes())
+	if len(blocks) != 1+len(capturePoints)+2 {
+		t.Errorf("unexpected number of blocks: %d", len(blocks))
+	}
+
+	if _, err := cm.Start(CaptureOptions{Points: []string{"nowhere"}}, &captureBuffer{}); err == nil {
+		t.Errorf("unknown capture point not detected")
+	}
+	if _, err := cm.StartFile(CaptureOptions{File: "../escape.pcapng"}); err == nil {
+		t.Errorf("invalid file name not detected")
+	}
+	s, err = cm.StartFile(CaptureOptions{File: "test.pcapng"})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if err := cm.Stop(s.ID); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	<-s.Done()
+	if err := cm.Stop(s.ID); err != ERR_UNKNOWN_CAPTURE {
+		t.Errorf("unexpected err: %v", err)
+	}
+}
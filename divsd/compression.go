@@ -0,0 +1,156 @@
+package divsd
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+// The protocol feature published by nodes that accept compressed frames
+const FEATURE_SNAPPY = "snappy"
+
+// The flag set in the message type (the first byte of a message) when the
+// rest of the message is compressed
+// All the message types must be lower than this flag.
+const MSG_FLAG_COMPRESSED = 0x80
+
+// the default minimum size (in bytes) of the messages we try to compress
+const DEFAULT_COMPRESSION_MIN = 128
+
+// the maximum size of a decompressed message: a frame read from the TAP
+// device, with the encoding overhead (the node names for relayed packets...)
+const COMPRESSION_MAX_LEN = TAP_BUFFER_LEN + 1024
+
+// Malformed compressed message
+var ERR_MALFORMED_COMPRESSED = fmt.Errorf("Malformed compressed message")
+
+// The compression statistics, as exposed in the control API
+type CompressionInfo struct {
+	Enabled       bool    `json:"enabled"`
+	Frames        uint64  `json:"frames"`         // frames that could be compressed
+	Compressed    uint64  `json:"compressed"`     // frames sent compressed
+	BytesIn       uint64  `json:"bytes_in"`       // size of those frames before compressing
+	BytesOut      uint64  `json:"bytes_out"`      // size of those frames sent
+	Ratio         float64 `json:"ratio"`          // bytes_in / bytes_out
+	Received      uint64  `json:"received"`       // compressed frames received
+	ReceivedBytes uint64  `json:"received_bytes"` // size of the compressed frames received
+}
+
+// The compressor for the frames sent to other nodes
+// Only the frames (Ethernet packets, direct or relayed, and mirrored frames)
+// sent to nodes that accept compressed frames are compressed, and they are
+// sent compressed only when that makes them smaller.
+type Compressor struct {
+	enabled       bool
+	min           int
+	frames        uint64
+	compressed    uint64
+	bytesIn       uint64
+	bytesOut      uint64
+	received      uint64
+	receivedBytes uint64
+	mutex         sync.RWMutex
+}
+
+// Create a new compressor
+func NewCompressor(c compressionConfig) *Compressor {
+	comp := &Compressor{}
+	comp.SetConfig(c)
+	return comp
+}
+
+// Set the compression configuration
+func (comp *Compressor) SetConfig(c compressionConfig) {
+	comp.mutex.Lock()
+	defer comp.mutex.Unlock()
+	comp.enabled = c.Enabled
+	comp.min = c.Min
+}
+
+// Return `true` if the compression is enabled
+func (comp *Compressor) Enabled() bool {
+	comp.mutex.RLock()
+	defer comp.mutex.RUnlock()
+	return comp.enabled
+}
+
+// Compress some data encoded in a buffer for sending to a node (with some
+// metadata), returning the buffer to send
+func (comp *Compressor) Compress(data Encodeable, buf []byte, meta *NodeMeta) []byte {
+	if !compressible(data) || len(buf) < 2 || buf[0]&MSG_FLAG_COMPRESSED != 0 {
+		return buf
+	}
+	comp.mutex.RLock()
+	enabled, min := comp.enabled, comp.min
+	comp.mutex.RUnlock()
+	if !enabled || len(buf) < min || len(buf)-1 > COMPRESSION_MAX_LEN || meta == nil || !meta.HasFeature(FEATURE_SNAPPY) {
+		return buf
+	}
+
+	atomic.AddUint64(&comp.frames, 1)
+	atomic.AddUint64(&comp.bytesIn, uint64(len(buf)))
+
+	res := make([]byte, 1+snappy.MaxEncodedLen(len(buf)-1))
+	res[0] = buf[0] | MSG_FLAG_COMPRESSED
+	res = res[:1+len(snappy.Encode(res[1:], buf[1:]))]
+	if len(res) >= len(buf) {
+		atomic.AddUint64(&comp.bytesOut, uint64(len(buf)))
+		return buf
+	}
+	atomic.AddUint64(&comp.compressed, 1)
+	atomic.AddUint64(&comp.bytesOut, uint64(len(res)))
+	return res
+}
+
+// Decompress a message received, if it is compressed
+func (comp *Compressor) Decompress(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0]&MSG_FLAG_COMPRESSED == 0 {
+		return buf, nil
+	}
+	// do not trust the length declared by the peer before allocating anything
+	size, err := snappy.DecodedLen(buf[1:])
+	if err != nil || size <= 0 || size > COMPRESSION_MAX_LEN {
+		return nil, ERR_MALFORMED_COMPRESSED
+	}
+	res := make([]byte, 1+size)
+	payload, err := snappy.Decode(res[1:], buf[1:])
+	if err != nil || len(payload) != size {
+		return nil, ERR_MALFORMED_COMPRESSED
+	}
+	res[0] = buf[0] &^ MSG_FLAG_COMPRESSED
+
+	atomic.AddUint64(&comp.received, 1)
+	atomic.AddUint64(&comp.receivedBytes, uint64(len(buf)))
+	return res, nil
+}
+
+// Get the compression statistics
+func (comp *Compressor) Info() CompressionInfo {
+	comp.mutex.RLock()
+	enabled := comp.enabled
+	comp.mutex.RUnlock()
+	info := CompressionInfo{
+		Enabled:       enabled,
+		Frames:        atomic.LoadUint64(&comp.frames),
+		Compressed:    atomic.LoadUint64(&comp.compressed),
+		BytesIn:       atomic.LoadUint64(&comp.bytesIn),
+		BytesOut:      atomic.LoadUint64(&comp.bytesOut),
+		Received:      atomic.LoadUint64(&comp.received),
+		ReceivedBytes: atomic.LoadUint64(&comp.receivedBytes),
+	}
+	if info.BytesOut > 0 {
+		info.Ratio = float64(info.BytesIn) / float64(info.BytesOut)
+	}
+	return info
+}
+
+// check if some data can be compressed
+func compressible(data Encodeable) bool {
+	if packet, _ := ethernetPacketIn(data); packet != nil {
+		return true
+	}
+	_, mirrored := data.(*MirroredPacket)
+	return mirrored
+}
@@ -0,0 +1,66 @@
+package divsd
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	comp := NewCompressor(compressionConfig{Enabled: true, Min: DEFAULT_COMPRESSION_MIN})
+	peer := &NodeMeta{Features: []string{FEATURE_VLAN, FEATURE_SNAPPY}}
+
+	pkt := newTestPacket()
+	pkt.Payload = bytes.Repeat([]byte("0123456789"), 100)
+	buf, _ := pkt.Encode()
+
+	// compressed frames are smaller, and they are decompressed back
+	compressed := comp.Compress(pkt, buf, peer)
+	if len(compressed) >= len(buf) || compressed[0]&MSG_FLAG_COMPRESSED == 0 {
+		t.Fatalf("frame not compressed: %d bytes", len(compressed))
+	}
+	decompressed, err := comp.Decompress(compressed)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if !bytes.Equal(decompressed, buf) {
+		t.Fatalf("decompressed frame differs from the original")
+	}
+
+	// not compressed for peers that do not accept it, or for control messages
+	if res := comp.Compress(pkt, buf, &NodeMeta{Features: []string{FEATURE_VLAN}}); !bytes.Equal(res, buf) {
+		t.Errorf("frame compressed for a peer without compression")
+	}
+	ka, _ := Keepalive{From: "node1", Seq: 1}.Encode()
+	if res := comp.Compress(&Keepalive{From: "node1", Seq: 1}, ka, peer); !bytes.Equal(res, ka) {
+		t.Errorf("keepalive compressed")
+	}
+
+	// incompressible frames are sent as they are
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	pkt.Payload = random
+	buf, _ = pkt.Encode()
+	if res := comp.Compress(pkt, buf, peer); !bytes.Equal(res, buf) {
+		t.Errorf("incompressible frame compressed")
+	}
+
+	info := comp.Info()
+	if info.Frames != 2 || info.Compressed != 1 || info.Received != 1 || info.Ratio <= 1 {
+		t.Errorf("unexpected stats: %+v", info)
+	}
+
+	// uncompressed messages are passed, malformed ones are rejected
+	if res, err := comp.Decompress(ka); err != nil || !bytes.Equal(res, ka) {
+		t.Errorf("uncompressed message modified")
+	}
+	if _, err := comp.Decompress([]byte{byte(MSG_DIVS_PKG_ETH) | MSG_FLAG_COMPRESSED, 0xff, 0xff}); err != ERR_MALFORMED_COMPRESSED {
+		t.Errorf("malformed message accepted")
+	}
+
+	// a header claiming a huge decompressed size is rejected before allocating it
+	huge := []byte{byte(MSG_DIVS_PKG_ETH) | MSG_FLAG_COMPRESSED, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x00}
+	if _, err := comp.Decompress(huge); err != ERR_MALFORMED_COMPRESSED {
+		t.Errorf("message with a 0xffffffff bytes header accepted")
+	}
+}
@@ -1,20 +1,63 @@
 package divsd
 
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/inercia/divs/divsd/nat"
+	logging "github.com/op/go-logging"
+)
+
+// default port for the memberlist management (UDP and TCP)
+const DEFAULT_PORT = 7946
+
+// default number of readers for the TAP device
+const DEFAULT_NUM_READERS = 10
+
+// default interval (in seconds) for re-checking our external address
+const DEFAULT_NAT_RECHECK = 300
+
 // The top configuration structure for the DiVS daemon
 type Config struct {
-	Global   globalConfig
-	Discover discoverConfig
-	Mdns     mdnsConfig
-	Tun      tunConfig
+	Global      globalConfig
+	Discover    discoverConfig
+	Mdns        mdnsConfig
+	Tun         tunConfig
+	Crypto      cryptoConfig
+	Control     controlConfig
+	Relay       relayConfig
+	Nat         natConfig
+	Vlan        vlanConfig
+	Switch      map[string]*switchConfig // additional switches, as [switch "name"] sections
+	Security    securityConfig
+	Node        map[string]*nodeConfig // settings for some nodes, as [node "name"] sections
+	Filter      filterConfig
+	Ratelimit   rateLimitConfig
+	Storm       stormConfig
+	Snooping    snoopingConfig
+	Capture     captureConfig
+	Mirror      map[string]*mirrorConfig // port mirroring sessions, as [mirror "name"] sections
+	Mirrorsink  mirrorSinkConfig
+	Qos         qosConfig
+	Compression compressionConfig
+	Batching    batchingConfig
 }
 
 // Global config
 type globalConfig struct {
-	Name   string
-	Host   string
-	Port   int
-	BindIP string
-	Serial UUID
+	Name     string
+	Host     string
+	Port     int
+	BindIP   string
+	Serial   UUID
+	Pidfile  string
+	LogLevel string
+	StateDir string
+	Site     string
+	Region   string
 }
 
 // MDNS discovery
@@ -25,6 +68,7 @@ type mdnsConfig struct {
 // DHT discovery
 type discoverConfig struct {
 	Port int
+	Peer []string // static peers, as IP:port
 }
 
 // NAT: TUN config
@@ -32,8 +76,614 @@ type tunConfig struct {
 	NumReaders int
 }
 
+// Encryption
+type cryptoConfig struct {
+	Key []string // base64-encoded keys: the first one is the primary key
+}
+
+// Relays
+type relayConfig struct {
+	Enabled bool   // provide the relay capability to other nodes
+	Via     string // force the relay (node name) other nodes must use for reaching us
+}
+
+// NAT traversal
+type natConfig struct {
+	Order      string // comma-separated list of mechanisms, in the order they are tried
+	Upnp       bool
+	Pcp        bool
+	Natpmp     bool
+	Stun       bool
+	Gateway    string   // gateway for PCP and NAT-PMP (default: the default gateway)
+	StunServer []string // STUN servers, as host:port (default: some public servers)
+	Recheck    int      // seconds between checks of our external address (0 disables it)
+	Keepalive  bool     // send keepalives to peers, keeping the NAT mappings active
+}
+
+// Get the NAT traversal mechanisms enabled, in the order they must be tried
+func (c natConfig) Resolvers() []string {
+	enabled := map[string]bool{
+		"upnp":   c.Upnp,
+		"pcp":    c.Pcp,
+		"natpmp": c.Natpmp,
+		"stun":   c.Stun,
+	}
+	res := []string{}
+	for _, name := range strings.Split(c.Order, ",") {
+		name = strings.TrimSpace(name)
+		if enabled[name] {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// VLANs in the TAP device
+type vlanConfig struct {
+	Mode    string   // "access" (untagged frames, in one VLAN) or "trunk" (802.1Q tagged frames)
+	Access  int      // VLAN for the TAP device in access mode
+	Native  int      // VLAN for untagged frames in trunk mode (0 drops them)
+	Allowed []string // VLANs (or ranges, like 10-20) allowed in trunk mode (default: all)
+}
+
+// Port security: the MACs a node may originate
+type securityConfig struct {
+	Mac        []string // MACs (or OUIs, like 00:16:3e) allowed (default: any)
+	MaxMacs    int      // maximum number of MACs a node may originate (0 for no limit)
+	Action     string   // action on violations: "drop", "log" or "quarantine" (the node)
+	Quarantine int      // seconds a node is quarantined (0 for as long as it is in the switch)
+}
+
+// Settings for some node: port security for the MACs it originates, and rate
+// limits for the traffic sent to it (0 for the ones in [security] and [ratelimit])
+type nodeConfig struct {
+	Mac                []string
+	MaxMacs            int
+	Action             string
+	Quarantine         int
+	Ratelimit          int // the unicast traffic to this node
+	RatelimitBroadcast int // the broadcast/multicast traffic to this node
+}
+
+// Get the port security configuration for a node: the settings in the
+// [node "name"] section, with the ones not present taken from [security]
+func (c *Config) NodeSecurity(name string) securityConfig {
+	res := c.Security
+	if sc, found := c.Node[name]; found {
+		if len(sc.Mac) > 0 {
+			res.Mac = sc.Mac
+		}
+		if sc.MaxMacs > 0 {
+			res.MaxMacs = sc.MaxMacs
+		}
+		if len(sc.Action) > 0 {
+			res.Action = sc.Action
+		}
+		if sc.Quarantine > 0 {
+			res.Quarantine = sc.Quarantine
+		}
+	}
+	return res
+}
+
+// Get the rate limits (unicast and broadcast/multicast) for the traffic sent to
+// a node: the ones in the [node "name"] section, or the ones in [ratelimit]
+func (c *Config) NodeRateLimits(name string) (int, int) {
+	unicast, broadcast := c.Ratelimit.Node, c.Ratelimit.NodeBroadcast
+	if nc, found := c.Node[name]; found {
+		if nc.Ratelimit > 0 {
+			unicast = nc.Ratelimit
+		}
+		if nc.RatelimitBroadcast > 0 {
+			broadcast = nc.RatelimitBroadcast
+		}
+	}
+	return unicast, broadcast
+}
+
+// Packets filtering
+type filterConfig struct {
+	Default string   // action for packets not matching any rule: "allow" or "drop"
+	Rule    []string // rules for this node
+	Shared  []string // rules published to all the nodes in the switch
+}
+
+// Rate limits for the traffic sent to other nodes, in kilobytes per second
+// (0 for no limit)
+type rateLimitConfig struct {
+	Global          int // all the unicast traffic
+	Node            int // the unicast traffic to each remote node
+	Mac             int // the unicast traffic from each local MAC
+	GlobalBroadcast int // all the broadcast/multicast traffic
+	NodeBroadcast   int // the broadcast/multicast traffic to each remote node
+	MacBroadcast    int // the broadcast/multicast traffic from each local MAC
+}
+
+// Storm control and L2 loops detection
+type stormConfig struct {
+	Broadcast  int    // maximum broadcast packets per second from a node (0 for no limit)
+	Multicast  int    // maximum multicast packets per second from a node
+	Unknown    int    // maximum unknown unicast packets per second from a node
+	Flaps      int    // number of moves of a MAC between nodes considered a flap (0 for disabling it)
+	FlapWindow int    // window (in seconds) for counting the moves of a MAC
+	Action     string // "block" or "log"
+	Block      int    // seconds a node is blocked
+}
+
+// IGMP/MLD snooping
+type snoopingConfig struct {
+	Enabled bool // forward multicast only to the nodes with receivers
+	Timeout int  // seconds a local receiver stays in a group without reporting it
+}
+
+// Packet captures
+type captureConfig struct {
+	Dir string // directory for the capture files (default: "captures" in the state directory)
+}
+
+// A port mirroring session: the frames for some MACs, VLANs or nodes are
+// copied to a local TAP device or to a remote node
+type mirrorConfig struct {
+	Mac    []string // frames from/to these MACs
+	Vlan   []string // frames in these VLANs
+	Node   []string // frames from/to these nodes
+	Tap    string   // the local mirror TAP device
+	Remote string   // the node receiving the mirrored frames
+}
+
+// The frames mirrored by other nodes
+type mirrorSinkConfig struct {
+	Tap string // the TAP device where they are written (empty for dropping them)
+}
+
+// Priority queueing for the data sent to other nodes
+type qosConfig struct {
+	Mode    string // "strict" or "weighted"
+	Weights string // weights for the weighted mode, as "control,arp,interactive,bulk"
+	Queue   int    // queue length for each priority class
+	Drop    string // drop policy for full queues: "tail" or "head"
+	Dscp    bool   // use the DSCP for classifying IP packets
+}
+
+// Compression of the frames sent to other nodes
+type compressionConfig struct {
+	Enabled bool // compress frames for the nodes that accept compressed frames
+	Min     int  // minimum size (in bytes) of the frames compressed
+}
+
+// Batching of the frames sent to other nodes
+type batchingConfig struct {
+	Enabled bool // coalesce frames for the nodes that accept batches
+	Mtu     int  // maximum size (in bytes) of a batch
+	Delay   int  // maximum time (in microseconds) a frame waits for other frames
+}
+
+// An additional virtual switch hosted by the daemon, with its own TAP device
+// and memberlist instance
+type switchConfig struct {
+	Serial  string   // the switch serial number
+	Port    int      // port for the memberlist of the switch (UDP and TCP)
+	DhtPort int      // port used for the DHT discovery (0 means any port)
+	Peer    []string // static peers, as host:port
+	Key     []string // base64-encoded keys: the first one is the primary key
+}
+
+// Get the configuration for an additional switch: the same configuration,
+// but with the identity, ports, peers and keys of the switch. The maps and
+// lists are copied, so the switches can not change each other's settings.
+func (c *Config) SwitchConfig(name string) *Config {
+	sc := c.Switch[name]
+	res := *c
+	res.Global.Serial = NewSwitchFromString(sc.Serial)
+	res.Global.Port = sc.Port
+	res.Discover.Port = sc.DhtPort
+	res.Discover.Peer = copyStrings(sc.Peer)
+	res.Crypto.Key = copyStrings(sc.Key)
+	res.Nat.StunServer = copyStrings(c.Nat.StunServer)
+	res.Vlan.Allowed = copyStrings(c.Vlan.Allowed)
+	res.Security.Mac = copyStrings(c.Security.Mac)
+	res.Filter.Rule = copyStrings(c.Filter.Rule)
+	res.Filter.Shared = copyStrings(c.Filter.Shared)
+	if c.Node != nil {
+		res.Node = make(map[string]*nodeConfig, len(c.Node))
+		for n, nc := range c.Node {
+			ncopy := *nc
+			ncopy.Mac = copyStrings(nc.Mac)
+			res.Node[n] = &ncopy
+		}
+	}
+	res.Control.Listen = ""
+	res.Switch = nil
+	res.Mirror = nil // mirroring is only done in the default switch
+	res.Mirrorsink = mirrorSinkConfig{}
+	return &res
+}
+
+// Control API
+type controlConfig struct {
+	Listen string // address (IP:port) for the control API, or empty for disabling it
+}
+
 // Create a new DiVS daemon configuration
 func NewConfig() (c *Config) {
 	c = &Config{}
+	c.Global.Port = DEFAULT_PORT
+	c.Tun.NumReaders = DEFAULT_NUM_READERS
+	c.Control.Listen = DEFAULT_CONTROL_ADDR
+	c.Nat.Order = strings.Join(nat.DEFAULT_RESOLVERS, ",")
+	c.Nat.Upnp = true
+	c.Nat.Pcp = true
+	c.Nat.Natpmp = true
+	c.Nat.Stun = true
+	c.Nat.Recheck = DEFAULT_NAT_RECHECK
+	c.Nat.Keepalive = true
+	c.Vlan.Mode = VLAN_MODE_ACCESS
+	c.Vlan.Access = DEFAULT_VLAN
+	c.Vlan.Native = DEFAULT_VLAN
+	c.Security.Action = SECURITY_ACTION_DROP
+	c.Security.Quarantine = DEFAULT_QUARANTINE_TIME
+	c.Filter.Default = FILTER_ALLOW
+	c.Storm.FlapWindow = DEFAULT_FLAP_WINDOW
+	c.Storm.Action = STORM_ACTION_BLOCK
+	c.Storm.Block = DEFAULT_STORM_BLOCK_TIME
+	c.Snooping.Enabled = true
+	c.Snooping.Timeout = DEFAULT_GROUP_TIMEOUT
+	c.Qos.Mode = QOS_MODE_WEIGHTED
+	c.Qos.Weights = DEFAULT_QOS_WEIGHTS
+	c.Qos.Queue = SEND_QUEUE_LEN
+	c.Qos.Drop = QOS_DROP_TAIL
+	c.Qos.Dscp = true
+	c.Compression.Min = DEFAULT_COMPRESSION_MIN
+	c.Batching.Mtu = DEFAULT_BATCH_MTU
+	c.Batching.Delay = DEFAULT_BATCH_DELAY
 	return
 }
+
+/////////////////////////////////////////////////////////////////////////////
+
+// An error in a configuration setting
+type ConfigError struct {
+	Key string // the offending setting, as "section.key"
+	Msg string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Msg)
+}
+
+// All the errors found in a configuration
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// add an error for a setting
+func (errs *ConfigErrors) add(key string, format string, args ...interface{}) {
+	*errs = append(*errs, ConfigError{Key: key, Msg: fmt.Sprintf(format, args...)})
+}
+
+// check a port number is valid (0 means "any port")
+func (errs *ConfigErrors) checkPort(key string, port int) {
+	if port < 0 || port > 65535 {
+		errs.add(key, "invalid port %d: must be in the range 0-65535", port)
+	}
+}
+
+// check a string is a valid IP address
+func (errs *ConfigErrors) checkIP(key string, ip string) {
+	if net.ParseIP(ip) == nil {
+		errs.add(key, "invalid IP address '%s'", ip)
+	}
+}
+
+// check a string is a valid address, as host:port
+func (errs *ConfigErrors) checkHostPort(key string, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(host) == 0 {
+		errs.add(key, "invalid address '%s': must be host:port", addr)
+		return
+	}
+	if portI, err := strconv.Atoi(port); err != nil || portI <= 0 || portI > 65535 {
+		errs.add(key, "invalid port in address '%s'", addr)
+	}
+}
+
+// check a port security configuration
+func (errs *ConfigErrors) checkSecurity(prefix string, sc *securityConfig) {
+	for _, mac := range sc.Mac {
+		if _, _, err := parseMacOrOui(mac); err != nil {
+			errs.add(prefix+"mac", "invalid MAC or OUI '%s'", mac)
+		}
+	}
+	if sc.MaxMacs < 0 {
+		errs.add(prefix+"maxmacs", "must be 0 (no limit) or a number of MACs")
+	}
+	switch sc.Action {
+	case "", SECURITY_ACTION_DROP, SECURITY_ACTION_LOG, SECURITY_ACTION_QUARANTINE:
+	default:
+		errs.add(prefix+"action", "unknown action '%s': must be 'drop', 'log' or 'quarantine'", sc.Action)
+	}
+	if sc.Quarantine < 0 {
+		errs.add(prefix+"quarantine", "must be 0 or a number of seconds")
+	}
+}
+
+// Get the directory for the capture files
+func (c *Config) CaptureDir() string {
+	if len(c.Capture.Dir) > 0 {
+		return c.Capture.Dir
+	}
+	return filepath.Join(c.Global.StateDir, "captures")
+}
+
+// check some filter rules
+func (errs *ConfigErrors) checkFilterRules(key string, rules []string) {
+	for _, rule := range rules {
+		if _, err := ParseFilterRule(rule); err != nil {
+			errs.add(key, "invalid rule '%s': %s", rule, err)
+		}
+	}
+}
+
+// Validate the configuration
+// It returns nil or a ConfigErrors with all the errors found.
+func (c *Config) Validate() error {
+	errs := ConfigErrors{}
+
+	// global
+	if c.Global.Port <= 0 || c.Global.Port > 65535 {
+		errs.add("global.port", "invalid port %d: must be in the range 1-65535", c.Global.Port)
+	}
+	if len(c.Global.BindIP) > 0 {
+		errs.checkIP("global.bindip", c.Global.BindIP)
+	}
+	if len(c.Global.Host) > 0 && strings.ContainsAny(c.Global.Host, " :/") && net.ParseIP(c.Global.Host) == nil {
+		errs.add("global.host", "invalid host '%s': must be an IP address or a hostname", c.Global.Host)
+	}
+	if len(c.Global.LogLevel) > 0 {
+		if _, err := logging.LogLevel(c.Global.LogLevel); err != nil {
+			errs.add("global.loglevel", "unknown log level '%s'", c.Global.LogLevel)
+		}
+	}
+
+	// discovery
+	errs.checkPort("discover.port", c.Discover.Port)
+	errs.checkPort("mdns.port", c.Mdns.Port)
+	for _, peer := range c.Discover.Peer {
+		errs.checkHostPort("discover.peer", peer)
+	}
+	if c.Discover.Port != 0 && c.Discover.Port == c.Global.Port {
+		errs.add("discover.port", "port %d is already used in global.port", c.Discover.Port)
+	}
+
+	// TAP device
+	if c.Tun.NumReaders < 1 {
+		errs.add("tun.numreaders", "must be at least 1")
+	}
+
+	// NAT traversal
+	seen := map[string]bool{}
+	for _, name := range strings.Split(c.Nat.Order, ",") {
+		name = strings.TrimSpace(name)
+		if !nat.IsResolver(name) {
+			errs.add("nat.order", "unknown NAT traversal mechanism '%s'", name)
+		} else if seen[name] {
+			errs.add("nat.order", "'%s' appears more than once", name)
+		}
+		seen[name] = true
+	}
+	if len(c.Nat.Gateway) > 0 {
+		errs.checkIP("nat.gateway", c.Nat.Gateway)
+	}
+	for _, server := range c.Nat.StunServer {
+		errs.checkHostPort("nat.stunserver", server)
+	}
+	if c.Nat.Recheck < 0 {
+		errs.add("nat.recheck", "must be 0 (disabled) or a number of seconds")
+	}
+
+	// VLANs
+	switch c.Vlan.Mode {
+	case VLAN_MODE_ACCESS, VLAN_MODE_TRUNK:
+	default:
+		errs.add("vlan.mode", "unknown mode '%s': must be 'access' or 'trunk'", c.Vlan.Mode)
+	}
+	if !validVlan(c.Vlan.Access) {
+		errs.add("vlan.access", "invalid VLAN %d: must be in the range 1-%d", c.Vlan.Access, MAX_VLAN)
+	}
+	if c.Vlan.Native != 0 && !validVlan(c.Vlan.Native) {
+		errs.add("vlan.native", "invalid VLAN %d: must be 0 or in the range 1-%d", c.Vlan.Native, MAX_VLAN)
+	}
+	for _, allowed := range c.Vlan.Allowed {
+		if _, err := ParseVlanSet([]string{allowed}); err != nil {
+			errs.add("vlan.allowed", "invalid VLANs '%s'", allowed)
+		}
+	}
+
+	// port security
+	errs.checkSecurity("security.", &c.Security)
+	if len(c.Security.Action) == 0 {
+		errs.add("security.action", "no action")
+	}
+	for _, name := range sortedNodeNames(c.Node) {
+		nc := c.Node[name]
+		prefix := fmt.Sprintf("node.%s.", name)
+		errs.checkSecurity(prefix, &securityConfig{nc.Mac, nc.MaxMacs, nc.Action, nc.Quarantine})
+		if nc.Ratelimit < 0 {
+			errs.add(prefix+"ratelimit", "invalid rate %d: must be >= 0", nc.Ratelimit)
+		}
+		if nc.RatelimitBroadcast < 0 {
+			errs.add(prefix+"ratelimitbroadcast", "invalid rate %d: must be >= 0", nc.RatelimitBroadcast)
+		}
+	}
+
+	// priority queueing
+	if c.Qos.Mode != QOS_MODE_STRICT && c.Qos.Mode != QOS_MODE_WEIGHTED {
+		errs.add("qos.mode", "unknown mode '%s': must be 'strict' or 'weighted'", c.Qos.Mode)
+	}
+	if _, err := parseQosWeights(c.Qos.Weights); err != nil {
+		errs.add("qos.weights", "%s", err)
+	}
+	if c.Qos.Queue <= 0 {
+		errs.add("qos.queue", "invalid queue length %d: must be > 0", c.Qos.Queue)
+	}
+	if c.Qos.Drop != QOS_DROP_TAIL && c.Qos.Drop != QOS_DROP_HEAD {
+		errs.add("qos.drop", "unknown drop policy '%s': must be 'tail' or 'head'", c.Qos.Drop)
+	}
+
+	// compression
+	if c.Compression.Min < 0 {
+		errs.add("compression.min", "invalid size %d: must be >= 0", c.Compression.Min)
+	}
+
+	// batching
+	if c.Batching.Mtu < BATCH_MIN_MTU || c.Batching.Mtu > BATCH_MAX_MTU {
+		errs.add("batching.mtu", "invalid size %d: must be between %d and %d", c.Batching.Mtu, BATCH_MIN_MTU, BATCH_MAX_MTU)
+	}
+	if c.Batching.Delay <= 0 {
+		errs.add("batching.delay", "invalid delay %d: must be > 0", c.Batching.Delay)
+	}
+
+	// port mirroring
+	for _, name := range sortedMirrorNames(c.Mirror) {
+		mc := c.Mirror[name]
+		prefix := fmt.Sprintf("mirror.%s.", name)
+		if len(mc.Mac) == 0 && len(mc.Vlan) == 0 && len(mc.Node) == 0 {
+			errs.add("mirror."+name, "no MACs, VLANs or nodes to mirror")
+		}
+		for _, mac := range mc.Mac {
+			if _, err := net.ParseMAC(mac); err != nil {
+				errs.add(prefix+"mac", "invalid MAC '%s'", mac)
+			}
+		}
+		if _, err := ParseVlanSet(mc.Vlan); err != nil {
+			errs.add(prefix+"vlan", "%s", err)
+		}
+		if (len(mc.Tap) == 0) == (len(mc.Remote) == 0) {
+			errs.add("mirror."+name, "either a 'tap' or a 'remote' node must be set")
+		}
+	}
+
+	// packets filtering
+	if c.Filter.Default != FILTER_ALLOW && c.Filter.Default != FILTER_DROP {
+		errs.add("filter.default", "unknown action '%s': must be 'allow' or 'drop'", c.Filter.Default)
+	}
+	errs.checkFilterRules("filter.rule", c.Filter.Rule)
+	errs.checkFilterRules("filter.shared", c.Filter.Shared)
+
+	// rate limits
+	for _, limit := range []struct {
+		key  string
+		rate int
+	}{
+		{"ratelimit.global", c.Ratelimit.Global},
+		{"ratelimit.node", c.Ratelimit.Node},
+		{"ratelimit.mac", c.Ratelimit.Mac},
+		{"ratelimit.globalbroadcast", c.Ratelimit.GlobalBroadcast},
+		{"ratelimit.nodebroadcast", c.Ratelimit.NodeBroadcast},
+		{"ratelimit.macbroadcast", c.Ratelimit.MacBroadcast},
+	} {
+		if limit.rate < 0 {
+			errs.add(limit.key, "invalid rate %d: must be >= 0", limit.rate)
+		}
+	}
+
+	// storm control
+	for _, threshold := range []struct {
+		key   string
+		value int
+	}{
+		{"storm.broadcast", c.Storm.Broadcast},
+		{"storm.multicast", c.Storm.Multicast},
+		{"storm.unknown", c.Storm.Unknown},
+		{"storm.flaps", c.Storm.Flaps},
+	} {
+		if threshold.value < 0 {
+			errs.add(threshold.key, "invalid value %d: must be >= 0", threshold.value)
+		}
+	}
+	if c.Storm.FlapWindow <= 0 {
+		errs.add("storm.flapwindow", "invalid window %d: must be > 0", c.Storm.FlapWindow)
+	}
+	if c.Storm.Action != STORM_ACTION_BLOCK && c.Storm.Action != STORM_ACTION_LOG {
+		errs.add("storm.action", "unknown action '%s': must be 'block' or 'log'", c.Storm.Action)
+	}
+	if c.Storm.Block <= 0 {
+		errs.add("storm.block", "invalid time %d: must be > 0", c.Storm.Block)
+	}
+
+	// IGMP/MLD snooping
+	if c.Snooping.Timeout <= 0 {
+		errs.add("snooping.timeout", "invalid timeout %d: must be > 0", c.Snooping.Timeout)
+	}
+
+	// additional switches
+	ports := map[int]string{c.Global.Port: "global.port"}
+	if c.Discover.Port != 0 {
+		ports[c.Discover.Port] = "discover.port"
+	}
+	serials := map[string]string{}
+	if !c.Global.Serial.Empty() {
+		serials[c.Global.Serial.String()] = "the default switch"
+	}
+	for _, name := range sortedSwitchNames(c.Switch) {
+		sc := c.Switch[name]
+		prefix := fmt.Sprintf("switch.%s.", name)
+		if name == DEFAULT_SWITCH {
+			errs.add("switch."+name, "'%s' is reserved for the default switch", name)
+		}
+		if NewSwitchFromString(sc.Serial).Empty() {
+			errs.add(prefix+"serial", "invalid serial '%s'", sc.Serial)
+		} else if other, found := serials[sc.Serial]; found {
+			errs.add(prefix+"serial", "serial already used in %s", other)
+		} else {
+			serials[sc.Serial] = "switch " + name
+		}
+		if sc.Port <= 0 || sc.Port > 65535 {
+			errs.add(prefix+"port", "invalid port %d: must be in the range 1-65535", sc.Port)
+		} else if other, found := ports[sc.Port]; found {
+			errs.add(prefix+"port", "port %d is already used in %s", sc.Port, other)
+		} else {
+			ports[sc.Port] = prefix + "port"
+		}
+		errs.checkPort(prefix+"dhtport", sc.DhtPort)
+		if other, found := ports[sc.DhtPort]; found && sc.DhtPort != 0 {
+			errs.add(prefix+"dhtport", "port %d is already used in %s", sc.DhtPort, other)
+		} else if sc.DhtPort != 0 {
+			ports[sc.DhtPort] = prefix + "dhtport"
+		}
+		for _, peer := range sc.Peer {
+			errs.checkHostPort(prefix+"peer", peer)
+		}
+		if len(sc.Key) == 0 {
+			errs.add(prefix+"key", "no encryption key: additional switches must be encrypted")
+		}
+		for i, key := range sc.Key {
+			if _, err := decodeKeys([]string{key}); err != nil {
+				errs.add(prefix+"key", "key #%d: %s", i+1, err)
+			}
+		}
+	}
+
+	// control API
+	if len(c.Control.Listen) > 0 {
+		errs.checkHostPort("control.listen", c.Control.Listen)
+	}
+
+	// encryption
+	for i, key := range c.Crypto.Key {
+		if _, err := decodeKeys([]string{key}); err != nil {
+			errs.add("crypto.key", "key #%d: %s", i+1, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package divsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigDefaultsAreValid(t *testing.T) {
+	if err := NewConfig().Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := NewConfig()
+	c.Global.Port = 70000
+	c.Global.BindIP = "300.0.0.1"
+	c.Discover.Peer = []string{"10.0.0.1:7946", "10.0.0.2"}
+	c.Tun.NumReaders = 0
+	c.Crypto.Key = []string{"c2hvcnQ="}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("no error detected")
+	}
+	errs := err.(ConfigErrors)
+
+	expected := []string{"global.port", "global.bindip", "discover.peer", "tun.numreaders", "crypto.key"}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected errors: %s", errs)
+	}
+	for i, key := range expected {
+		if errs[i].Key != key {
+			t.Errorf("expected error in %s, got %s", key, errs[i])
+		}
+	}
+}
+
+func TestConfigValidatePortsConflict(t *testing.T) {
+	c := NewConfig()
+	c.Discover.Port = c.Global.Port
+
+	err := c.Validate()
+	if err == nil || err.(ConfigErrors)[0].Key != "discover.port" {
+		t.Fatalf("port conflict not detected: %v", err)
+	}
+}
+
+func TestConfigNatResolvers(t *testing.T) {
+	c := NewConfig()
+	c.Nat.Order = "stun, upnp,pcp"
+	c.Nat.Upnp = false
+	if r := c.Nat.Resolvers(); !reflect.DeepEqual(r, []string{"stun", "pcp"}) {
+		t.Fatalf("unexpected resolvers: %v", r)
+	}
+
+	c.Nat.Order = "stun,foo,stun"
+	err := c.Validate()
+	if err == nil || len(err.(ConfigErrors)) != 2 || err.(ConfigErrors)[0].Key != "nat.order" {
+		t.Fatalf("invalid order not detected: %v", err)
+	}
+}
+
+func TestConfigValidateNat(t *testing.T) {
+	c := NewConfig()
+	c.Nat.StunServer = []string{"stun.example.com:3478", "stun.example.com"}
+	c.Nat.Recheck = -1
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("no error detected")
+	}
+	errs := err.(ConfigErrors)
+	if len(errs) != 2 || errs[0].Key != "nat.stunserver" || errs[1].Key != "nat.recheck" {
+		t.Fatalf("unexpected errors: %s", errs)
+	}
+}
+
+func TestConfigValidateIPv6(t *testing.T) {
+	c := NewConfig()
+	c.Global.BindIP = "::"
+	c.Global.Host = "2001:db8::1"
+	c.Discover.Peer = []string{"[2001:db8::2]:7946", "10.0.0.1:7946"}
+	c.Control.Listen = "[::1]:7947"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	c.Discover.Peer = []string{"2001:db8::2:7946"}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("unbracketed IPv6 peer not detected")
+	}
+}
+
+func TestConfigValidateVlan(t *testing.T) {
+	c := NewConfig()
+	c.Vlan.Mode = "trunk"
+	c.Vlan.Allowed = []string{"10-20", "100,200"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	c.Vlan.Mode = "hybrid"
+	c.Vlan.Access = 4095
+	c.Vlan.Allowed = []string{"20-10"}
+	errs, ok := c.Validate().(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestConfigSwitches(t *testing.T) {
+	c := NewConfig()
+	key := []string{"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}
+	c.Switch = map[string]*switchConfig{
+		"tenant1": {Serial: NewSwitchId().String(), Port: 7950, Peer: []string{"10.0.0.1:7950"}, Key: key},
+		"tenant2": {Serial: NewSwitchId().String(), Port: 7951, DhtPort: 7952, Key: key},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	sc := c.SwitchConfig("tenant1")
+	if sc.Global.Port != 7950 || sc.Global.Serial.String() != c.Switch["tenant1"].Serial {
+		t.Fatalf("unexpected switch config: %+v", sc.Global)
+	}
+	if !reflect.DeepEqual(sc.Discover.Peer, []string{"10.0.0.1:7950"}) || sc.Switch != nil {
+		t.Fatalf("unexpected switch config: %+v", sc)
+	}
+	if c.Global.Port != DEFAULT_PORT {
+		t.Fatalf("main config modified")
+	}
+
+	// the maps and lists are not shared with the main config
+	c.Filter.Rule = []string{"drop vlan=10"}
+	c.Node = map[string]*nodeConfig{"node1": {Mac: []string{"00:16:3e"}}}
+	sc = c.SwitchConfig("tenant1")
+	sc.Filter.Rule[0] = "allow"
+	sc.Node["node1"].Mac[0] = "02:00:00:00:00:01"
+	sc.Node["node2"] = &nodeConfig{MaxMacs: 1}
+	sc.Crypto.Key[0] = ""
+	if c.Filter.Rule[0] != "drop vlan=10" || c.Node["node1"].Mac[0] != "00:16:3e" || len(c.Node) != 1 || c.Switch["tenant1"].Key[0] != key[0] {
+		t.Fatalf("main config modified by a switch config")
+	}
+
+	// duplicate ports and serials, reserved names and invalid serials
+	c.Switch["tenant2"].Port = 7950
+	c.Switch["tenant2"].Serial = c.Switch["tenant1"].Serial
+	c.Switch[DEFAULT_SWITCH] = &switchConfig{Serial: "invalid", Port: DEFAULT_PORT, Key: key}
+	errs, ok := c.Validate().(ConfigErrors)
+	if !ok || len(errs) != 5 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// switches without encryption keys
+	c = NewConfig()
+	c.Switch = map[string]*switchConfig{"tenant1": {Serial: NewSwitchId().String(), Port: 7950}}
+	errs, ok = c.Validate().(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Key != "switch.tenant1.key" {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestConfigNodeSecurity(t *testing.T) {
+	c := NewConfig()
+	c.Security.Mac = []string{"00:16:3e"}
+	c.Security.MaxMacs = 10
+	c.Node = map[string]*nodeConfig{
+		"node1": {MaxMacs: 2, Action: SECURITY_ACTION_QUARANTINE},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	sc := c.NodeSecurity("node1")
+	if sc.MaxMacs != 2 || sc.Action != SECURITY_ACTION_QUARANTINE || len(sc.Mac) != 1 || sc.Quarantine != DEFAULT_QUARANTINE_TIME {
+		t.Fatalf("unexpected settings for node1: %+v", sc)
+	}
+	if sc := c.NodeSecurity("node2"); sc.MaxMacs != 10 || sc.Action != SECURITY_ACTION_DROP {
+		t.Fatalf("unexpected settings for node2: %+v", sc)
+	}
+
+	c.Security.Mac = []string{"00:16"}
+	c.Node["node1"].Action = "ignore"
+	c.Node["node1"].Ratelimit = -1
+	errs, ok := c.Validate().(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestConfigValidateFilter(t *testing.T) {
+	c := NewConfig()
+	c.Filter.Rule = []string{"drop proto=tcp dport=22", "limit=10 ethertype=arp"}
+	c.Filter.Shared = []string{"drop dir=in vlan=10"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	c.Filter.Default = "reject"
+	c.Filter.Rule = []string{"drop dport=99999"}
+	c.Filter.Shared = []string{"limit"}
+	errs, ok := c.Validate().(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for i, key := range []string{"filter.default", "filter.rule", "filter.shared"} {
+		if errs[i].Key != key {
+			t.Errorf("expected error in %s, got %s", key, errs[i])
+		}
+	}
+}
+
+func TestConfigValidateBatching(t *testing.T) {
+	c := NewConfig()
+	c.Batching.Mtu = BATCH_MAX_MTU
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	// larger batches would be fragmented once encrypted
+	for _, mtu := range []int{BATCH_MAX_MTU + 1, 9000, BATCH_MIN_MTU - 1} {
+		c.Batching.Mtu = mtu
+		errs, ok := c.Validate().(ConfigErrors)
+		if !ok || len(errs) != 1 || errs[0].Key != "batching.mtu" {
+			t.Errorf("mtu %d: unexpected errors: %v", mtu, errs)
+		}
+	}
+}
+
+func TestConfigValidateLimitsOrder(t *testing.T) {
+	c := NewConfig()
+	c.Ratelimit.MacBroadcast = -1
+	c.Ratelimit.Global = -1
+	c.Storm.Flaps = -1
+	c.Storm.Broadcast = -1
+
+	// the errors are always reported in the same order
+	for i := 0; i < 10; i++ {
+		errs, ok := c.Validate().(ConfigErrors)
+		if !ok || len(errs) != 4 ||
+			errs[0].Key != "ratelimit.global" || errs[1].Key != "ratelimit.macbroadcast" ||
+			errs[2].Key != "storm.broadcast" || errs[3].Key != "storm.flaps" {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package divsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// default address for the control API
+const DEFAULT_CONTROL_ADDR = "127.0.0.1:7947"
+
+// The control API: a HTTP/JSON API for inspecting the daemon
+type ControlServer struct {
+	server   *Server
+	listener net.Listener
+	mux      *http.ServeMux
+}
+
+// Create a new control API server
+func NewControlServer(s *Server) *ControlServer {
+	cs := &ControlServer{
+		server: s,
+		mux:    http.NewServeMux(),
+	}
+	cs.mux.HandleFunc("/node", cs.handleNode)
+	cs.mux.HandleFunc("/nodes", cs.handleNodes)
+	cs.mux.HandleFunc("/macs", cs.handleMacs)
+	cs.mux.HandleFunc("/keepalives", cs.handleKeepalives)
+	cs.mux.HandleFunc("/metrics", cs.handleMetrics)
+	cs.mux.HandleFunc("/switches", cs.handleSwitches)
+	cs.mux.HandleFunc("/filter", cs.handleFilter)
+	cs.mux.HandleFunc("/storm", cs.handleStorm)
+	cs.mux.HandleFunc("/groups", cs.handleGroups)
+	cs.mux.HandleFunc("/mirror", cs.handleMirror)
+	cs.mux.HandleFunc("/compression", cs.handleCompression)
+	cs.mux.HandleFunc("/capture", cs.handleCapture)
+	cs.mux.HandleFunc("/capture/stream", cs.handleCaptureStream)
+	return cs
+}
+
+// Start listening for requests
+func (cs *ControlServer) Start(addr string) (err error) {
+	cs.listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info("Control API listening at %s", cs.listener.Addr())
+
+	go func() {
+		if err := http.Serve(cs.listener, cs); err != nil {
+			log.Debug("Control API finished: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Serve a request
+// The Host must be a loopback address (or the address the API is listening
+// at): a web page could make its own domain resolve to 127.0.0.1 (DNS
+// rebinding) and read the responses (ie, a live capture) otherwise.
+// The requests that change the state (anything but GET) must be JSON requests:
+// browsers cannot send them from other sites without a CORS preflight (that
+// we never accept), so web pages cannot use the API.
+func (cs *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !cs.allowedHost(r.Host) {
+		http.Error(w, "invalid Host", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	cs.mux.ServeHTTP(w, r)
+}
+
+// Check the Host in a request: a loopback IP (or "localhost"), or the IP the
+// API is listening at, but never a domain name
+func (cs *ControlServer) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	if cs.listener != nil {
+		if addr, ok := cs.listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsUnspecified() {
+			return addr.IP.Equal(ip)
+		}
+	}
+	return false
+}
+
+// Stop listening for requests
+func (cs *ControlServer) Stop() error {
+	if cs.listener == nil {
+		return nil
+	}
+	return cs.listener.Close()
+}
+
+// GET /node: the metadata of the local node
+func (cs *ControlServer) handleNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.LocalMeta())
+}
+
+// GET /nodes: the peers, with their metadata
+func (cs *ControlServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.Peers())
+}
+
+// GET /macs: the MAC database
+func (cs *ControlServer) handleMacs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.Macs())
+}
+
+// GET /filter: the filter rules, with their hit counters
+func (cs *ControlServer) handleFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.filter.Status())
+}
+
+// GET /storm: the nodes blocked by the storm control
+// DELETE /storm?node=<name>: unblock a node (or the local port, with the local node name)
+func (cs *ControlServer) handleStorm(w http.ResponseWriter, r *http.Request) {
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		cs.writeJSON(w, sw.nodesManager.storm.BlockedNodes())
+	case "DELETE":
+		if !sw.nodesManager.storm.Unblock(r.URL.Query().Get("node")) {
+			http.Error(w, "node not blocked", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /groups: the multicast groups, with the nodes with receivers
+func (cs *ControlServer) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.Groups())
+}
+
+// GET /mirror: the port mirroring sessions, with their counters
+func (cs *ControlServer) handleMirror(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.mirror.Sessions())
+}
+
+// GET /compression: the compression statistics
+func (cs *ControlServer) handleCompression(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.compressor.Info())
+}
+
+// get the capture options from the request parameters
+func captureOptions(r *http.Request) (CaptureOptions, error) {
+	q := r.URL.Query()
+	opts := CaptureOptions{
+		Filter: q.Get("filter"),
+		Peer:   q.Get("peer"),
+		File:   q.Get("file"),
+	}
+	if points := q.Get("points"); len(points) > 0 {
+		opts.Points = strings.Split(points, ",")
+	}
+	if count := q.Get("count"); len(count) > 0 {
+		var err error
+		if opts.Count, err = strconv.Atoi(count); err != nil {
+			return opts, fmt.Errorf("invalid count '%s'", count)
+		}
+	}
+	return opts, nil
+}
+
+// GET /capture: the capture sessions
+// POST /capture?file=<name>[&points=<points>][&filter=<filter>][&peer=<node>][&count=<n>]:
+// start capturing to a file in the captures directory
+// DELETE /capture?id=<id>: stop a capture session
+func (cs *ControlServer) handleCapture(w http.ResponseWriter, r *http.Request) {
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	captures := sw.nodesManager.captures
+
+	switch r.Method {
+	case "GET":
+		cs.writeJSON(w, captures.Sessions())
+	case "POST":
+		opts, err := captureOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := captures.StartFile(opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		cs.writeJSON(w, s.Info())
+	case "DELETE":
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid capture id", http.StatusBadRequest)
+			return
+		}
+		if err := captures.Stop(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// a writer that flushes a HTTP response after every write
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (fw flushWriter) Close() error {
+	return nil
+}
+
+// GET /capture/stream[?points=<points>][&filter=<filter>][&peer=<node>][&count=<n>]:
+// a live capture, in pcapng format, until the client disconnects
+func (cs *ControlServer) handleCaptureStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	opts, err := captureOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.File = ""
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	captures := sw.nodesManager.captures
+	s, err := captures.Start(opts, flushWriter{w})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-s.Done():
+	case <-r.Context().Done():
+		captures.Stop(s.ID)
+		<-s.Done()
+	}
+}
+
+// GET /keepalives: the keepalive state for each peer
+func (cs *ControlServer) handleKeepalives(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sw, ok := cs.getSwitch(w, r)
+	if !ok {
+		return
+	}
+	cs.writeJSON(w, sw.nodesManager.keepaliver.Info())
+}
+
+// GET /metrics: the daemon counters
+func (cs *ControlServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cs.writeJSON(w, metrics.Snapshot())
+}
+
+// GET /switches: the switches hosted by the daemon
+// POST /switches?switch=<name>: add a switch, with the settings in the body
+// DELETE /switches?switch=<name>: remove a switch
+func (cs *ControlServer) handleSwitches(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("switch")
+	switch r.Method {
+	case "GET":
+		infos := []SwitchInfo{}
+		for _, sw := range cs.server.Switches() {
+			infos = append(infos, sw.Info())
+		}
+		cs.writeJSON(w, infos)
+	case "POST":
+		var sc switchConfig
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			http.Error(w, fmt.Sprintf("invalid switch settings: %s", err), http.StatusBadRequest)
+			return
+		}
+		if len(name) == 0 {
+			http.Error(w, "no switch name", http.StatusBadRequest)
+			return
+		}
+		if err := cs.server.AddSwitch(name, &sc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sw, _ := cs.server.Switch(name)
+		w.WriteHeader(http.StatusCreated)
+		cs.writeJSON(w, sw.Info())
+	case "DELETE":
+		ctx, cancel := context.WithTimeout(r.Context(), DEFAULT_LEAVE_TIMEOUT)
+		defer cancel()
+		switch err := cs.server.RemoveSwitch(ctx, name); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ERR_UNKNOWN_SWITCH:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// get the switch selected with the "switch" parameter (the default switch
+// if not present), replying with an error if it does not exist
+func (cs *ControlServer) getSwitch(w http.ResponseWriter, r *http.Request) (*Switch, bool) {
+	name := r.URL.Query().Get("switch")
+	if len(name) == 0 {
+		name = DEFAULT_SWITCH
+	}
+	sw, err := cs.server.Switch(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unknown switch '%s'", name), http.StatusNotFound)
+		return nil, false
+	}
+	return sw, true
+}
+
+// write a JSON response
+func (cs *ControlServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("Could not write control API response: %s", err)
+	}
+}
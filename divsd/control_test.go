@@ -0,0 +1,64 @@
+package divsd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestControlRequiresJson(t *testing.T) {
+	cs := NewControlServer(nil)
+
+	// a simple (form) request, that a web page could send from other site
+	r := httptest.NewRequest("POST", "/switches?switch=evil", strings.NewReader(`{"port": 7950}`))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	cs.ServeHTTP(w, withHost(r))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST without a JSON content type: unexpected status %d", w.Code)
+	}
+
+	r = httptest.NewRequest("DELETE", "/capture?id=1", nil)
+	w = httptest.NewRecorder()
+	cs.ServeHTTP(w, withHost(r))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("DELETE without a content type: unexpected status %d", w.Code)
+	}
+
+	// the metrics do not need the server
+	r = httptest.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	cs.ServeHTTP(w, withHost(r))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET: unexpected status %d", w.Code)
+	}
+}
+
+// set the Host of a request to the default control API address
+func withHost(r *http.Request) *http.Request {
+	r.Host = DEFAULT_CONTROL_ADDR
+	return r
+}
+
+func TestControlChecksHost(t *testing.T) {
+	cs := NewControlServer(nil)
+	for host, expected := range map[string]int{
+		"127.0.0.1:7947":        http.StatusOK,
+		"[::1]:7947":            http.StatusOK,
+		"localhost:7947":        http.StatusOK,
+		"127.0.0.1":             http.StatusOK,
+		"evil.example.com:7947": http.StatusForbidden, // resolving to 127.0.0.1
+		"evil.example.com":      http.StatusForbidden,
+		"10.0.0.1:7947":         http.StatusForbidden,
+		"":                      http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		cs.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("Host '%s': expected status %d, got %d", host, expected, w.Code)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package divsd
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"sync"
 
@@ -13,13 +15,19 @@ import (
 // the buffer length used for reading a packet from the TAP device
 const TAP_BUFFER_LEN = 9000
 
+// the queue length for packets waiting to be written to the TAP device
+const TAP_WRITE_QUEUE_LEN = 100
+
 /////////////////////////////////////////////////////////////////////////////
 
 type DevManager struct {
 	numWorkers   int
 	tun          *tuntap.TunTap
 	nodesManager *NodesManager
+	vlans        *VlanPort
 	packetsChan  chan []byte
+	writeChan    chan []byte
+	readerDone   chan struct{} // closed when the device reader finishes
 	wg           *sync.WaitGroup
 	mutex        sync.RWMutex
 }
@@ -28,9 +36,16 @@ type DevManager struct {
 // This manager will be responsible for reading from the device and sending
 // data to the right peers
 func NewDevManager(config *Config) (d *DevManager, err error) {
+	vlans, err := NewVlanPort(config.Vlan)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid VLAN configuration: %s", err)
+	}
 	d = &DevManager{
+		vlans:       vlans,
 		numWorkers:  config.Tun.NumReaders,
 		packetsChan: make(chan []byte),
+		writeChan:   make(chan []byte, TAP_WRITE_QUEUE_LEN),
+		readerDone:  make(chan struct{}),
 		wg:          new(sync.WaitGroup),
 	}
 	return d, nil
@@ -63,33 +78,115 @@ func (dman *DevManager) Start() (err error) {
 		go dman.packetProcessor()
 	}
 
-	go dman.devReader()
+	go dman.devReader(dman.tun)
+	go dman.devWriter(dman.tun)
 	return nil
 }
 
-func (dman *DevManager) Stop() {
+// Write a frame to the TAP device
+// The frame is enqueued for writing, and it is dropped if the queue is full.
+func (dman *DevManager) Write(frame []byte) error {
+	dman.mutex.RLock()
+	defer dman.mutex.RUnlock()
+
+	if dman.tun == nil {
+		return ERR_DEVICE_NOT_READY
+	}
+	select {
+	case dman.writeChan <- frame:
+		return nil
+	default:
+		log.Debug("TAP write queue full: dropping frame")
+		return ERR_QUEUE_FULL
+	}
+}
+
+// Stop reading from the TAP device and tear it down
+// We wait for the device reader to finish until the context is done: if the
+// reader is still blocked then, the packets processors are left running.
+func (dman *DevManager) Stop(ctx context.Context) error {
+	dman.mutex.Lock()
+	defer dman.mutex.Unlock()
+
+	if dman.tun == nil {
+		return nil
+	}
+
+	// Closing the device makes the reader fail and finish
+	log.Info("Closing tap device %s\n", dman.tun.Name())
+	if err := dman.tun.Close(); err != nil {
+		log.Warning("Error closing tap device: %s", err)
+	}
+	dman.tun = nil
+	close(dman.writeChan)
+
+	select {
+	case <-dman.readerDone:
+	case <-ctx.Done():
+		return fmt.Errorf("the tap device reader did not finish: %s", ctx.Err())
+	}
+
 	// Closing channel (waiting in goroutines won't continue any more)
 	close(dman.packetsChan)
 
 	// Waiting for all goroutines to finish (otherwise they die as main routine dies)
 	dman.wg.Wait()
+	return nil
+}
+
+// Get the name of the TAP device (or an empty string if it has not been started)
+func (dman *DevManager) Name() string {
+	dman.mutex.RLock()
+	defer dman.mutex.RUnlock()
+
+	if dman.tun == nil {
+		return ""
+	}
+	return dman.tun.Name()
+}
+
+// Get the hardware address of the TAP device (or nil if it has not been started)
+func (dman *DevManager) HardwareAddr() net.HardwareAddr {
+	dman.mutex.RLock()
+	defer dman.mutex.RUnlock()
+
+	if dman.tun == nil {
+		return nil
+	}
+	iface, err := net.InterfaceByName(dman.tun.Name())
+	if err != nil {
+		log.Debug("Could not get the TAP device interface: %s", err)
+		return nil
+	}
+	return iface.HardwareAddr
 }
 
 // the device reader
-func (dman *DevManager) devReader() {
+func (dman *DevManager) devReader(tun *tuntap.TunTap) {
+	defer close(dman.readerDone)
+
 	// Processing all packets by spreading them to `free` goroutines
 	log.Debug("Starting reading from TAP device...")
 	for {
 		// TODO: use a sync.Pool for the buffers, so we do not generate so much garbage...
 
 		packet := make([]byte, TAP_BUFFER_LEN)
-		_, err := dman.tun.Read(packet)
+		n, err := tun.Read(packet)
 		if err != nil {
 			log.Info("Error reading from TAP device: %s", err)
 			break
 		} else {
 			log.Debug("New packet read from TAP device")
-			dman.packetsChan <- packet // handoff the packet to a packets processor
+			dman.packetsChan <- packet[:n] // handoff the packet to a packets processor
+		}
+	}
+}
+
+// the device writer
+func (dman *DevManager) devWriter(tun *tuntap.TunTap) {
+	for frame := range dman.writeChan {
+		if _, err := tun.Write(frame); err != nil {
+			log.Debug("Error writing to TAP device: %s", err)
 		}
 	}
 }
@@ -107,13 +204,41 @@ func (dman *DevManager) packetProcessor() {
 		if ethLayer := packet.Layer(layers.LayerTypeEthernet); ethLayer != nil {
 			eth, _ := ethLayer.(*layers.Ethernet)
 			log.Debug("Ethernet: src:%s, dst:%s\n", eth.SrcMAC, eth.DstMAC)
+			dman.nodesManager.captures.Capture(CAPTURE_TAP_IN, "", &EthernetPacket{Ethernet: *eth}, packet.Data())
+
+			// tag the frame with its VLAN, dropping it if it is not allowed
+			pkt, ok := dman.vlans.Ingress(&EthernetPacket{Ethernet: *eth})
+			if !ok {
+				log.Debug("Dropping frame: VLAN not allowed in the TAP device")
+				continue
+			}
+
+			// check the storm control (the local port could be blocked)
+			if !dman.nodesManager.StormCheck(pkt) {
+				continue
+			}
+
+			// check the port security for the source MAC
+			if !dman.nodesManager.CheckLocalMac(pkt.Vlan(), eth.SrcMAC) {
+				continue
+			}
+
+			// check the filter rules
+			if !dman.nodesManager.FilterPacket(pkt) {
+				continue
+			}
+
+			// learn the MACs that are behind this node
+			dman.nodesManager.LearnLocalMac(pkt.Vlan(), eth.SrcMAC)
+
+			// learn the multicast groups with receivers behind this node
+			dman.nodesManager.SnoopPacket(pkt)
 
 			// TODO: we should parse the packet and do interesting things like
 			//       - answer ARP requests
-			//       - do some IGMP snooping...
 
 			// pass the parsed packet to the nodes manager so it send it to the right destination
-			dman.nodesManager.SendPacket(&EthernetPacket{*eth})
+			dman.nodesManager.SendPacket(pkt)
 		}
 	}
 }
@@ -12,3 +12,18 @@ var ERR_MALFORMED_MSG = fmt.Errorf("Malformed message")
 
 // Timeout while waiting for peers
 var ERR_TIMEOUT_PEERS = fmt.Errorf("Timeout while waiting for peers")
+
+// The node has been closed
+var ERR_NODE_CLOSED = fmt.Errorf("Node closed")
+
+// The server has been shut down
+var ERR_SERVER_CLOSED = fmt.Errorf("Server closed")
+
+// The change can not be applied without a restart
+var ERR_RESTART_REQUIRED = fmt.Errorf("Restart required")
+
+// The device has not been started (or it has been stopped)
+var ERR_DEVICE_NOT_READY = fmt.Errorf("Device not ready")
+
+// A queue is full
+var ERR_QUEUE_FULL = fmt.Errorf("Queue full")
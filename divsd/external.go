@@ -0,0 +1,84 @@
+package divsd
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/inercia/divs/divsd/nat"
+)
+
+// Periodically check our external address, updating it when it changes (ie,
+// when the NAT has rebound our mapping)
+func (nm *NodesManager) externalAddrWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			nm.checkExternalAddr()
+		case <-nm.stopChan:
+			return
+		}
+	}
+}
+
+// obtain our external address again
+// When we have a port mapping for our port, the address is the one in the
+// mapping (renewed in the background). Otherwise, the address is obtained again,
+// but STUN uses its own socket: the port it reports is the NAT binding for that
+// socket, not for ours, so only the IP is taken and the port is kept.
+func (nm *NodesManager) checkExternalAddr() {
+	port := nm.config.Global.Port
+	if m, found := nat.MappingFor("udp", port); found {
+		nm.setExternalAddr(net.UDPAddr{IP: m.ExternalIP, Port: m.ExternalPort})
+		return
+	}
+
+	defaultAddr := net.JoinHostPort(nm.config.Global.Host, strconv.Itoa(port))
+	addr, err := nat.NewExternalUDPAddr(defaultAddr)
+	if err != nil || addr.Port == 0 || addr.IP == nil || addr.IP.IsUnspecified() {
+		log.Debug("Could not check the external address")
+		return
+	}
+	if m, found := nat.MappingFor("udp", port); found {
+		addr = net.UDPAddr{IP: m.ExternalIP, Port: m.ExternalPort}
+	} else if current := nm.ExternalAddr(); current.Port != 0 {
+		addr.Port = current.Port
+	}
+	nm.setExternalAddr(addr)
+}
+
+// Get our external address
+func (nm *NodesManager) ExternalAddr() net.UDPAddr {
+	nm.mutex.RLock()
+	defer nm.mutex.RUnlock()
+	return nm.membersExtAddr
+}
+
+// Update our external address, announcing it to the cluster and to the
+// rendezvous services. memberlist only uses the advertised address when it
+// starts, so peers use the address we publish in our metadata for sending us
+// traffic.
+func (nm *NodesManager) setExternalAddr(addr net.UDPAddr) {
+	nm.mutex.Lock()
+	prev := nm.membersExtAddr
+	if prev.IP.Equal(addr.IP) && prev.Port == addr.Port {
+		nm.mutex.Unlock()
+		return
+	}
+	nm.membersExtAddr = addr
+	if nm.membersConfig != nil {
+		nm.membersConfig.AdvertiseAddr = addr.IP.String()
+		nm.membersConfig.AdvertisePort = addr.Port
+	}
+	nm.mutex.Unlock()
+
+	log.Warning("External address changed from %s to %s", prev.String(), addr.String())
+	if err := nm.UpdateMeta(); err != nil {
+		log.Warning("Could not update the node metadata: %s", err)
+	}
+	if nm.rendezvous != nil {
+		nm.rendezvous.Announce(addr.String())
+	}
+}
@@ -0,0 +1,463 @@
+package divsd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"github.com/juju/ratelimit"
+)
+
+// Filter actions
+const (
+	FILTER_ALLOW = "allow"
+	FILTER_DROP  = "drop"
+	FILTER_LIMIT = "limit" // allow up to some packets per second, dropping the rest
+)
+
+// Filter directions
+const (
+	FILTER_OUT = "out" // frames read from the TAP device
+	FILTER_IN  = "in"  // packets received from other nodes
+)
+
+// Protocol names that can be used in filter rules
+var filterEtherTypes = map[string]layers.EthernetType{
+	"ipv4": layers.EthernetTypeIPv4,
+	"ipv6": layers.EthernetTypeIPv6,
+	"arp":  layers.EthernetTypeARP,
+}
+
+var filterProtocols = map[string]layers.IPProtocol{
+	"icmp":   layers.IPProtocolICMPv4,
+	"icmpv6": layers.IPProtocolICMPv6,
+	"tcp":    layers.IPProtocolTCP,
+	"udp":    layers.IPProtocolUDP,
+	"sctp":   layers.IPProtocolSCTP,
+}
+
+// A range of ports
+type portRange struct {
+	from, to int
+}
+
+func parsePortRange(s string) (portRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	from, err := strconv.Atoi(bounds[0])
+	if err != nil || from < 0 || from > 65535 {
+		return portRange{}, fmt.Errorf("invalid port '%s'", s)
+	}
+	to := from
+	if len(bounds) == 2 {
+		if to, err = strconv.Atoi(bounds[1]); err != nil || to < from || to > 65535 {
+			return portRange{}, fmt.Errorf("invalid port range '%s'", s)
+		}
+	}
+	return portRange{from, to}, nil
+}
+
+// check if a port is in the range
+func (r portRange) contains(port int) bool {
+	return port >= r.from && port <= r.to
+}
+
+// parse an IP prefix (or an IP address)
+func parsePrefix(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address '%s'", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix '%s'", s)
+	}
+	return prefix, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// The fields of a packet used for matching the filter rules
+type filterPacket struct {
+	etherType layers.EthernetType // the EtherType after the VLAN tag
+	vlan      uint16
+	tagged    bool // the packet has a 802.1Q tag
+	srcMAC    string
+	dstMAC    string
+	src, dst  net.IP // nil for non-IP packets
+	proto     int    // -1 for non-IP packets
+	sport     int    // -1 for packets without ports
+	dport     int
+}
+
+// get the fields of a packet, decoding the IP and TCP/UDP layers
+func newFilterPacket(pkt *EthernetPacket) *filterPacket {
+	fp := &filterPacket{
+		etherType: pkt.EthernetType,
+		vlan:      DEFAULT_VLAN,
+		srcMAC:    pkt.SrcMAC.String(),
+		dstMAC:    pkt.DstMAC.String(),
+		proto:     -1,
+		sport:     -1,
+		dport:     -1,
+	}
+	payload := pkt.Payload
+	if tag, ok := pkt.dot1q(); ok {
+		fp.etherType = tag.Type
+		fp.tagged = true
+		if tag.VLANIdentifier != 0 {
+			fp.vlan = tag.VLANIdentifier
+		}
+		payload = tag.Payload
+	}
+
+	var transport []byte
+	switch fp.etherType {
+	case layers.EthernetTypeIPv4:
+		var ip layers.IPv4
+		if err := ip.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+			return fp
+		}
+		fp.src, fp.dst, fp.proto = ip.SrcIP, ip.DstIP, int(ip.Protocol)
+		if ip.FragOffset == 0 {
+			transport = ip.Payload
+		}
+	case layers.EthernetTypeIPv6:
+		var ip layers.IPv6
+		if err := ip.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+			return fp
+		}
+		fp.src, fp.dst, fp.proto = ip.SrcIP, ip.DstIP, int(ip.NextHeader)
+		transport = ip.Payload
+	default:
+		return fp
+	}
+
+	switch layers.IPProtocol(fp.proto) {
+	case layers.IPProtocolTCP:
+		var tcp layers.TCP
+		if err := tcp.DecodeFromBytes(transport, gopacket.NilDecodeFeedback); err == nil {
+			fp.sport, fp.dport = int(tcp.SrcPort), int(tcp.DstPort)
+		}
+	case layers.IPProtocolUDP:
+		var udp layers.UDP
+		if err := udp.DecodeFromBytes(transport, gopacket.NilDecodeFeedback); err == nil {
+			fp.sport, fp.dport = int(udp.SrcPort), int(udp.DstPort)
+		}
+	}
+	return fp
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// A filter rule: an action and the conditions a packet must match, written
+// as "<action>[=<packets per second>] [<key>=<value>...]", like
+// "drop proto=tcp dport=22 dst=10.0.0.0/8" or "limit=100 ethertype=arp"
+type FilterRule struct {
+	spec      string
+	action    string
+	direction string // empty for both directions
+	etherType int    // -1 for any
+	vlans     VlanSet
+	srcMAC    string
+	dstMAC    string
+	src, dst  *net.IPNet
+	proto     int // -1 for any
+	sport     *portRange
+	dport     *portRange
+	bucket    *ratelimit.Bucket // for the "limit" action
+
+	hits    uint64 // packets matched
+	dropped uint64 // packets dropped (by "drop" and "limit" rules)
+}
+
+// Parse a filter rule
+func ParseFilterRule(spec string) (*FilterRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	r := &FilterRule{spec: strings.Join(fields, " "), etherType: -1, proto: -1}
+
+	action := strings.SplitN(fields[0], "=", 2)
+	switch r.action = action[0]; r.action {
+	case FILTER_ALLOW, FILTER_DROP:
+		if len(action) > 1 {
+			return nil, fmt.Errorf("no rate expected for '%s'", r.action)
+		}
+	case FILTER_LIMIT:
+		rate := 0.0
+		if len(action) > 1 {
+			rate, _ = strconv.ParseFloat(action[1], 64)
+		}
+		if rate <= 0 {
+			return nil, fmt.Errorf("'%s' requires a rate, in packets per second (ie, limit=100)", r.action)
+		}
+		r.bucket = ratelimit.NewBucketWithRate(rate, int64(rate)+1)
+	default:
+		return nil, fmt.Errorf("unknown action '%s'", r.action)
+	}
+
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid condition '%s': must be key=value", field)
+		}
+		key, value := kv[0], strings.ToLower(kv[1])
+
+		var err error
+		switch key {
+		case "dir":
+			if value != FILTER_IN && value != FILTER_OUT {
+				return nil, fmt.Errorf("invalid direction '%s': must be 'in' or 'out'", value)
+			}
+			r.direction = value
+		case "ethertype":
+			if et, found := filterEtherTypes[value]; found {
+				r.etherType = int(et)
+			} else if et, err := strconv.ParseUint(value, 0, 16); err == nil {
+				r.etherType = int(et)
+			} else {
+				return nil, fmt.Errorf("unknown EtherType '%s'", value)
+			}
+		case "vlan":
+			if r.vlans, err = ParseVlanSet([]string{value}); err != nil {
+				return nil, err
+			}
+		case "srcmac", "dstmac":
+			mac, err := net.ParseMAC(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MAC '%s'", value)
+			}
+			if key == "srcmac" {
+				r.srcMAC = mac.String()
+			} else {
+				r.dstMAC = mac.String()
+			}
+		case "src":
+			if r.src, err = parsePrefix(value); err != nil {
+				return nil, err
+			}
+		case "dst":
+			if r.dst, err = parsePrefix(value); err != nil {
+				return nil, err
+			}
+		case "proto":
+			if proto, found := filterProtocols[value]; found {
+				r.proto = int(proto)
+			} else if proto, err := strconv.ParseUint(value, 10, 8); err == nil {
+				r.proto = int(proto)
+			} else {
+				return nil, fmt.Errorf("unknown protocol '%s'", value)
+			}
+		case "sport", "dport":
+			ports, err := parsePortRange(value)
+			if err != nil {
+				return nil, err
+			}
+			if key == "sport" {
+				r.sport = &ports
+			} else {
+				r.dport = &ports
+			}
+		default:
+			return nil, fmt.Errorf("unknown condition '%s'", key)
+		}
+	}
+	return r, nil
+}
+
+// Parse a list of filter rules
+func ParseFilterRules(specs []string) ([]*FilterRule, error) {
+	rules := make([]*FilterRule, 0, len(specs))
+	for _, spec := range specs {
+		r, err := ParseFilterRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %s", spec, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (r *FilterRule) String() string {
+	return r.spec
+}
+
+// Return `true` if a packet (in some direction) matches the rule
+func (r *FilterRule) matches(direction string, fp *filterPacket) bool {
+	inPorts := func(ports *portRange, port int) bool {
+		return ports == nil || ports.contains(port)
+	}
+	switch {
+	case len(r.direction) > 0 && r.direction != direction:
+	case r.etherType >= 0 && r.etherType != int(fp.etherType):
+	case r.vlans != nil && !r.vlans.Contains(fp.vlan):
+	case len(r.srcMAC) > 0 && r.srcMAC != fp.srcMAC:
+	case len(r.dstMAC) > 0 && r.dstMAC != fp.dstMAC:
+	case r.src != nil && (fp.src == nil || !r.src.Contains(fp.src)):
+	case r.dst != nil && (fp.dst == nil || !r.dst.Contains(fp.dst)):
+	case r.proto >= 0 && r.proto != fp.proto:
+	case !inPorts(r.sport, fp.sport) || !inPorts(r.dport, fp.dport):
+	default:
+		return true
+	}
+	return false
+}
+
+// Apply the rule to a matching packet, returning `true` if it is accepted
+func (r *FilterRule) apply() bool {
+	atomic.AddUint64(&r.hits, 1)
+	accepted := r.action == FILTER_ALLOW || (r.action == FILTER_LIMIT && r.bucket.TakeAvailable(1) > 0)
+	if !accepted {
+		atomic.AddUint64(&r.dropped, 1)
+	}
+	return accepted
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// The hit counters for a rule, as exposed in the control API
+type RuleStatus struct {
+	Rule    string `json:"rule"`
+	Hits    uint64 `json:"hits"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// The state of the filter, as exposed in the control API
+type FilterStatus struct {
+	Default       string       `json:"default"`
+	DefaultHits   uint64       `json:"default_hits"`
+	Rules         []RuleStatus `json:"rules"`                    // local rules
+	SharedRules   []RuleStatus `json:"shared_rules"`             // rules shared by all the nodes
+	SharedVersion int64        `json:"shared_version,omitempty"` // version of the shared rules
+	SharedOrigin  string       `json:"shared_origin,omitempty"`  // node that published the shared rules
+}
+
+// The packets filter: the local rules are evaluated first, then the rules
+// shared by all the nodes in the switch, and then the default action
+type Filter struct {
+	defaultAction string
+	defaultHits   uint64
+	rules         []*FilterRule
+	shared        []*FilterRule
+	ruleSet       *RuleSet // the shared rules, as received
+	mutex         sync.RWMutex
+}
+
+// Create a new filter from the configuration
+func NewFilter(c filterConfig) (*Filter, error) {
+	f := &Filter{}
+	if err := f.SetRules(c.Default, c.Rule); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Replace the local rules and the default action
+func (f *Filter) SetRules(defaultAction string, specs []string) error {
+	rules, err := ParseFilterRules(specs)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.defaultAction = defaultAction
+	f.rules = rules
+	return nil
+}
+
+// Replace the shared rules, if the rule set is newer than the current one
+// Returns `true` if the rule set has been accepted.
+func (f *Filter) SetRuleSet(rs *RuleSet) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.ruleSet != nil && !rs.newerThan(f.ruleSet) {
+		return false, nil
+	}
+	shared, err := ParseFilterRules(rs.Rules)
+	if err != nil {
+		return false, err
+	}
+	f.shared = shared
+	f.ruleSet = rs
+	return true, nil
+}
+
+// Get the shared rules (or nil if there are no shared rules)
+func (f *Filter) RuleSet() *RuleSet {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.ruleSet
+}
+
+// Check a packet going in some direction, returning `true` if it is accepted
+func (f *Filter) Check(direction string, pkt *EthernetPacket) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if len(f.rules) == 0 && len(f.shared) == 0 && f.defaultAction != FILTER_DROP {
+		atomic.AddUint64(&f.defaultHits, 1)
+		return true // nothing to check
+	}
+
+	fp := newFilterPacket(pkt)
+	for _, rules := range [][]*FilterRule{f.rules, f.shared} {
+		for _, r := range rules {
+			if r.matches(direction, fp) {
+				accepted := r.apply()
+				if !accepted {
+					metrics.Inc("filter.dropped")
+				}
+				return accepted
+			}
+		}
+	}
+	atomic.AddUint64(&f.defaultHits, 1)
+	if f.defaultAction == FILTER_DROP {
+		metrics.Inc("filter.dropped")
+		return false
+	}
+	return true
+}
+
+// Get the filter state, with the hit counters
+func (f *Filter) Status() FilterStatus {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	status := func(rules []*FilterRule) []RuleStatus {
+		res := make([]RuleStatus, len(rules))
+		for i, r := range rules {
+			res[i] = RuleStatus{
+				Rule:    r.spec,
+				Hits:    atomic.LoadUint64(&r.hits),
+				Dropped: atomic.LoadUint64(&r.dropped),
+			}
+		}
+		return res
+	}
+	res := FilterStatus{
+		Default:     f.defaultAction,
+		DefaultHits: atomic.LoadUint64(&f.defaultHits),
+		Rules:       status(f.rules),
+		SharedRules: status(f.shared),
+	}
+	if f.ruleSet != nil {
+		res.SharedVersion = f.ruleSet.Version
+		res.SharedOrigin = f.ruleSet.Origin
+	}
+	return res
+}
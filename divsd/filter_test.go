@@ -0,0 +1,174 @@
+package divsd
+
+import (
+	"net"
+	"testing"
+
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+)
+
+// build a IPv4/TCP packet, optionally tagged with a VLAN
+func newTestTCPPacket(t *testing.T, vlan uint16, dst string, dport uint16) *EthernetPacket {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("10.0.0.1"),
+		DstIP:    net.ParseIP(dst),
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(dport)}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp); err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	pkt := newTestPacket()
+	pkt.Payload = buf.Bytes()
+	if vlan != 0 {
+		tagged, err := pkt.Tag(vlan)
+		if err != nil {
+			t.Fatalf("could not tag packet: %s", err)
+		}
+		pkt = tagged
+	}
+	return pkt
+}
+
+func TestParseFilterRule(t *testing.T) {
+	for _, spec := range []string{
+		"allow",
+		"drop proto=tcp dport=22 dst=10.0.0.0/8",
+		"limit=100 ethertype=arp",
+		"drop dir=in vlan=10 srcmac=02:00:00:00:00:01 sport=1000-2000",
+		"allow src=fd00::/64 proto=udp",
+	} {
+		if _, err := ParseFilterRule(spec); err != nil {
+			t.Errorf("rule %q: unexpected err: %s", spec, err)
+		}
+	}
+	for _, spec := range []string{
+		"",
+		"reject",
+		"limit",
+		"drop=10",
+		"drop dir=up",
+		"drop vlan=5000",
+		"drop dst=10.0.0.300/8",
+		"drop dport=70000",
+		"drop dport=20-10",
+		"drop foo=bar",
+		"drop proto",
+	} {
+		if _, err := ParseFilterRule(spec); err == nil {
+			t.Errorf("invalid rule %q not detected", spec)
+		}
+	}
+}
+
+func TestFilterCheck(t *testing.T) {
+	f, err := NewFilter(filterConfig{
+		Default: FILTER_ALLOW,
+		Rule: []string{
+			"drop dir=out proto=tcp dport=22 dst=192.168.0.0/16",
+			"drop vlan=10",
+			"drop ethertype=arp",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	if f.Check(FILTER_OUT, newTestTCPPacket(t, 0, "192.168.1.1", 22)) {
+		t.Errorf("SSH to 192.168.1.1 not dropped")
+	}
+	if !f.Check(FILTER_IN, newTestTCPPacket(t, 0, "192.168.1.1", 22)) {
+		t.Errorf("incoming SSH to 192.168.1.1 dropped")
+	}
+	if !f.Check(FILTER_OUT, newTestTCPPacket(t, 0, "172.16.1.1", 22)) {
+		t.Errorf("SSH to 172.16.1.1 dropped")
+	}
+	if !f.Check(FILTER_OUT, newTestTCPPacket(t, 0, "192.168.1.1", 80)) {
+		t.Errorf("HTTP to 192.168.1.1 dropped")
+	}
+	if f.Check(FILTER_OUT, newTestTCPPacket(t, 10, "172.16.1.1", 80)) {
+		t.Errorf("packet in VLAN 10 not dropped")
+	}
+	arp := newTestPacket()
+	arp.EthernetType = layers.EthernetTypeARP
+	if f.Check(FILTER_IN, arp) {
+		t.Errorf("ARP packet not dropped")
+	}
+
+	status := f.Status()
+	if status.Rules[0].Hits != 1 || status.Rules[0].Dropped != 1 {
+		t.Errorf("unexpected counters for rule 0: %+v", status.Rules[0])
+	}
+	if status.DefaultHits != 3 {
+		t.Errorf("unexpected default hits: %d", status.DefaultHits)
+	}
+
+	// a default "drop" drops anything not allowed
+	if err := f.SetRules(FILTER_DROP, []string{"allow proto=tcp dport=80"}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if !f.Check(FILTER_OUT, newTestTCPPacket(t, 0, "192.168.1.1", 80)) {
+		t.Errorf("HTTP dropped")
+	}
+	if f.Check(FILTER_OUT, newTestTCPPacket(t, 0, "192.168.1.1", 22)) {
+		t.Errorf("SSH not dropped")
+	}
+}
+
+func TestFilterLimit(t *testing.T) {
+	f, err := NewFilter(filterConfig{Default: FILTER_ALLOW, Rule: []string{"limit=1 proto=tcp"}})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	accepted := 0
+	for i := 0; i < 5; i++ {
+		if f.Check(FILTER_OUT, newTestTCPPacket(t, 0, "192.168.1.1", 80)) {
+			accepted++
+		}
+	}
+	if accepted == 0 || accepted == 5 {
+		t.Errorf("unexpected number of packets accepted: %d", accepted)
+	}
+}
+
+func TestFilterRuleSet(t *testing.T) {
+	f, err := NewFilter(filterConfig{Default: FILTER_ALLOW})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	rs := &RuleSet{Version: 2, Origin: "node1", Rules: []string{"drop proto=tcp dport=22"}}
+	if accepted, err := f.SetRuleSet(rs); !accepted || err != nil {
+		t.Fatalf("rule set not accepted: %s", err)
+	}
+	if f.Check(FILTER_IN, newTestTCPPacket(t, 0, "192.168.1.1", 22)) {
+		t.Errorf("SSH not dropped by the shared rules")
+	}
+
+	// older rule sets are ignored
+	older := &RuleSet{Version: 1, Origin: "node2", Rules: []string{}}
+	if accepted, _ := f.SetRuleSet(older); accepted {
+		t.Errorf("older rule set accepted")
+	}
+	if f.RuleSet() != rs {
+		t.Errorf("rule set replaced")
+	}
+
+	// invalid rule sets are rejected
+	invalid := &RuleSet{Version: 3, Origin: "node2", Rules: []string{"reject"}}
+	if _, err := f.SetRuleSet(invalid); err == nil {
+		t.Errorf("invalid rule set accepted")
+	}
+
+	newer := &RuleSet{Version: 3, Origin: "node2", Rules: []string{}}
+	if accepted, _ := f.SetRuleSet(newer); !accepted {
+		t.Errorf("newer rule set not accepted")
+	}
+	if !f.Check(FILTER_IN, newTestTCPPacket(t, 0, "192.168.1.1", 22)) {
+		t.Errorf("SSH dropped after removing the shared rules")
+	}
+}
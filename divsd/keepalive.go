@@ -0,0 +1,230 @@
+package divsd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/inercia/divs/divsd/nat"
+)
+
+// initial interval between keepalives (most NATs expire UDP mappings after
+// 30 seconds or more)
+const KEEPALIVE_INITIAL_INTERVAL = 15 * time.Second
+
+// minimum and maximum interval between keepalives
+const (
+	KEEPALIVE_MIN_INTERVAL = 5 * time.Second
+	KEEPALIVE_MAX_INTERVAL = 120 * time.Second
+)
+
+// increment of the interval every time a keepalive is answered
+const KEEPALIVE_INTERVAL_STEP = 5 * time.Second
+
+// time we wait for the answer to a keepalive
+const KEEPALIVE_TIMEOUT = 5 * time.Second
+
+// interval for checking if some peers need a keepalive
+const KEEPALIVE_TICK = 1 * time.Second
+
+// The keepalive state for a peer
+type KeepaliveInfo struct {
+	Interval time.Duration `json:"interval"` // current interval between keepalives
+	Lifetime time.Duration `json:"lifetime"` // estimated mapping lifetime (0 if unknown)
+	RTT      time.Duration `json:"rtt"`      // round-trip time of the last keepalive answered
+	Sent     int64         `json:"sent"`
+	Acked    int64         `json:"acked"`
+	Lost     int64         `json:"lost"`
+
+	seq          uint32
+	pending      bool
+	pendingSince time.Time
+	lastSent     time.Time // last time we sent anything to the peer
+	alive        time.Duration
+}
+
+// Check if a keepalive must be sent, or if the pending one has been lost
+func (k *KeepaliveInfo) check(now time.Time) (send bool) {
+	if k.pending {
+		if now.Sub(k.pendingSince) > KEEPALIVE_TIMEOUT {
+			k.lost()
+		}
+		return false
+	}
+	return now.Sub(k.lastSent) >= k.Interval
+}
+
+// A keepalive has been answered: the mapping survived the interval, so we
+// try with a longer one (without reaching the lifetime observed)
+func (k *KeepaliveInfo) acked(now time.Time) {
+	k.pending = false
+	k.Acked++
+	k.RTT = now.Sub(k.pendingSince)
+	if k.Interval > k.alive {
+		k.alive = k.Interval
+	}
+
+	next := k.Interval + KEEPALIVE_INTERVAL_STEP
+	if k.Lifetime > 0 && next > k.Lifetime*3/4 {
+		next = k.Lifetime * 3 / 4
+	}
+	k.Interval = clampDuration(next, KEEPALIVE_MIN_INTERVAL, KEEPALIVE_MAX_INTERVAL)
+}
+
+// A keepalive has not been answered: the mapping has probably expired before
+// the interval, so we go back to a safe interval
+func (k *KeepaliveInfo) lost() {
+	k.pending = false
+	k.Lost++
+	if k.Lifetime == 0 || k.Interval < k.Lifetime {
+		k.Lifetime = k.Interval
+	}
+
+	next := k.Interval / 2
+	if k.alive > 0 && k.alive < k.Interval && k.alive > next {
+		next = k.alive
+	}
+	k.Interval = clampDuration(next, KEEPALIVE_MIN_INTERVAL, KEEPALIVE_MAX_INTERVAL)
+}
+
+func clampDuration(d time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// The keepalive scheduler sends keepalives to the peers we have not sent
+// anything to in a while, keeping the NAT mappings active. The interval is
+// adapted for each peer, depending on the mapping lifetime observed.
+type Keepaliver struct {
+	nm    *NodesManager
+	peers map[string]*KeepaliveInfo
+	mutex sync.Mutex
+}
+
+// Create a new keepalive scheduler
+func NewKeepaliver(nm *NodesManager) *Keepaliver {
+	return &Keepaliver{
+		nm:    nm,
+		peers: make(map[string]*KeepaliveInfo),
+	}
+}
+
+// get the keepalive state for a peer. The caller must be holding the lock.
+func (k *Keepaliver) peer(name string) *KeepaliveInfo {
+	info, found := k.peers[name]
+	if !found {
+		info = &KeepaliveInfo{Interval: KEEPALIVE_INITIAL_INTERVAL, lastSent: time.Now()}
+		k.peers[name] = info
+	}
+	return info
+}
+
+// Some traffic has been sent to a peer: no keepalive is needed for a while
+func (k *Keepaliver) Sent(name string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.peer(name).lastSent = time.Now()
+}
+
+// Forget about a peer
+func (k *Keepaliver) Forget(name string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.peers, name)
+}
+
+// Get the keepalive state for all the peers
+func (k *Keepaliver) Info() map[string]KeepaliveInfo {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	res := make(map[string]KeepaliveInfo, len(k.peers))
+	for name, info := range k.peers {
+		res[name] = *info
+	}
+	return res
+}
+
+// Run the scheduler, until the nodes manager leaves the cluster
+func (k *Keepaliver) Run() {
+	ticker := time.NewTicker(KEEPALIVE_TICK)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			// nodes not behind a NAT do not need keepalives
+			if nat.DetectedType() != nat.NAT_TYPE_NONE {
+				k.tick(now)
+			}
+		case <-k.nm.stopChan:
+			return
+		}
+	}
+}
+
+// send the keepalives needed
+func (k *Keepaliver) tick(now time.Time) {
+	k.nm.mutex.RLock()
+	nodes := make([]*Node, 0, len(k.nm.nodes))
+	for _, node := range k.nm.nodes {
+		nodes = append(nodes, node)
+	}
+	k.nm.mutex.RUnlock()
+
+	for _, node := range nodes {
+		// the relay keeps the mappings for the nodes we reach through it
+		if k.nm.nextHop(node) != node {
+			continue
+		}
+
+		k.mutex.Lock()
+		info := k.peer(node.Name)
+		lost := info.Lost
+		send := info.check(now)
+		if info.Lost > lost {
+			metrics.Inc("keepalive.lost")
+			log.Debug("Keepalive to %s lost: interval is now %s", node.Name, info.Interval)
+		}
+		if send {
+			info.seq++
+			info.pending = true
+			info.pendingSince = now
+			info.lastSent = now
+			info.Sent++
+		}
+		seq := info.seq
+		k.mutex.Unlock()
+
+		if send {
+			metrics.Inc("keepalive.sent")
+			node.Send(&Keepalive{From: k.nm.localName, Seq: seq})
+		}
+	}
+}
+
+// Answer a keepalive from a peer
+func (k *Keepaliver) handleKeepalive(ka *Keepalive) {
+	k.nm.mutex.RLock()
+	node, found := k.nm.nodes[ka.From]
+	k.nm.mutex.RUnlock()
+	if !found {
+		return
+	}
+	metrics.Inc("keepalive.received")
+	node.Send(&KeepaliveAck{From: k.nm.localName, Seq: ka.Seq})
+}
+
+// A peer has answered one of our keepalives
+func (k *Keepaliver) handleAck(ack *KeepaliveAck) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	info, found := k.peers[ack.From]
+	if !found || !info.pending || info.seq != ack.Seq {
+		return
+	}
+	info.acked(time.Now())
+	metrics.Inc("keepalive.acked")
+}
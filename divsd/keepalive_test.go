@@ -0,0 +1,49 @@
+package divsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepaliveAdaptiveInterval(t *testing.T) {
+	now := time.Now()
+	k := &KeepaliveInfo{Interval: KEEPALIVE_INITIAL_INTERVAL, lastSent: now}
+
+	if k.check(now.Add(KEEPALIVE_INITIAL_INTERVAL / 2)) {
+		t.Fatalf("keepalive sent before the interval")
+	}
+	if !k.check(now.Add(KEEPALIVE_INITIAL_INTERVAL)) {
+		t.Fatalf("keepalive not sent after the interval")
+	}
+
+	// answered keepalives make the interval longer
+	k.pending, k.pendingSince = true, now
+	k.acked(now.Add(100 * time.Millisecond))
+	if expected := KEEPALIVE_INITIAL_INTERVAL + KEEPALIVE_INTERVAL_STEP; k.Interval != expected {
+		t.Fatalf("expected interval %s, got %s", expected, k.Interval)
+	}
+	if k.RTT != 100*time.Millisecond {
+		t.Fatalf("unexpected RTT %s", k.RTT)
+	}
+
+	// a lost keepalive goes back to the last interval that worked, and the
+	// interval never reaches the observed lifetime again
+	k.pending, k.pendingSince = true, now
+	if k.check(now.Add(KEEPALIVE_TIMEOUT * 2)); k.Lost != 1 || k.pending {
+		t.Fatalf("keepalive not detected as lost")
+	}
+	if k.Interval != KEEPALIVE_INITIAL_INTERVAL {
+		t.Fatalf("expected interval %s, got %s", KEEPALIVE_INITIAL_INTERVAL, k.Interval)
+	}
+	lifetime := KEEPALIVE_INITIAL_INTERVAL + KEEPALIVE_INTERVAL_STEP
+	if k.Lifetime != lifetime {
+		t.Fatalf("expected lifetime %s, got %s", lifetime, k.Lifetime)
+	}
+	for i := 0; i < 10; i++ {
+		k.pending, k.pendingSince = true, now
+		k.acked(now)
+	}
+	if k.Interval > lifetime*3/4 {
+		t.Fatalf("interval %s too close to the lifetime %s", k.Interval, lifetime)
+	}
+}
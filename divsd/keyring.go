@@ -0,0 +1,51 @@
+package divsd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Decode a list of base64-encoded keys
+// Keys must be 16, 24 or 32 bytes long, for selecting AES-128, AES-192 or AES-256
+func decodeKeys(encoded []string) ([][]byte, error) {
+	keys := make([][]byte, 0, len(encoded))
+	for _, e := range encoded {
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode key: %s", err)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("invalid key length %d: must be 16, 24 or 32 bytes", len(key))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Create a new keyring from a list of base64-encoded keys
+// It returns a nil keyring (and no error) when there are no keys.
+func newKeyring(encoded []string) (*memberlist.Keyring, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	keys, err := decodeKeys(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return memberlist.NewKeyring(keys, keys[0])
+}
+
+// Derive the cluster key from the switch secret
+// The switch secret never leaves the node that created the switch: other nodes
+// receive this derived key in the join tokens.
+func deriveClusterKey(secret []byte, serial string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("divs cluster key:" + serial))
+	return mac.Sum(nil)
+}
@@ -6,6 +6,9 @@ import (
 
 const LOG_MODULE = "divs"
 
+// the log level used when no level is configured
+const DEFAULT_LOG_LEVEL = "info"
+
 var log = logging.MustGetLogger(LOG_MODULE)
 
 // Example format string. Everything except the message has a custom color
@@ -44,3 +47,16 @@ func (logger loggerW) Write(p []byte) (n int, err error) {
 	log.Info(skipFields(msg, " ", 3))
 	return len(msg), nil
 }
+
+// Set the log level from a name (ie, "debug", "info", "warning"...)
+func SetLogLevel(name string) error {
+	if len(name) == 0 {
+		name = DEFAULT_LOG_LEVEL
+	}
+	level, err := logging.LogLevel(name)
+	if err != nil {
+		return err
+	}
+	logging.SetLevel(level, LOG_MODULE)
+	return nil
+}
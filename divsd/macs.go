@@ -0,0 +1,118 @@
+package divsd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The key in the MAC database: the same MAC can be in different VLANs
+type MacKey struct {
+	Vlan uint16
+	MAC  string
+}
+
+// An entry in the MAC database: the node where the MAC is located and,
+// when that node is not directly reachable, the relay for reaching it
+type MacEntry struct {
+	Vlan    uint16    `json:"vlan"`
+	MAC     string    `json:"mac"`
+	Node    string    `json:"node"`
+	Via     string    `json:"via,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// The MAC database: a (VLAN, MAC address) to node mapping
+type MacTable struct {
+	entries map[MacKey]*MacEntry
+	mutex   sync.RWMutex
+}
+
+// Create a new MAC database
+func NewMacTable() *MacTable {
+	return &MacTable{
+		entries: make(map[MacKey]*MacEntry),
+	}
+}
+
+// Lookup the node for a MAC address in a VLAN
+func (t *MacTable) Lookup(vlan uint16, mac string) (MacEntry, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	entry, found := t.entries[MacKey{vlan, mac}]
+	if !found {
+		return MacEntry{}, false
+	}
+	return *entry, true
+}
+
+// Learn that a MAC in a VLAN is located at a node (reachable through a relay,
+// if not empty)
+// Returns `true` if the MAC was unknown or it was located somewhere else.
+func (t *MacTable) Learn(vlan uint16, mac string, node string, via string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := MacKey{vlan, mac}
+	entry, found := t.entries[key]
+	if !found {
+		t.entries[key] = &MacEntry{Vlan: vlan, MAC: mac, Node: node, Via: via, Updated: time.Now()}
+		return true
+	}
+
+	changed := entry.Node != node || entry.Via != via
+	entry.Node = node
+	entry.Via = via
+	entry.Updated = time.Now()
+	return changed
+}
+
+// Update the relay used for reaching all the MACs located at a node
+func (t *MacTable) SetVia(node string, via string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, entry := range t.entries {
+		if entry.Node == node {
+			entry.Via = via
+		}
+	}
+}
+
+// Remove all the MACs located at a node
+func (t *MacTable) RemoveNode(node string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, entry := range t.entries {
+		if entry.Node == node {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Remove all the entries
+func (t *MacTable) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entries = make(map[MacKey]*MacEntry)
+}
+
+// Get a copy of all the entries, sorted by VLAN and MAC
+func (t *MacTable) Entries() []MacEntry {
+	t.mutex.RLock()
+	res := make([]MacEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		res = append(res, *entry)
+	}
+	t.mutex.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Vlan != res[j].Vlan {
+			return res[i].Vlan < res[j].Vlan
+		}
+		return res[i].MAC < res[j].MAC
+	})
+	return res
+}
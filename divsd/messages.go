@@ -2,6 +2,8 @@ package divsd
 
 import (
 	"bytes"
+
+	"code.google.com/p/gopacket"
 	"code.google.com/p/gopacket/layers"
 	"github.com/ugorji/go/codec"
 )
@@ -11,8 +13,22 @@ import (
 type messageType uint8
 
 // The list of available message types.
+// They must be lower than MSG_FLAG_COMPRESSED.
 const (
 	MSG_DIVS_PKG_ETH messageType = iota
+	MSG_DIVS_MAC_ANNOUNCE
+	MSG_DIVS_MACS_STATE
+	MSG_DIVS_RELAY
+	MSG_DIVS_PUNCH_REQUEST
+	MSG_DIVS_PUNCH_SYNC
+	MSG_DIVS_PUNCH_PROBE
+	MSG_DIVS_PUNCH_ACK
+	MSG_DIVS_KEEPALIVE
+	MSG_DIVS_KEEPALIVE_ACK
+	MSG_DIVS_RULES
+	MSG_DIVS_GROUP
+	MSG_DIVS_MIRROR
+	MSG_DIVS_BATCH
 	MSG_LAST
 )
 
@@ -25,6 +41,7 @@ type Encodeable interface {
 // An encapsulated ethernet packet
 type EthernetPacket struct {
 	layers.Ethernet
+	From string // the node that sent the packet (empty from old nodes)
 }
 
 // Decode a ethernet packet from a buffer
@@ -45,6 +62,216 @@ func (pkt EthernetPacket) Encode() (data []byte, err error) {
 	return buf.Bytes(), nil
 }
 
+// Serialize the ethernet packet as a frame that can be written to a TAP device
+func (pkt *EthernetPacket) Bytes() ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{}
+	if err := gopacket.SerializeLayers(buf, opts, &pkt.Ethernet, gopacket.Payload(pkt.Payload)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/////////////////////////////////////////////////////////////////////////
+
+// A MAC address announcement: the MAC is located at a node
+type MacAnnounce struct {
+	MAC  string
+	Node string
+	Vlan uint16 // 0 from nodes without VLAN support
+}
+
+func (m MacAnnounce) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_MAC_ANNOUNCE, m)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The list of MACs located at a node, exchanged in push/pull syncs
+type MacsState struct {
+	Node   string
+	MACs   []string
+	Vlans  []uint16          // the VLAN of each MAC (missing from nodes without VLAN support)
+	Rules  *RuleSet          // the shared filter rules known by the node (if any)
+	Groups []GroupMembership // the multicast groups with receivers behind the node
+}
+
+func (m MacsState) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_MACS_STATE, m)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A multicast group in a VLAN
+type GroupMembership struct {
+	Vlan  uint16
+	Group string // the group IP address
+}
+
+// A multicast group membership announcement: there are (or there are no
+// more) receivers for a group behind a node
+type GroupAnnounce struct {
+	Node  string
+	Group GroupMembership
+	Join  bool
+}
+
+func (g GroupAnnounce) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_GROUP, g)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A frame mirrored by a node
+type MirroredPacket struct {
+	From    string // the node that mirrored the frame
+	Session string // the mirroring session
+	Frame   []byte
+}
+
+func (m MirroredPacket) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_MIRROR, m)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The filter rules shared by all the nodes in the switch
+type RuleSet struct {
+	Version int64  // rule sets with higher versions replace the previous ones
+	Origin  string // the node that published the rules
+	Rules   []string
+}
+
+// check if a rule set is newer than other one (ties are broken by origin, so
+// all the nodes choose the same rule set)
+func (rs *RuleSet) newerThan(other *RuleSet) bool {
+	if rs.Version != other.Version {
+		return rs.Version > other.Version
+	}
+	return rs.Origin > other.Origin
+}
+
+func (rs RuleSet) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_RULES, rs)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// An ethernet packet relayed through some other node
+type RelayedPacket struct {
+	From   string // the node that sent the packet
+	To     string // the final destination node
+	Hops   int    // number of relays the packet has gone through
+	Packet EthernetPacket
+}
+
+func (r RelayedPacket) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_RELAY, r)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A request for coordinating a hole punching with some other node
+type PunchRequest struct {
+	Session uint64
+	From    string
+	To      string
+}
+
+func (p PunchRequest) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_PUNCH_REQUEST, p)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The coordinator instructing a node to start probing a peer
+type PunchSync struct {
+	Session  uint64
+	Peer     string // the peer name
+	PeerAddr string // the peer external address, as host:port
+	PeerNat  string // the type of NAT the peer is behind
+}
+
+func (p PunchSync) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_PUNCH_SYNC, p)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A hole punching probe
+type PunchProbe struct {
+	Session uint64
+	From    string
+	ToAddr  string // the address the probe was sent to
+}
+
+func (p PunchProbe) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_PUNCH_PROBE, p)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The answer to a hole punching probe
+type PunchAck struct {
+	Session   uint64
+	From      string
+	ProbeAddr string // the address where the probe was received
+}
+
+func (p PunchAck) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_PUNCH_ACK, p)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A keepalive, for keeping the NAT mappings active
+type Keepalive struct {
+	From string
+	Seq  uint32
+}
+
+func (k Keepalive) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_KEEPALIVE, k)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The answer to a keepalive
+type KeepaliveAck struct {
+	From string
+	Seq  uint32
+}
+
+func (k KeepaliveAck) Encode() (data []byte, err error) {
+	buf, err := encodeMsg(MSG_DIVS_KEEPALIVE_ACK, k)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 /////////////////////////////////////////////////////////////////////////
 
 // Encode writes an encoded object to a new bytes buffer
@@ -71,6 +298,9 @@ func decodeMsg(buf []byte, out interface{}) error {
 // Peek the first bytes two bytes of a buffer for identifying the
 // message type
 func peekMsgType(buf []byte) (messageType, error) {
+	if len(buf) == 0 {
+		return MSG_LAST, ERR_MALFORMED_MSG
+	}
 	var msgType messageType = messageType(buf[0])
 	return msgType, nil
 }
@@ -79,5 +309,8 @@ func peekMsgType(buf []byte) (messageType, error) {
 // You can then apply `decode()` in the buffer result
 func getTypeAndEncodedMsg(buf []byte) (messageType, []byte, error) {
 	msgType, err := peekMsgType(buf)
-	return msgType, buf[1:], err
+	if err != nil {
+		return msgType, nil, err
+	}
+	return msgType, buf[1:], nil
 }
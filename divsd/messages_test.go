@@ -40,7 +40,7 @@ func TestEncodeDecode(t *testing.T) {
 // Assert we can serialize/deserialize a ethernet package
 func TestPkgEtherSerialization(t *testing.T) {
 	pkg := EthernetPacket{
-		layers.Ethernet{
+		Ethernet: layers.Ethernet{
 			BaseLayer: layers.BaseLayer{
 				Payload: []byte("0123456789"),
 			},
@@ -61,7 +61,7 @@ func TestPkgEtherSerialization(t *testing.T) {
 // Benchmark for ethernet package serialization/deserializations
 func BenchmarkDbReqSerialization(b *testing.B) {
 	pkg := EthernetPacket{
-		layers.Ethernet{
+		Ethernet: layers.Ethernet{
 			BaseLayer: layers.BaseLayer{
 				Payload: []byte("0123456789"),
 			},
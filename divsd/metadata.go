@@ -0,0 +1,108 @@
+package divsd
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+// the software version
+const VERSION = "0.1.0"
+
+// Protocol features supported by this node
+var FEATURES = []string{
+	"eth",        // encapsulated ethernet packets (MSG_DIVS_PKG_ETH)
+	FEATURE_VLAN, // 802.1Q tagged packets
+}
+
+// Capabilities a node can provide to the rest of the switch
+const (
+	CAP_RELAY = "relay"
+)
+
+// Node metadata too large
+var ERR_META_TOO_LARGE = fmt.Errorf("Node metadata too large")
+
+// The metadata published by a node through the memberlist
+type NodeMeta struct {
+	Name         string   `json:"name"`         // node name
+	Version      string   `json:"version"`      // software version
+	Features     []string `json:"features"`     // protocol features supported
+	TapMAC       string   `json:"tap_mac"`      // MAC address of the TAP device
+	Site         string   `json:"site"`         // site label
+	Region       string   `json:"region"`       // region label
+	Capabilities []string `json:"capabilities"` // capabilities provided (ie, relay)
+	NatType      string   `json:"nat_type"`     // type of NAT the node is behind
+	Via          string   `json:"via"`          // relay for reaching the node (if not directly reachable)
+	Addr         string   `json:"addr"`         // external address (IP:port) of the node
+	Addr6        string   `json:"addr6"`        // global IPv6 address ([IP]:port) of the node, if any
+	Vlans        string   `json:"vlans"`        // VLANs carried by the node (ie, "1,10-20"), or empty for all
+}
+
+// Decode some node metadata
+func DecodeNodeMeta(buf []byte) (*NodeMeta, error) {
+	meta := &NodeMeta{}
+	if len(buf) == 0 {
+		return meta, nil
+	}
+	hd := codec.MsgpackHandle{}
+	if err := codec.NewDecoder(bytes.NewReader(buf), &hd).Decode(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// The optional fields in the metadata, dropped (in this order) when the
+// metadata is larger than the limit
+var metaOptionalFields = []struct {
+	name  string
+	clear func(meta *NodeMeta)
+}{
+	{"TAP MAC", func(meta *NodeMeta) { meta.TapMAC = "" }},
+	{"site and region", func(meta *NodeMeta) { meta.Site, meta.Region = "", "" }},
+	{"VLANs", func(meta *NodeMeta) { meta.Vlans = "" }},
+}
+
+// Encode the node metadata, checking the result is not larger than a limit
+// The optional fields are dropped until the metadata fits in the limit, so the
+// fields needed for talking to the node (features, relay, addresses...) are
+// always published.
+func (meta *NodeMeta) Encode(limit int) ([]byte, error) {
+	m := *meta
+	buf, err := m.encode()
+	for _, field := range metaOptionalFields {
+		if err != nil || len(buf) <= limit {
+			break
+		}
+		log.Warning("Node metadata too large (%d bytes): not publishing the %s", len(buf), field.name)
+		field.clear(&m)
+		buf, err = m.encode()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > limit {
+		return nil, ERR_META_TOO_LARGE
+	}
+	return buf, nil
+}
+
+func (meta *NodeMeta) encode() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	hd := codec.MsgpackHandle{}
+	if err := codec.NewEncoder(buf, &hd).Encode(meta); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Return `true` if the node provides some capability
+func (meta *NodeMeta) HasCapability(capability string) bool {
+	return containsString(meta.Capabilities, capability)
+}
+
+// Return `true` if the node supports some protocol feature
+func (meta *NodeMeta) HasFeature(feature string) bool {
+	return containsString(meta.Features, feature)
+}
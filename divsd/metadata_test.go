@@ -0,0 +1,70 @@
+package divsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNodeMetaEncodeDecode(t *testing.T) {
+	meta := &NodeMeta{
+		Name:         "node-a",
+		Version:      VERSION,
+		Features:     FEATURES,
+		TapMAC:       "02:00:00:00:00:01",
+		Site:         "bcn",
+		Region:       "eu-west",
+		Capabilities: []string{CAP_RELAY},
+	}
+
+	buf, err := meta.Encode(512)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	decoded, err := DecodeNodeMeta(buf)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(meta, decoded) {
+		t.Fatalf("decoded %+v is different from %+v", decoded, meta)
+	}
+	if !decoded.HasCapability(CAP_RELAY) || decoded.HasCapability("other") {
+		t.Fatalf("bad capabilities: %v", decoded.Capabilities)
+	}
+
+	if _, err := meta.Encode(10); err != ERR_META_TOO_LARGE {
+		t.Fatalf("limit not enforced: %v", err)
+	}
+}
+
+func TestNodeMetaEncodeLimit(t *testing.T) {
+	meta := &NodeMeta{
+		Name:         "node-a",
+		Version:      VERSION,
+		Features:     append(FEATURES, FEATURE_IGMP, FEATURE_SNAPPY, FEATURE_BATCH),
+		TapMAC:       "02:00:00:00:00:01",
+		Site:         strings.Repeat("s", 250),
+		Region:       strings.Repeat("r", 250),
+		Capabilities: []string{CAP_RELAY},
+		Via:          "relay-node",
+		Addr:         "203.0.113.10:7946",
+		Vlans:        "1,10-20",
+	}
+
+	// the optional fields are dropped until the metadata fits in the memberlist limit
+	buf, err := meta.Encode(512)
+	if err != nil || len(buf) > 512 {
+		t.Fatalf("metadata not shrunk: %d bytes (err: %v)", len(buf), err)
+	}
+	decoded, _ := DecodeNodeMeta(buf)
+	if len(decoded.TapMAC) > 0 || len(decoded.Site) > 0 || len(decoded.Region) > 0 {
+		t.Errorf("optional fields published: %+v", decoded)
+	}
+	if decoded.Vlans != meta.Vlans || decoded.Via != meta.Via || decoded.Addr != meta.Addr ||
+		!reflect.DeepEqual(decoded.Features, meta.Features) || !decoded.HasCapability(CAP_RELAY) {
+		t.Errorf("required fields not published: %+v", decoded)
+	}
+	if meta.Site != strings.Repeat("s", 250) {
+		t.Errorf("original metadata modified")
+	}
+}
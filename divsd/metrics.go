@@ -0,0 +1,56 @@
+package divsd
+
+import (
+	"sync"
+)
+
+// A set of named counters, exposed in the control API
+type Metrics struct {
+	counters map[string]int64
+	mutex    sync.Mutex
+}
+
+// Create a new set of counters
+func NewMetrics() *Metrics {
+	return &Metrics{counters: make(map[string]int64)}
+}
+
+// the metrics for this daemon
+var metrics = NewMetrics()
+
+// Increment a counter
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Add some value to a counter
+func (m *Metrics) Add(name string, delta int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[name] += delta
+}
+
+// Set the value of a counter
+func (m *Metrics) Set(name string, value int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[name] = value
+}
+
+// Get the value of a counter
+func (m *Metrics) Get(name string) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counters[name]
+}
+
+// Get a copy of all the counters
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	res := make(map[string]int64, len(m.counters))
+	for name, value := range m.counters {
+		res[name] = value
+	}
+	return res
+}
@@ -0,0 +1,276 @@
+package divsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/inercia/water/tuntap"
+)
+
+// the queue length for frames waiting to be written to a mirror TAP device
+const MIRROR_QUEUE_LEN = 1000
+
+// A TAP device where mirrored frames are written
+type mirrorTap struct {
+	tun   *tuntap.TunTap
+	queue chan []byte
+	done  chan struct{}
+}
+
+// create a mirror TAP device
+func newMirrorTap(name string) (*mirrorTap, error) {
+	tun, err := tuntap.NewTAP(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not create mirror TAP device %s: %s", name, err)
+	}
+	log.Info("Mirror TAP device: %s", tun.Name())
+	t := &mirrorTap{
+		tun:   tun,
+		queue: make(chan []byte, MIRROR_QUEUE_LEN),
+		done:  make(chan struct{}),
+	}
+	go t.writer()
+	return t, nil
+}
+
+// enqueue a frame for writing, returning `false` if the queue is full
+func (t *mirrorTap) write(frame []byte) bool {
+	select {
+	case t.queue <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *mirrorTap) writer() {
+	defer close(t.done)
+	for frame := range t.queue {
+		if _, err := t.tun.Write(frame); err != nil {
+			log.Debug("Error writing to mirror TAP device: %s", err)
+		}
+	}
+}
+
+// close the device, once everything enqueued has been written
+func (t *mirrorTap) close() {
+	close(t.queue)
+	<-t.done
+	if err := t.tun.Close(); err != nil {
+		log.Warning("Error closing mirror TAP device: %s", err)
+	}
+}
+
+// A mirroring session: the frames for some MACs, VLANs or nodes are copied to
+// a local mirror TAP device or to a remote node
+type mirrorSession struct {
+	name     string
+	macs     map[string]bool
+	vlans    VlanSet
+	nodes    map[string]bool
+	tap      string // the local mirror TAP device
+	remote   string // the node receiving the mirrored frames
+	mirrored uint64
+	dropped  uint64
+}
+
+func newMirrorSession(name string, c *mirrorConfig) (*mirrorSession, error) {
+	s := &mirrorSession{
+		name:   name,
+		macs:   make(map[string]bool),
+		nodes:  make(map[string]bool),
+		tap:    c.Tap,
+		remote: c.Remote,
+	}
+	for _, m := range c.Mac {
+		mac, err := net.ParseMAC(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC '%s'", m)
+		}
+		s.macs[mac.String()] = true
+	}
+	if len(c.Vlan) > 0 {
+		vlans, err := ParseVlanSet(c.Vlan)
+		if err != nil {
+			return nil, err
+		}
+		s.vlans = vlans
+	}
+	for _, node := range c.Node {
+		s.nodes[node] = true
+	}
+	return s, nil
+}
+
+// check if a frame from a node to other node (empty when flooded) must be
+// mirrored in this session
+func (s *mirrorSession) matches(from string, to string, pkt *EthernetPacket) bool {
+	switch {
+	case s.macs[pkt.SrcMAC.String()] || s.macs[pkt.DstMAC.String()]:
+		return true
+	case s.vlans != nil && s.vlans.Contains(pkt.Vlan()):
+		return true
+	case s.nodes[from] || s.nodes[to] || (len(to) == 0 && len(s.nodes) > 0):
+		return true
+	}
+	return false
+}
+
+// get the names of the mirroring sessions, sorted
+func sortedMirrorNames(mirrors map[string]*mirrorConfig) []string {
+	names := make([]string, 0, len(mirrors))
+	for name := range mirrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The information about a mirroring session, as exposed in the control API
+type MirrorInfo struct {
+	Name     string `json:"name"`
+	Tap      string `json:"tap,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Mirrored uint64 `json:"mirrored"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// The port mirroring: it copies the frames that go through the switch (the
+// frames read from the TAP device and the packets received from other nodes)
+// to the mirroring sessions, and it writes the frames mirrored by other nodes
+// to the mirror sink device
+type Mirror struct {
+	config   *Config
+	nm       *NodesManager
+	sessions []*mirrorSession
+	taps     map[string]*mirrorTap
+	sink     *mirrorTap
+	mutex    sync.RWMutex
+}
+
+// Create a new port mirroring
+func NewMirror(config *Config, nm *NodesManager) (*Mirror, error) {
+	m := &Mirror{config: config, nm: nm, taps: make(map[string]*mirrorTap)}
+	for _, name := range sortedMirrorNames(config.Mirror) {
+		s, err := newMirrorSession(name, config.Mirror[name])
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s: %s", name, err)
+		}
+		m.sessions = append(m.sessions, s)
+	}
+	return m, nil
+}
+
+// Start the mirroring, creating the mirror TAP devices
+func (m *Mirror) Start() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, s := range m.sessions {
+		if len(s.tap) == 0 || m.taps[s.tap] != nil {
+			continue
+		}
+		t, err := newMirrorTap(s.tap)
+		if err != nil {
+			return err
+		}
+		m.taps[s.tap] = t
+	}
+	if len(m.config.Mirrorsink.Tap) > 0 {
+		t, err := newMirrorTap(m.config.Mirrorsink.Tap)
+		if err != nil {
+			return err
+		}
+		m.sink = t
+	}
+	return nil
+}
+
+// Stop the mirroring, closing the mirror TAP devices
+func (m *Mirror) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for name, t := range m.taps {
+		t.close()
+		delete(m.taps, name)
+	}
+	if m.sink != nil {
+		m.sink.close()
+		m.sink = nil
+	}
+}
+
+// Return `true` if there are mirroring sessions
+func (m *Mirror) Active() bool {
+	return len(m.sessions) > 0
+}
+
+// Mirror a frame from a node to other node (empty when flooded)
+func (m *Mirror) Mirror(from string, to string, pkt *EthernetPacket) {
+	if !m.Active() {
+		return
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var frame []byte
+	for _, s := range m.sessions {
+		if !s.matches(from, to, pkt) {
+			continue
+		}
+		if frame == nil {
+			var err error
+			if frame, err = pkt.Bytes(); err != nil {
+				log.Debug("Could not serialize packet for mirroring: %s", err)
+				return
+			}
+		}
+
+		sent := false
+		if t, found := m.taps[s.tap]; found {
+			sent = t.write(frame)
+		} else if len(s.remote) > 0 && s.remote != m.nm.localName {
+			sent = m.nm.sendMirrored(s.remote, &MirroredPacket{From: m.nm.localName, Session: s.name, Frame: frame})
+		}
+		if sent {
+			atomic.AddUint64(&s.mirrored, 1)
+		} else {
+			atomic.AddUint64(&s.dropped, 1)
+			metrics.Inc("mirror.dropped")
+		}
+	}
+}
+
+// Write a frame mirrored by other node to the mirror sink device
+func (m *Mirror) Receive(mp *MirroredPacket) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.sink == nil {
+		log.Debug("Dropping frame mirrored by %s: no mirror sink", mp.From)
+		return
+	}
+	if !m.sink.write(mp.Frame) {
+		metrics.Inc("mirror.dropped")
+	}
+}
+
+// Get the information about the mirroring sessions
+func (m *Mirror) Sessions() []MirrorInfo {
+	res := make([]MirrorInfo, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		res = append(res, MirrorInfo{
+			Name:     s.name,
+			Tap:      s.tap,
+			Remote:   s.remote,
+			Mirrored: atomic.LoadUint64(&s.mirrored),
+			Dropped:  atomic.LoadUint64(&s.dropped),
+		})
+	}
+	return res
+}
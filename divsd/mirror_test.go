@@ -0,0 +1,64 @@
+package divsd
+
+import (
+	"testing"
+)
+
+func TestMirrorSession(t *testing.T) {
+	pkt := newTestPacket() // from 02:00:00:00:00:01 to 02:00:00:00:00:02
+	tagged, _ := newTestPacket().Tag(10)
+
+	for _, test := range []struct {
+		config   mirrorConfig
+		from, to string
+		expected bool
+	}{
+		{mirrorConfig{Mac: []string{"02:00:00:00:00:02"}}, "local", "node1", true},
+		{mirrorConfig{Mac: []string{"02:00:00:00:00:03"}}, "local", "node1", false},
+		{mirrorConfig{Vlan: []string{"10-20"}}, "local", "node1", false},
+		{mirrorConfig{Node: []string{"node1"}}, "local", "node1", true},
+		{mirrorConfig{Node: []string{"node1"}}, "node1", "local", true},
+		{mirrorConfig{Node: []string{"node1"}}, "node2", "local", false},
+		{mirrorConfig{Node: []string{"node1"}}, "local", "", true}, // flooded
+	} {
+		s, err := newMirrorSession("test", &test.config)
+		if err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+		if s.matches(test.from, test.to, pkt) != test.expected {
+			t.Errorf("%+v (%s -> %s): expected %t", test.config, test.from, test.to, test.expected)
+		}
+	}
+
+	s, _ := newMirrorSession("test", &mirrorConfig{Vlan: []string{"10-20"}})
+	if !s.matches("local", "node1", tagged) {
+		t.Errorf("frame in VLAN 10 not mirrored")
+	}
+}
+
+func TestConfigMirror(t *testing.T) {
+	c := NewConfig()
+	c.Mirror = map[string]*mirrorConfig{
+		"ids": {Vlan: []string{"10"}, Remote: "node1"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	c.Mirror["bad"] = &mirrorConfig{Mac: []string{"02:00"}, Tap: "mirror0", Remote: "node1"}
+	c.Mirror["empty"] = &mirrorConfig{Tap: "mirror0"}
+	errs, ok := c.Validate().(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for i, key := range []string{"mirror.bad.mac", "mirror.bad", "mirror.empty"} {
+		if errs[i].Key != key {
+			t.Errorf("expected error in %s, got %s", key, errs[i])
+		}
+	}
+
+	c.Switch = map[string]*switchConfig{"tenant1": {Port: 7950}}
+	if sc := c.SwitchConfig("tenant1"); sc.Mirror != nil {
+		t.Errorf("mirroring sessions in other switches")
+	}
+}
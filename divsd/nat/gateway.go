@@ -0,0 +1,33 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// could not find the default gateway
+var ERR_NO_DEFAULT_GATEWAY = fmt.Errorf("Could not find the default gateway")
+
+// the gateway used for NAT-PMP and PCP
+var gateway struct {
+	ip    net.IP
+	mutex sync.Mutex
+}
+
+// Set the gateway used for NAT-PMP and PCP (nil for using the default gateway)
+func SetGateway(ip net.IP) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.ip = ip
+}
+
+// get the gateway used for NAT-PMP and PCP
+func getGateway() (net.IP, error) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	if gateway.ip != nil {
+		return gateway.ip, nil
+	}
+	return systemGateway()
+}
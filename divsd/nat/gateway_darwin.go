@@ -0,0 +1,24 @@
+package nat
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// get the default gateway with the route command
+func systemGateway() (net.IP, error) {
+	out, err := exec.Command("/sbin/route", "-n", "get", "default").Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "gateway:" {
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, ERR_NO_DEFAULT_GATEWAY
+}
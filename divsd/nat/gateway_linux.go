@@ -0,0 +1,40 @@
+package nat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+)
+
+// get the default gateway from the kernel routing table
+func systemGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcRoute(bufio.NewScanner(f))
+}
+
+// parse the routing table in /proc/net/route, looking for the default route
+func parseProcRoute(scanner *bufio.Scanner) (net.IP, error) {
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+		// addresses are in host byte order (little endian)
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+		return ip, nil
+	}
+	return nil, ERR_NO_DEFAULT_GATEWAY
+}
@@ -0,0 +1,22 @@
+package nat
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+const procRoute = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	0	00000000	0	0	0
+`
+
+func TestParseProcRoute(t *testing.T) {
+	ip, err := parseProcRoute(bufio.NewScanner(strings.NewReader(procRoute)))
+	if err != nil {
+		t.Fatalf("Could not parse the routing table: %s", err)
+	}
+	if ip.String() != "192.168.0.1" {
+		t.Fatalf("Unexpected gateway %s", ip)
+	}
+}
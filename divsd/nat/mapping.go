@@ -0,0 +1,208 @@
+package nat
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// lifetime requested for port mappings
+const MAPPING_LIFETIME = 1 * time.Hour
+
+// interval for checking if some mappings must be renewed
+const MAPPING_CHECK_INTERVAL = 1 * time.Minute
+
+// no NAT gateway where we could create a port mapping
+var ERR_NO_GATEWAY = fmt.Errorf("No NAT gateway found for port mappings")
+
+// Something that can create port mappings in a NAT gateway
+type portMapper interface {
+	// Map an internal port to an external port (or to any port if 0), returning
+	// the external IP and port obtained, and the lifetime granted by the gateway
+	// (0 for permanent mappings)
+	addMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error)
+
+	// Remove a port mapping
+	deleteMapping(protocol string, internalPort int, externalPort int) error
+
+	String() string
+}
+
+// A port mapping in a NAT gateway
+type Mapping struct {
+	Protocol     string
+	InternalPort int
+	ExternalIP   net.IP
+	ExternalPort int
+	Lifetime     time.Duration // granted by the gateway (0 for permanent mappings)
+	Renewed      time.Time
+
+	mapper portMapper
+}
+
+func (m Mapping) String() string {
+	return fmt.Sprintf("%s %d -> %s:%d (%s)", m.Protocol, m.InternalPort, m.ExternalIP, m.ExternalPort, m.mapper)
+}
+
+// check if the mapping must be renewed: we renew at half the lifetime
+func (m *Mapping) needsRenewal(now time.Time) bool {
+	return m.Lifetime > 0 && now.Sub(m.Renewed) >= m.Lifetime/2
+}
+
+// renew the mapping, keeping the same external port
+func (m *Mapping) renew(now time.Time) error {
+	ip, port, lifetime, err := m.mapper.addMapping(m.Protocol, m.InternalPort, m.ExternalPort, MAPPING_LIFETIME)
+	if err != nil {
+		return err
+	}
+	if port != m.ExternalPort || !ip.Equal(m.ExternalIP) {
+		log.Warning("Mapping %s has changed to %s:%d", m, ip, port)
+	}
+	m.ExternalIP, m.ExternalPort, m.Lifetime, m.Renewed = ip, port, lifetime, now
+	return nil
+}
+
+// the port mappings we have created, renewed by a worker
+var mappings struct {
+	list     []*Mapping
+	stopChan chan struct{}
+	mutex    sync.Mutex
+}
+
+// Create a port mapping with a mapper, and keep it renewed until
+// RemoveMappings() is called. Mapping again the same port replaces the
+// previous mapping.
+func addMapping(mapper portMapper, protocol string, port int) (*Mapping, error) {
+	ip, extPort, lifetime, err := mapper.addMapping(protocol, port, port, MAPPING_LIFETIME)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapping{
+		Protocol:     protocol,
+		InternalPort: port,
+		ExternalIP:   ip,
+		ExternalPort: extPort,
+		Lifetime:     lifetime,
+		Renewed:      time.Now(),
+		mapper:       mapper,
+	}
+	log.Info("Port mapping created: %s", m)
+
+	mappings.mutex.Lock()
+	defer mappings.mutex.Unlock()
+	for i, prev := range mappings.list {
+		if prev.mapper.String() == mapper.String() && prev.Protocol == protocol && prev.InternalPort == port {
+			mappings.list[i] = m
+			return m, nil
+		}
+	}
+	mappings.list = append(mappings.list, m)
+	if mappings.stopChan == nil {
+		mappings.stopChan = make(chan struct{})
+		go mappingsWorker(mappings.stopChan)
+	}
+	return m, nil
+}
+
+// map a port for both UDP and TCP (as memberlist uses both protocols in the
+// same port), returning the external IP and port
+func mapExternal(mapper portMapper, port int) (net.IP, int, error) {
+	udp, err := addMapping(mapper, "udp", port)
+	if err != nil {
+		log.Warning("Could not map UDP port %d with %s: %s", port, mapper, err)
+		return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_NAT
+	}
+	if _, err := addMapping(mapper, "tcp", port); err != nil {
+		log.Warning("Could not map TCP port %d with %s: %s", port, mapper, err)
+	}
+	return udp.ExternalIP, udp.ExternalPort, nil
+}
+
+// Get the port mappings currently active
+func Mappings() []Mapping {
+	mappings.mutex.Lock()
+	defer mappings.mutex.Unlock()
+	res := make([]Mapping, 0, len(mappings.list))
+	for _, m := range mappings.list {
+		res = append(res, *m)
+	}
+	return res
+}
+
+// Get the port mapping we have created for an internal port, if any
+func MappingFor(protocol string, port int) (Mapping, bool) {
+	mappings.mutex.Lock()
+	defer mappings.mutex.Unlock()
+	for _, m := range mappings.list {
+		if m.Protocol == protocol && m.InternalPort == port {
+			return *m, true
+		}
+	}
+	return Mapping{}, false
+}
+
+// Remove all the port mappings we have created
+func RemoveMappings() {
+	mappings.mutex.Lock()
+	defer mappings.mutex.Unlock()
+
+	if mappings.stopChan != nil {
+		close(mappings.stopChan)
+		mappings.stopChan = nil
+	}
+	for _, m := range mappings.list {
+		log.Info("Removing port mapping %s", m)
+		if err := m.mapper.deleteMapping(m.Protocol, m.InternalPort, m.ExternalPort); err != nil {
+			log.Warning("Could not remove port mapping %s: %s", m, err)
+		}
+	}
+	mappings.list = nil
+}
+
+// Remove the port mappings we have created for an internal port
+func RemovePortMappings(port int) {
+	mappings.mutex.Lock()
+	defer mappings.mutex.Unlock()
+
+	kept := []*Mapping{}
+	for _, m := range mappings.list {
+		if m.InternalPort != port {
+			kept = append(kept, m)
+			continue
+		}
+		log.Info("Removing port mapping %s", m)
+		if err := m.mapper.deleteMapping(m.Protocol, m.InternalPort, m.ExternalPort); err != nil {
+			log.Warning("Could not remove port mapping %s: %s", m, err)
+		}
+	}
+	mappings.list = kept
+}
+
+// renew the mappings that are about to expire
+func renewMappings(now time.Time) {
+	mappings.mutex.Lock()
+	defer mappings.mutex.Unlock()
+	for _, m := range mappings.list {
+		if m.needsRenewal(now) {
+			log.Debug("Renewing port mapping %s", m)
+			if err := m.renew(now); err != nil {
+				log.Warning("Could not renew port mapping %s: %s", m, err)
+			}
+		}
+	}
+}
+
+// the worker that keeps the mappings alive
+func mappingsWorker(stopChan chan struct{}) {
+	ticker := time.NewTicker(MAPPING_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			renewMappings(now)
+		case <-stopChan:
+			return
+		}
+	}
+}
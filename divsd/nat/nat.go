@@ -1,15 +1,17 @@
 // The NAT package is responsible for
-// * obtaining a pair of public IP and port that can be announced to external
-//   nodes and can be used for sending traffic to this node.
-// * keep that NAT traversal mechanism active, either by sending keepalives or
-//   by notifying the corresponding service about our interest in keeping it active.
+//   - obtaining a pair of public IP and port that can be announced to external
+//     nodes and can be used for sending traffic to this node.
+//   - keep that NAT traversal mechanism active, either by sending keepalives or
+//     by notifying the corresponding service about our interest in keeping it active.
 package nat
 
 import (
-	logging "github.com/op/go-logging"
+	"errors"
+	"fmt"
 	"net"
 	"strconv"
-	"errors"
+
+	logging "github.com/op/go-logging"
 )
 
 const LOG_MODULE = "divs"
@@ -21,12 +23,52 @@ var ERR_COULD_NOT_OBTAIN_NAT = errors.New("Could not obtain a valid IP/port")
 
 type resolversFunc func(net.IP, int) (net.IP, int, error)
 
+// default order of the NAT traversal mechanisms
+var DEFAULT_RESOLVERS = []string{"upnp", "pcp", "natpmp", "stun"}
+
+// all the NAT traversal mechanisms available, by name
+var resolversByName = map[string]resolversFunc{
+	"upnp":   GetUpnp,
+	"pcp":    GetPcp,
+	"natpmp": GetNatPmp,
+	"stun":   GetStun,
+}
+
 var resolvers = []resolversFunc{
 	GetUpnp,
+	GetPcp,
+	GetNatPmp,
 	GetStun,
 }
 
+// Check if a name is a valid NAT traversal mechanism
+func IsResolver(name string) bool {
+	_, found := resolversByName[name]
+	return found
+}
+
+// Set the NAT traversal mechanisms used (and the order) for obtaining the
+// external address
+func SetResolvers(names []string) error {
+	res := []resolversFunc{}
+	for _, name := range names {
+		resolver, found := resolversByName[name]
+		if !found {
+			return fmt.Errorf("Unknown NAT traversal mechanism '%s'", name)
+		}
+		res = append(res, resolver)
+	}
+	resolvers = res
+	return nil
+}
+
 func getExternalAddr(defaultIp net.IP, defaultPort int) (net.IP, int, error) {
+	if IsGlobalIPv6(defaultIp) {
+		log.Debug("Using global IPv6 address %s: no NAT traversal needed", defaultIp)
+		setDetectedType(NAT_TYPE_NONE)
+		return defaultIp, defaultPort, nil
+	}
+
 	for _, resolver := range resolvers {
 		if ip, port, err := resolver(defaultIp, defaultPort); err == nil {
 			return ip, port, nil
@@ -54,7 +96,7 @@ func NewExternalTCPAddr(addr string) (net.TCPAddr, error) {
 		return net.TCPAddr{}, err
 	}
 	portI, _ := strconv.Atoi(port)
-	tcpAddr := net.TCPAddr{net.ParseIP(host), portI, ""}
+	tcpAddr := net.TCPAddr{IP: net.ParseIP(host), Port: portI}
 	return NewExternalTCP(tcpAddr)
 }
 
@@ -75,7 +117,7 @@ func NewExternalUDPAddr(addr string) (net.UDPAddr, error) {
 		return net.UDPAddr{}, err
 	}
 	portI, _ := strconv.Atoi(port)
-	udpAddr := net.UDPAddr{net.ParseIP(host), portI, ""}
+	udpAddr := net.UDPAddr{IP: net.ParseIP(host), Port: portI}
 	return NewExternalUDP(udpAddr)
 }
 
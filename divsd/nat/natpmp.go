@@ -0,0 +1,148 @@
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// port where NAT-PMP and PCP gateways listen
+const PMP_PORT = 5351
+
+// initial timeout for NAT-PMP and PCP requests (doubled on every retry)
+const PMP_INITIAL_TIMEOUT = 250 * time.Millisecond
+
+// number of NAT-PMP and PCP requests sent before giving up
+const PMP_MAX_TRIES = 4
+
+const (
+	NATPMP_VERSION         = 0
+	NATPMP_OP_EXTERNAL     = 0
+	NATPMP_OP_MAP_UDP      = 1
+	NATPMP_OP_MAP_TCP      = 2
+	NATPMP_OP_RESPONSE     = 128
+	NATPMP_RESULT_SUCCESS  = 0
+	NATPMP_EXTERNAL_LENGTH = 12
+	NATPMP_MAP_LENGTH      = 16
+)
+
+// the gateway did not reply to a NAT-PMP or PCP request
+var ERR_PMP_TIMEOUT = fmt.Errorf("No response from the gateway")
+
+// invalid response from a NAT-PMP or PCP gateway
+var ERR_PMP_INVALID_RESPONSE = fmt.Errorf("Invalid response from the gateway")
+
+// send a request to a NAT-PMP/PCP gateway, retrying with exponential backoff,
+// until a response is accepted by the check function
+func pmpRequest(gateway *net.UDPAddr, req []byte, check func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1100)
+	timeout := PMP_INITIAL_TIMEOUT
+	for i := 0; i < PMP_MAX_TRIES; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break // timeout: retry
+			}
+			if check(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, ERR_PMP_TIMEOUT
+}
+
+// A port mapper for a NAT-PMP gateway (RFC 6886)
+type natPmpMapper struct {
+	gateway *net.UDPAddr
+}
+
+func newNatPmpMapper(gateway *net.UDPAddr) *natPmpMapper {
+	return &natPmpMapper{gateway: gateway}
+}
+
+func (m *natPmpMapper) String() string {
+	return fmt.Sprintf("NAT-PMP at %s", m.gateway)
+}
+
+func (m *natPmpMapper) request(req []byte, length int) ([]byte, error) {
+	op := req[1]
+	resp, err := pmpRequest(m.gateway, req, func(resp []byte) bool {
+		return len(resp) >= length && resp[0] == NATPMP_VERSION && resp[1] == NATPMP_OP_RESPONSE+op
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result := binary.BigEndian.Uint16(resp[2:4]); result != NATPMP_RESULT_SUCCESS {
+		return nil, fmt.Errorf("NAT-PMP error %d from %s", result, m.gateway)
+	}
+	return resp, nil
+}
+
+func (m *natPmpMapper) externalIP() (net.IP, error) {
+	resp, err := m.request([]byte{NATPMP_VERSION, NATPMP_OP_EXTERNAL}, NATPMP_EXTERNAL_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (m *natPmpMapper) mapPort(protocol string, internalPort int, externalPort int, lifetime time.Duration) ([]byte, error) {
+	op := byte(NATPMP_OP_MAP_UDP)
+	if protocol == "tcp" {
+		op = NATPMP_OP_MAP_TCP
+	}
+	req := make([]byte, 12)
+	req[0] = NATPMP_VERSION
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	return m.request(req, NATPMP_MAP_LENGTH)
+}
+
+func (m *natPmpMapper) addMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+	resp, err := m.mapPort(protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	ip, err := m.externalIP()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return ip, int(binary.BigEndian.Uint16(resp[10:12])), granted, nil
+}
+
+func (m *natPmpMapper) deleteMapping(protocol string, internalPort int, externalPort int) error {
+	_, err := m.mapPort(protocol, internalPort, 0, 0)
+	return err
+}
+
+// get an external IP and port with NAT-PMP
+func GetNatPmp(defaultIp net.IP, defaultPort int) (net.IP, int, error) {
+	log.Debug("Using NAT-PMP for getting external IP/port")
+	gateway, err := getGateway()
+	if err != nil {
+		return net.IP{}, 0, err
+	}
+	if gateway.To4() == nil {
+		return net.IP{}, 0, fmt.Errorf("NAT-PMP does not support IPv6 gateways")
+	}
+	return mapExternal(newNatPmpMapper(&net.UDPAddr{IP: gateway, Port: PMP_PORT}), defaultPort)
+}
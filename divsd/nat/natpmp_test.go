@@ -0,0 +1,148 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a fake NAT-PMP and PCP gateway, recording the mappings lifetimes
+type fakePmpGateway struct {
+	conn        *net.UDPConn
+	mappings    map[uint16]uint32 // internal port -> lifetime
+	maxLifetime uint32            // maximum lifetime granted (0 for any)
+	suggested   net.IP            // external address suggested in the last PCP request
+	mutex       sync.Mutex
+}
+
+// get the lifetime granted for a requested lifetime
+func (gw *fakePmpGateway) grant(requested uint32) uint32 {
+	if gw.maxLifetime > 0 && requested > gw.maxLifetime {
+		return gw.maxLifetime
+	}
+	return requested
+}
+
+func newFakePmpGateway(t *testing.T) *fakePmpGateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	gw := &fakePmpGateway{conn: conn, mappings: make(map[uint16]uint32)}
+	go gw.serve()
+	return gw
+}
+
+func (gw *fakePmpGateway) addr() *net.UDPAddr {
+	return gw.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (gw *fakePmpGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := gw.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		var resp []byte
+		gw.mutex.Lock()
+		switch {
+		case req[0] == NATPMP_VERSION && req[1] == NATPMP_OP_EXTERNAL:
+			resp = make([]byte, NATPMP_EXTERNAL_LENGTH)
+			resp[1] = NATPMP_OP_RESPONSE
+			copy(resp[8:12], net.IPv4(203, 0, 113, 7).To4())
+		case req[0] == NATPMP_VERSION:
+			granted := gw.grant(binary.BigEndian.Uint32(req[8:12]))
+			resp = make([]byte, NATPMP_MAP_LENGTH)
+			resp[1] = NATPMP_OP_RESPONSE + req[1]
+			copy(resp[8:12], req[4:6])
+			copy(resp[10:12], req[6:8])
+			binary.BigEndian.PutUint32(resp[12:16], granted)
+			gw.mappings[binary.BigEndian.Uint16(req[4:6])] = granted
+		case req[0] == PCP_VERSION && len(req) == PCP_MAP_LENGTH:
+			granted := gw.grant(binary.BigEndian.Uint32(req[4:8]))
+			gw.suggested = net.IP(append([]byte{}, req[44:60]...))
+			resp = make([]byte, PCP_MAP_LENGTH)
+			copy(resp, req)
+			resp[1] = PCP_OP_RESPONSE | PCP_OP_MAP
+			binary.BigEndian.PutUint32(resp[4:8], granted)
+			copy(resp[44:60], net.IPv4(203, 0, 113, 7).To16())
+			gw.mappings[binary.BigEndian.Uint16(req[40:42])] = granted
+		}
+		gw.mutex.Unlock()
+		if resp != nil {
+			gw.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (gw *fakePmpGateway) lifetime(port uint16) uint32 {
+	gw.mutex.Lock()
+	defer gw.mutex.Unlock()
+	return gw.mappings[port]
+}
+
+func testMapper(t *testing.T, gw *fakePmpGateway, mapper portMapper) {
+	ip, port, granted, err := mapper.addMapping("udp", 7946, 7946, time.Hour)
+	if err != nil {
+		t.Fatalf("Could not add mapping with %s: %s", mapper, err)
+	}
+	if ip.String() != "203.0.113.7" || port != 7946 {
+		t.Fatalf("Unexpected external address %s:%d", ip, port)
+	}
+	if lifetime := gw.lifetime(7946); lifetime != 3600 || granted != time.Hour {
+		t.Fatalf("Unexpected lifetime %d (granted %s)", lifetime, granted)
+	}
+
+	if err := mapper.deleteMapping("udp", 7946, port); err != nil {
+		t.Fatalf("Could not delete mapping with %s: %s", mapper, err)
+	}
+	if lifetime := gw.lifetime(7946); lifetime != 0 {
+		t.Fatalf("Mapping not deleted")
+	}
+
+	// the mapping is renewed before the lifetime granted expires, when it is
+	// shorter than the one requested
+	gw.mutex.Lock()
+	gw.maxLifetime = 600
+	gw.mutex.Unlock()
+	m, err := addMapping(mapper, "udp", 7947)
+	if err != nil {
+		t.Fatalf("Could not add mapping with %s: %s", mapper, err)
+	}
+	defer RemoveMappings()
+	if m.Lifetime != 10*time.Minute {
+		t.Fatalf("Unexpected lifetime recorded: %s", m.Lifetime)
+	}
+	if !m.needsRenewal(m.Renewed.Add(5 * time.Minute)) {
+		t.Fatalf("Mapping not renewed at half the lifetime granted")
+	}
+}
+
+func TestNatPmpMapper(t *testing.T) {
+	gw := newFakePmpGateway(t)
+	defer gw.conn.Close()
+
+	testMapper(t, gw, newNatPmpMapper(gw.addr()))
+}
+
+func TestPcpMapper(t *testing.T) {
+	gw := newFakePmpGateway(t)
+	defer gw.conn.Close()
+
+	mapper, err := newPcpMapper(gw.addr())
+	if err != nil {
+		t.Fatalf("Could not create the PCP mapper: %s", err)
+	}
+	testMapper(t, gw, mapper)
+
+	// we are an IPv4 client: no suggested external address is ::ffff:0.0.0.0
+	gw.mutex.Lock()
+	defer gw.mutex.Unlock()
+	if !gw.suggested.Equal(net.IPv4zero) {
+		t.Fatalf("Unexpected suggested external address %s", gw.suggested)
+	}
+}
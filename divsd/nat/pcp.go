@@ -0,0 +1,164 @@
+package nat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	PCP_VERSION        = 2
+	PCP_OP_MAP         = 1
+	PCP_OP_RESPONSE    = 0x80
+	PCP_RESULT_SUCCESS = 0
+	PCP_MAP_LENGTH     = 60
+	PCP_PROTOCOL_UDP   = 17
+	PCP_PROTOCOL_TCP   = 6
+	PCP_NONCE_LENGTH   = 12
+)
+
+// A port mapper for a PCP gateway (RFC 6887)
+type pcpMapper struct {
+	gateway  *net.UDPAddr
+	clientIP net.IP                            // our IP in the network of the gateway
+	nonces   map[string][PCP_NONCE_LENGTH]byte // the nonce used for each mapping
+	mutex    sync.Mutex
+}
+
+func newPcpMapper(gateway *net.UDPAddr) (*pcpMapper, error) {
+	conn, err := net.DialUDP("udp", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return &pcpMapper{
+		gateway:  gateway,
+		clientIP: conn.LocalAddr().(*net.UDPAddr).IP,
+		nonces:   make(map[string][PCP_NONCE_LENGTH]byte),
+	}, nil
+}
+
+func (m *pcpMapper) String() string {
+	return fmt.Sprintf("PCP at %s", m.gateway)
+}
+
+// get the nonce for a mapping: renewals and deletions must use the same
+// nonce used when the mapping was created
+func (m *pcpMapper) nonce(protocol string, internalPort int) [PCP_NONCE_LENGTH]byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := fmt.Sprintf("%s:%d", protocol, internalPort)
+	nonce, found := m.nonces[key]
+	if !found {
+		rand.Read(nonce[:])
+		m.nonces[key] = nonce
+	}
+	return nonce
+}
+
+// send a MAP request, returning the external IP and port assigned, and the
+// lifetime granted
+func (m *pcpMapper) mapPort(protocol string, internalPort int, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	proto := byte(PCP_PROTOCOL_UDP)
+	if protocol == "tcp" {
+		proto = PCP_PROTOCOL_TCP
+	}
+	nonce := m.nonce(protocol, internalPort)
+
+	req := make([]byte, PCP_MAP_LENGTH)
+	req[0] = PCP_VERSION
+	req[1] = PCP_OP_MAP
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], m.clientIP.To16())
+	copy(req[24:36], nonce[:])
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:42], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:44], uint16(externalPort))
+	// no suggested external address: the all-zeros address of our family
+	// (::ffff:0.0.0.0 for IPv4, see RFC 6887 section 11.1)
+	if m.clientIP.To4() != nil {
+		copy(req[44:60], net.IPv4zero.To16())
+	} else {
+		copy(req[44:60], net.IPv6zero)
+	}
+
+	resp, err := pmpRequest(m.gateway, req, func(resp []byte) bool {
+		return len(resp) >= PCP_MAP_LENGTH &&
+			resp[0] == PCP_VERSION &&
+			resp[1] == PCP_OP_RESPONSE|PCP_OP_MAP &&
+			string(resp[24:36]) == string(nonce[:])
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if result := resp[3]; result != PCP_RESULT_SUCCESS {
+		return nil, 0, 0, fmt.Errorf("PCP error %d from %s", result, m.gateway)
+	}
+
+	ip := net.IP(append([]byte{}, resp[44:60]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	return ip, int(binary.BigEndian.Uint16(resp[42:44])), granted, nil
+}
+
+func (m *pcpMapper) addMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+	return m.mapPort(protocol, internalPort, externalPort, lifetime)
+}
+
+func (m *pcpMapper) deleteMapping(protocol string, internalPort int, externalPort int) error {
+	_, _, _, err := m.mapPort(protocol, internalPort, 0, 0)
+
+	m.mutex.Lock()
+	delete(m.nonces, fmt.Sprintf("%s:%d", protocol, internalPort))
+	m.mutex.Unlock()
+	return err
+}
+
+// get an external IP and port with PCP
+func GetPcp(defaultIp net.IP, defaultPort int) (net.IP, int, error) {
+	log.Debug("Using PCP for getting external IP/port")
+	gateway, err := getGateway()
+	if err != nil {
+		return net.IP{}, 0, err
+	}
+	mapper, err := getPcpMapper(&net.UDPAddr{IP: gateway, Port: PMP_PORT})
+	if err != nil {
+		return net.IP{}, 0, err
+	}
+	return mapExternal(mapper, defaultPort)
+}
+
+// the PCP mappers, by gateway (we must keep them, as they hold the nonces
+// needed for renewing the mappings)
+var pcpMappers struct {
+	mappers map[string]*pcpMapper
+	mutex   sync.Mutex
+}
+
+// get the PCP mapper for a gateway
+func getPcpMapper(gateway *net.UDPAddr) (*pcpMapper, error) {
+	pcpMappers.mutex.Lock()
+	defer pcpMappers.mutex.Unlock()
+	if mapper, found := pcpMappers.mappers[gateway.String()]; found {
+		return mapper, nil
+	}
+	mapper, err := newPcpMapper(gateway)
+	if err != nil {
+		return nil, err
+	}
+	if pcpMappers.mappers == nil {
+		pcpMappers.mappers = make(map[string]*pcpMapper)
+	}
+	pcpMappers.mappers[gateway.String()] = mapper
+	return mapper, nil
+}
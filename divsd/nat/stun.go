@@ -2,31 +2,69 @@ package nat
 
 import (
 	"fmt"
-	"github.com/ccding/go-stun/stun"
 	"net"
 	"strconv"
+	"sync"
+
+	"github.com/ccding/go-stun/stun"
 )
 
 // could not obtain a NAT mapping with STUN
 var ERR_COULD_NOT_OBTAIN_STUN = fmt.Errorf("Could not obtain a valid IP/port with STUN")
 
-// default STUN server:port
-const STUN_SERVICE_ADDRESS = "stun.ekiga.net:3478"
+// default STUN servers (as host:port), in the order they are tried
+var DEFAULT_STUN_SERVERS = []string{
+	"stun.ekiga.net:3478",
+	"stun.l.google.com:19302",
+	"stun.stunprotocol.org:3478",
+}
+
+// the STUN servers used
+var stunServers struct {
+	servers []string
+	mutex   sync.Mutex
+}
+
+// Set the STUN servers (as host:port), in the order they must be tried. An
+// empty list means the default servers.
+func SetStunServers(servers []string) {
+	stunServers.mutex.Lock()
+	defer stunServers.mutex.Unlock()
+	stunServers.servers = servers
+}
+
+func getStunServers() []string {
+	stunServers.mutex.Lock()
+	defer stunServers.mutex.Unlock()
+	if len(stunServers.servers) == 0 {
+		return DEFAULT_STUN_SERVERS
+	}
+	return stunServers.servers
+}
 
-// try to obtain an external IP address and (optionally) port
+// try to obtain an external IP address and (optionally) port, trying all the
+// STUN servers until one of them replies
 func GetStun(defaultIp net.IP, defaultPort int) (net.IP, int, error) {
-	var stunHost *stun.Host
-	var nat int
+	for _, server := range getStunServers() {
+		ip, port, err := getStunFrom(server)
+		if err == nil {
+			return ip, port, nil
+		}
+		log.Debug("Could not obtain external IP from STUN server %s", server)
+	}
+	return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_STUN
+}
 
-	log.Debug("Using STUN for getting external IP from %s...\n",
-		STUN_SERVICE_ADDRESS)
-	sAddr, sPort, err := net.SplitHostPort(STUN_SERVICE_ADDRESS)
+// obtain the external IP address and port from a STUN server
+func getStunFrom(server string) (net.IP, int, error) {
+	log.Debug("Using STUN for getting external IP from %s...", server)
+	sAddr, sPort, err := net.SplitHostPort(server)
 	if err != nil {
 		return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_STUN
 	}
 	sPortI, _ := strconv.Atoi(sPort)
 	stun.SetServerHost(sAddr, sPortI)
-	nat, stunHost, err = stun.Discover()
+	nat, stunHost, err := stun.Discover()
 	if err != nil {
 		return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_STUN
 	}
@@ -34,29 +72,31 @@ func GetStun(defaultIp net.IP, defaultPort int) (net.IP, int, error) {
 		return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_STUN
 	}
 
-	var t string
+	natType := stunNatType(nat)
+	setDetectedType(natType)
+
+	log.Debug("STUN result: external IP:port: %s (NAT type: %s)",
+		stunHost.TransportAddr(), natType)
+	return net.ParseIP(stunHost.Ip()), int(stunHost.Port()), nil
+}
+
+// translate the NAT type returned by the STUN library
+func stunNatType(nat int) NatType {
 	switch nat {
-	case stun.NAT_ERROR:
-		t = "test failed"
-	case stun.NAT_UNKNOWN:
-		t = "unexpected response from the STUN server"
-	case stun.NAT_BLOCKED:
-		t = "UDP is blocked"
+	case stun.NAT_NONE:
+		return NAT_TYPE_NONE
 	case stun.NAT_FULL:
-		t = "Full cone"
-	case stun.NAT_SYMETRIC:
-		t = "symetric"
+		return NAT_TYPE_FULL_CONE
 	case stun.NAT_RESTRICTED:
-		t = "restricted"
+		return NAT_TYPE_RESTRICTED
 	case stun.NAT_PORT_RESTRICTED:
-		t = "port restricted"
-	case stun.NAT_NONE:
-		t = "not behind a"
+		return NAT_TYPE_PORT_RESTRICTED
+	case stun.NAT_SYMETRIC:
+		return NAT_TYPE_SYMMETRIC
 	case stun.NAT_SYMETRIC_UDP_FIREWALL:
-		t = "symetric UDP firewall"
+		return NAT_TYPE_SYMMETRIC_UDP_FIREWALL
+	case stun.NAT_BLOCKED:
+		return NAT_TYPE_BLOCKED
 	}
-
-	log.Debug("STUN result: external IP:port: %s (NAT type: %s)",
-		stunHost.TransportAddr(), t)
-	return net.ParseIP(stunHost.Ip()), int(stunHost.Port()), nil
+	return NAT_TYPE_UNKNOWN
 }
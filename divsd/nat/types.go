@@ -0,0 +1,80 @@
+package nat
+
+import (
+	"net"
+	"sync"
+)
+
+// The type of NAT we are behind
+type NatType int
+
+const (
+	NAT_TYPE_UNKNOWN NatType = iota
+	NAT_TYPE_NONE
+	NAT_TYPE_FULL_CONE
+	NAT_TYPE_RESTRICTED
+	NAT_TYPE_PORT_RESTRICTED
+	NAT_TYPE_SYMMETRIC
+	NAT_TYPE_SYMMETRIC_UDP_FIREWALL
+	NAT_TYPE_BLOCKED
+)
+
+var natTypeNames = map[NatType]string{
+	NAT_TYPE_UNKNOWN:                "unknown",
+	NAT_TYPE_NONE:                   "none",
+	NAT_TYPE_FULL_CONE:              "full-cone",
+	NAT_TYPE_RESTRICTED:             "restricted",
+	NAT_TYPE_PORT_RESTRICTED:        "port-restricted",
+	NAT_TYPE_SYMMETRIC:              "symmetric",
+	NAT_TYPE_SYMMETRIC_UDP_FIREWALL: "symmetric-udp-firewall",
+	NAT_TYPE_BLOCKED:                "blocked",
+}
+
+func (t NatType) String() string {
+	if name, found := natTypeNames[t]; found {
+		return name
+	}
+	return natTypeNames[NAT_TYPE_UNKNOWN]
+}
+
+// Parse a NAT type name, as returned by String()
+func ParseNatType(name string) NatType {
+	for t, n := range natTypeNames {
+		if n == name {
+			return t
+		}
+	}
+	return NAT_TYPE_UNKNOWN
+}
+
+// Return `true` if other nodes can send traffic to a node behind this type of NAT
+// by using the external address obtained (so it does not need a relay)
+func (t NatType) DirectlyReachable() bool {
+	switch t {
+	case NAT_TYPE_SYMMETRIC, NAT_TYPE_SYMMETRIC_UDP_FIREWALL, NAT_TYPE_BLOCKED:
+		return false
+	}
+	return true
+}
+
+var detectedType = NAT_TYPE_UNKNOWN
+var detectedTypeMutex sync.RWMutex
+
+// Get the type of NAT detected (when obtaining the external address)
+func DetectedType() NatType {
+	detectedTypeMutex.RLock()
+	defer detectedTypeMutex.RUnlock()
+	return detectedType
+}
+
+func setDetectedType(t NatType) {
+	detectedTypeMutex.Lock()
+	defer detectedTypeMutex.Unlock()
+	detectedType = t
+}
+
+// Check if an IP is a global IPv6 address (ie, not link-local nor a unique
+// local address). There is no NAT with these addresses.
+func IsGlobalIPv6(ip net.IP) bool {
+	return ip != nil && ip.To4() == nil && ip.IsGlobalUnicast() && ip[0]&0xfe != 0xfc
+}
@@ -0,0 +1,23 @@
+package nat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsGlobalIPv6(t *testing.T) {
+	for s, expected := range map[string]bool{
+		"2001:db8::1":  true,
+		"fe80::1":      false,
+		"fd00::1":      false,
+		"::1":          false,
+		"::":           false,
+		"192.168.1.1":  false,
+		"203.0.113.7":  false,
+		"2a00:1450::e": true,
+	} {
+		if global := IsGlobalIPv6(net.ParseIP(s)); global != expected {
+			t.Errorf("%s: expected %t, got %t", s, expected, global)
+		}
+	}
+}
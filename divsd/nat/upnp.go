@@ -2,56 +2,185 @@ package nat
 
 import (
 	"fmt"
-	"github.com/huin/goupnp/dcps/internetgateway1"
 	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway1"
 )
 
 var ERR_COULD_NOT_OBTAIN_UPNP = fmt.Errorf("Could not obtain a valid IP/port with UPNP")
 
-// get an external IP and port with UpnP
-func GetUpnp(defaultIp net.IP, defaultPort int) (net.IP, int, error) {
-	log.Debug("Using UPnP for getting external IP/port")
-	clients, errors, err := internetgateway1.NewWANPPPConnection1Clients()
+// description used for our port mappings
+const UPNP_MAPPING_DESCRIPTION = "divs"
+
+// UPnP error returned by gateways that only support permanent leases
+const UPNP_ERR_ONLY_PERMANENT_LEASES = "725"
+
+// A WANIPConnection1 or WANPPPConnection1 client
+type upnpClient interface {
+	GetExternalIPAddress() (string, error)
+	AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16,
+		internalClient string, enabled bool, description string, leaseDuration uint32) error
+	DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error
+}
+
+// A port mapper for a UPnP internet gateway device
+type upnpMapper struct {
+	client  upnpClient
+	name    string
+	localIP net.IP // our IP in the network of the gateway
+}
+
+// Create a mapper for a UPnP client, obtaining the local IP used for
+// reaching the gateway
+func newUpnpMapper(client upnpClient, sc *goupnp.ServiceClient) (*upnpMapper, error) {
+	base := sc.RootDevice.URLBase
+	conn, err := net.Dial("udp", hostWithPort(&base))
 	if err != nil {
-		return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_UPNP
+		return nil, err
 	}
+	defer conn.Close()
+
+	return &upnpMapper{
+		client:  client,
+		name:    fmt.Sprintf("UPnP %s at %s", sc.Service.ServiceType, base.Host),
+		localIP: conn.LocalAddr().(*net.UDPAddr).IP,
+	}, nil
+}
 
-	log.Debug("%d UPnP servers discovered (%d errors)", len(clients), len(errors))
-	for i, e := range errors {
-		log.Error("Error finding server #%d: %v\n", i+1, e)
+func (m *upnpMapper) String() string {
+	return m.name
+}
+
+func (m *upnpMapper) addMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
 	}
-	if len(clients) == 0 {
-		return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_UPNP
+	proto := strings.ToUpper(protocol)
+	err := m.client.AddPortMapping("", uint16(externalPort), proto, uint16(internalPort),
+		m.localIP.String(), true, UPNP_MAPPING_DESCRIPTION, uint32(lifetime/time.Second))
+	if err != nil && lifetime > 0 && strings.Contains(err.Error(), UPNP_ERR_ONLY_PERMANENT_LEASES) {
+		log.Debug("%s only supports permanent leases", m)
+		lifetime = 0
+		err = m.client.AddPortMapping("", uint16(externalPort), proto, uint16(internalPort),
+			m.localIP.String(), true, UPNP_MAPPING_DESCRIPTION, 0)
+	}
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
-	for _, c := range clients {
-		dev := &c.ServiceClient.RootDevice.Device
-		srv := &c.ServiceClient.Service
-
-		log.Debug(dev.FriendlyName, " :: ", srv.String())
-		scpd, err := srv.RequestSCDP()
-		if err != nil {
-			log.Warning("  Error requesting service SCPD: %v\n", err)
-		} else {
-			log.Debug("  Available actions:")
-			for _, action := range scpd.Actions {
-				log.Debug("  * %s\n", action.Name)
-				for _, arg := range action.Arguments {
-					var varDesc string
-					if stateVar := scpd.GetStateVariable(arg.RelatedStateVariable); stateVar != nil {
-						varDesc = fmt.Sprintf(" (%s)", stateVar.DataType.Name)
-					}
-					log.Debug("    * [%s] %s%s\n", arg.Direction, arg.Name, varDesc)
-				}
+	ip, err := m.externalIP()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return ip, externalPort, lifetime, nil
+}
+
+func (m *upnpMapper) deleteMapping(protocol string, internalPort int, externalPort int) error {
+	return m.client.DeletePortMapping("", uint16(externalPort), strings.ToUpper(protocol))
+}
+
+func (m *upnpMapper) externalIP() (net.IP, error) {
+	s, err := m.client.GetExternalIPAddress()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid external IP from %s: %q", m, s)
+	}
+	return ip, nil
+}
+
+// the UPnP gateway found (we only look for it once)
+var upnpGateway struct {
+	mapper *upnpMapper
+	err    error
+	once   sync.Once
+}
+
+// discover the UPnP gateways, looking for WANIPConnection1 and
+// WANPPPConnection1 services
+func discoverUpnp() (*upnpMapper, error) {
+	log.Debug("Discovering UPnP gateways")
+	var mappers []*upnpMapper
+
+	ipClients, errs, err := internetgateway1.NewWANIPConnection1Clients()
+	if err == nil {
+		for _, c := range ipClients {
+			if m, err := newUpnpMapper(c, &c.ServiceClient); err == nil {
+				mappers = append(mappers, m)
 			}
 		}
+	}
+	for i, e := range errs {
+		log.Debug("Error finding WANIPConnection1 server #%d: %v", i+1, e)
+	}
+
+	pppClients, errs, err := internetgateway1.NewWANPPPConnection1Clients()
+	if err == nil {
+		for _, c := range pppClients {
+			if m, err := newUpnpMapper(c, &c.ServiceClient); err == nil {
+				mappers = append(mappers, m)
+			}
+		}
+	}
+	for i, e := range errs {
+		log.Debug("Error finding WANPPPConnection1 server #%d: %v", i+1, e)
+	}
+
+	log.Debug("%d UPnP gateways discovered", len(mappers))
+	for _, m := range mappers {
+		if _, err := m.externalIP(); err == nil {
+			log.Info("Using %s", m)
+			return m, nil
+		}
+	}
+	return nil, ERR_NO_GATEWAY
+}
 
-		if scpd == nil || scpd.GetAction("GetExternalIPAddress") != nil {
-			ip, err := c.GetExternalIPAddress()
-			log.Info("GetExternalIPAddress: ", ip, err)
-			return net.ParseIP(ip), defaultPort, nil
+// get the mapper for the UPnP gateway in our network
+func getUpnpMapper() (*upnpMapper, error) {
+	upnpGateway.once.Do(func() {
+		upnpGateway.mapper, upnpGateway.err = discoverUpnp()
+	})
+	return upnpGateway.mapper, upnpGateway.err
+}
+
+// get a WANIPConnection1 mapper for a gateway at some URL
+func upnpMapperByURL(loc *url.URL) (*upnpMapper, error) {
+	clients, err := internetgateway1.NewWANIPConnection1ClientsByURL(loc)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, ERR_NO_GATEWAY
+	}
+	return newUpnpMapper(clients[0], &clients[0].ServiceClient)
+}
+
+// get the host:port for an URL, using the default port for the scheme
+func hostWithPort(u *url.URL) string {
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
 		}
 	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
 
-	return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_UPNP
+// get an external IP and port with UpnP
+func GetUpnp(defaultIp net.IP, defaultPort int) (net.IP, int, error) {
+	log.Debug("Using UPnP for getting external IP/port")
+	mapper, err := getUpnpMapper()
+	if err != nil {
+		return net.IP{}, 0, ERR_COULD_NOT_OBTAIN_UPNP
+	}
+	return mapExternal(mapper, defaultPort)
 }
@@ -0,0 +1,170 @@
+package nat
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeIgdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <friendlyName>Fake IGD</friendlyName>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+                <controlURL>/ctl</controlURL>
+                <eventSubURL>/evt</eventSubURL>
+                <SCPDURL>/scpd.xml</SCPDURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// a fake internet gateway device, recording the port mappings
+type fakeIgd struct {
+	mappings map[string]string // "PROTO:port" -> lease
+	mutex    sync.Mutex
+}
+
+func (igd *fakeIgd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/desc.xml" {
+		fmt.Fprint(w, fakeIgdDescription)
+		return
+	}
+
+	var env struct {
+		Body struct {
+			Action struct {
+				XMLName       xml.Name
+				ExternalPort  string `xml:"NewExternalPort"`
+				Protocol      string `xml:"NewProtocol"`
+				LeaseDuration string `xml:"NewLeaseDuration"`
+			} `xml:",any"`
+		}
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := env.Body.Action
+	key := action.Protocol + ":" + action.ExternalPort
+
+	igd.mutex.Lock()
+	response := ""
+	switch action.XMLName.Local {
+	case "AddPortMapping":
+		igd.mappings[key] = action.LeaseDuration
+	case "DeletePortMapping":
+		delete(igd.mappings, key)
+	case "GetExternalIPAddress":
+		response = "<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>"
+	}
+	igd.mutex.Unlock()
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body>
+</s:Envelope>`, action.XMLName.Local, response, action.XMLName.Local)
+}
+
+func (igd *fakeIgd) lease(key string) (string, bool) {
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+	lease, found := igd.mappings[key]
+	return lease, found
+}
+
+func TestUpnpMappings(t *testing.T) {
+	igd := &fakeIgd{mappings: make(map[string]string)}
+	server := httptest.NewServer(igd)
+	defer server.Close()
+
+	loc, _ := url.Parse(server.URL + "/desc.xml")
+	mapper, err := upnpMapperByURL(loc)
+	if err != nil {
+		t.Fatalf("Could not create the UPnP mapper: %s", err)
+	}
+
+	udp, err := addMapping(mapper, "udp", 7946)
+	if err != nil {
+		t.Fatalf("Could not add the UDP mapping: %s", err)
+	}
+	if _, err := addMapping(mapper, "tcp", 7946); err != nil {
+		t.Fatalf("Could not add the TCP mapping: %s", err)
+	}
+	// mapping again the same port replaces the previous mapping
+	if _, err := addMapping(mapper, "tcp", 7946); err != nil {
+		t.Fatalf("Could not add the TCP mapping again: %s", err)
+	}
+	if n := len(Mappings()); n != 2 {
+		t.Fatalf("Unexpected number of mappings: %d", n)
+	}
+	if udp.ExternalIP.String() != "203.0.113.7" || udp.ExternalPort != 7946 {
+		t.Fatalf("Unexpected external address %s:%d", udp.ExternalIP, udp.ExternalPort)
+	}
+	for _, key := range []string{"UDP:7946", "TCP:7946"} {
+		lease, found := igd.lease(key)
+		if !found {
+			t.Fatalf("Mapping %s not created", key)
+		}
+		if expected := fmt.Sprintf("%d", int(MAPPING_LIFETIME/time.Second)); lease != expected {
+			t.Fatalf("Mapping %s with lease %s (expected %s)", key, lease, expected)
+		}
+	}
+
+	// nothing is renewed until half the lifetime has passed
+	renewMappings(time.Now())
+	if m := Mappings()[0]; !m.Renewed.Equal(udp.Renewed) {
+		t.Fatalf("Mapping renewed too early")
+	}
+	later := time.Now().Add(MAPPING_LIFETIME / 2)
+	renewMappings(later)
+	if m := Mappings()[0]; !m.Renewed.Equal(later) {
+		t.Fatalf("Mapping not renewed")
+	}
+
+	RemoveMappings()
+	if len(Mappings()) != 0 {
+		t.Fatalf("Mappings not removed: %v", Mappings())
+	}
+	for _, key := range []string{"UDP:7946", "TCP:7946"} {
+		if _, found := igd.lease(key); found {
+			t.Fatalf("Mapping %s not removed from the gateway", key)
+		}
+	}
+}
+
+func TestHostWithPort(t *testing.T) {
+	for s, expected := range map[string]string{
+		"http://192.168.1.1:5000/desc.xml": "192.168.1.1:5000",
+		"http://192.168.1.1/desc.xml":      "192.168.1.1:80",
+		"https://[fe80::1]/desc.xml":       "[fe80::1]:443",
+	} {
+		u, _ := url.Parse(s)
+		if host := hostWithPort(u); host != expected {
+			t.Errorf("%s: expected %s, got %s", s, expected, host)
+		}
+	}
+}
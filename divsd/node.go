@@ -1,94 +1,317 @@
 package divsd
 
 import (
-	"fmt"
+	"bytes"
+	"context"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 
-	"bytes"
 	"github.com/hashicorp/memberlist"
 )
 
 // maybe we should use this in the future:
 // http://zhen.org/blog/ring-buffer-variable-length-low-latency-disruptor-style/
 
-// maybe we should send with ratelimit
-// https://github.com/juju/ratelimit
-
-// the send queue length used for sending to a node
+// the default send queue length (for each priority class) used for sending to a node
 const SEND_QUEUE_LEN = 100
 
 type Node struct {
 	*memberlist.Node
 
-	manager  *NodesManager
-	sendChan chan Encodeable
+	manager    *NodesManager
+	meta       *NodeMeta
+	extAddr    *net.UDPAddr // the external address published by the node
+	addr6      *net.UDPAddr // the global IPv6 address published by the node
+	directAddr *net.UDPAddr // a direct path obtained with hole punching
+	vlans      VlanSet      // the VLANs carried by the node (nil for all)
+	sendQueue  *SendQueue
+	doneChan   chan struct{} // closed when the sender worker finishes
+	closed     bool
+	mutex      sync.RWMutex
 }
 
-// @param address: a string in the form IP:port
-func NewNode(address string, nm *NodesManager) (*Node, error) {
-	host, port, err := net.SplitHostPort(address)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse peer address: %v", err)
+// Create a new node for a member of the cluster
+func NewNode(member *memberlist.Node, nm *NodesManager) *Node {
+	n := &Node{
+		Node:     member,
+		meta:     &NodeMeta{},
+		doneChan: make(chan struct{}),
+		manager:  nm,
 	}
-	portI, err := strconv.Atoi(port)
+	n.sendQueue = NewSendQueue(nm.config.Qos)
+
+	n.Update(member)
+
+	// create a worker for sending data
+	go n.sendWorker()
+
+	return n
+}
+
+// Get the metadata published by this node
+func (node *Node) Meta() *NodeMeta {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.meta
+}
+
+// Update the memberlist information (and the metadata) for this node
+func (node *Node) Update(member *memberlist.Node) {
+	meta, err := DecodeNodeMeta(member.Meta)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse port number from address")
+		log.Warning("Could not decode metadata for %s: %s", member.Name, err)
+		meta = &NodeMeta{}
 	}
 
-	n := Node{
-		Node: &memberlist.Node{
-			Addr: net.ParseIP(host),
-			Port: uint16(portI),
-		},
-		sendChan: make(chan Encodeable, SEND_QUEUE_LEN),
-		manager:  nm,
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.Node != nil && !node.Node.Addr.Equal(member.Addr) {
+		node.directAddr = nil // the node has moved: forget any direct path
 	}
+	node.Node = member
+	node.meta = meta
+	node.extAddr = nil
+	if len(meta.Addr) > 0 {
+		if addr, err := net.ResolveUDPAddr("udp", meta.Addr); err == nil {
+			node.extAddr = addr
+		}
+	}
+	node.addr6 = nil
+	if len(meta.Addr6) > 0 {
+		if addr, err := net.ResolveUDPAddr("udp6", meta.Addr6); err == nil {
+			node.addr6 = addr
+		}
+	}
+	node.vlans = nil
+	if len(meta.Vlans) > 0 {
+		if node.vlans, err = ParseVlanSet([]string{meta.Vlans}); err != nil {
+			log.Warning("Invalid VLANs for %s: %s", member.Name, err)
+			node.vlans = VlanSet{}
+		}
+	}
+}
 
-	// create a worker for sending data
-	go n.sendWorker()
+// Return `true` if the node carries some VLAN: nodes without VLAN support
+// only carry the default VLAN
+func (node *Node) CarriesVlan(vlan uint16) bool {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	if !node.meta.HasFeature(FEATURE_VLAN) {
+		return vlan == DEFAULT_VLAN
+	}
+	return node.vlans == nil || node.vlans.Contains(vlan)
+}
+
+// Set a direct path to this node (or nil for removing it)
+func (node *Node) SetDirectAddr(addr *net.UDPAddr) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.directAddr = addr
+}
 
-	return &n, nil
+// Get the direct path to this node obtained with hole punching, if any
+func (node *Node) DirectAddr() *net.UDPAddr {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.directAddr
+}
+
+// Get the external address of the node: the address it publishes in its
+// metadata (as it can change after a NAT rebinding), or the memberlist address
+func (node *Node) externalAddr() *net.UDPAddr {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	if node.extAddr != nil {
+		return node.extAddr
+	}
+	return &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
+}
+
+// Get the global IPv6 address of the node, when both this node and the local
+// node have one: we can then avoid NAT altogether
+func (node *Node) ipv6Addr() *net.UDPAddr {
+	if node.manager == nil || len(node.manager.localAddr6) == 0 {
+		return nil
+	}
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.addr6
+}
+
+// Get the address we must send to
+func (node *Node) sendAddr() *net.UDPAddr {
+	if addr := node.DirectAddr(); addr != nil {
+		return addr
+	}
+	if addr := node.ipv6Addr(); addr != nil {
+		return addr
+	}
+	return node.externalAddr()
 }
 
 // Send some serializable object to this node
-// Data is enqueued in a queue for sending
+// Data is enqueued in the queue for its priority class, and it is dropped if
+// that queue is full.
 // This method will only be invoked from the NodesManager
 func (node *Node) Send(data Encodeable) error {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
+	if node.closed {
+		return ERR_NODE_CLOSED
+	}
 	log.Debug("Enqueuing data for sending to %v", node)
-	node.sendChan <- data
+	if !node.sendQueue.Push(data) {
+		return ERR_QUEUE_FULL
+	}
 	return nil
 }
 
 // Close the node, releasing all the resources associated with it
+// Data already enqueued will still be sent by the sender worker.
 func (node *Node) Close() error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if node.closed {
+		return nil
+	}
 	log.Debug("Closing node %s", node)
-	close(node.sendChan)
+	node.closed = true
+	node.sendQueue.Close()
 	return nil
 }
 
+// Close the node and wait until all the data enqueued has been sent (or
+// until the context is done)
+func (node *Node) Drain(ctx context.Context) error {
+	node.Close()
+	select {
+	case <-node.doneChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Start a coroutine that send to this node
+// With batching enabled, the frames for nodes that accept batches are
+// coalesced in batches, that are sent when they are full or when the first
+// frame in the batch has waited for the batching delay.
 func (node *Node) sendWorker() {
-	ipAddr, err := net.ResolveIPAddr("ip", node.Addr.String())
-	if err != nil {
-		log.Debug("Could not parse IP address %v", node.Addr)
+	defer close(node.doneChan)
+
+	log.Info("Starting sender worker for %s", node.Name)
+	var batch *Batch
+	bc := node.manager.config.Batching
+	delay := time.Duration(bc.Delay) * time.Microsecond
+	if bc.Enabled {
+		batch = NewBatch(bc.Mtu)
 	}
+	for {
+		data, ok := node.sendQueue.Pop()
+		if !ok {
+			break
+		}
+		node.send(data, batch)
+		for batch != nil && batch.Len() > 0 {
+			data, ok := node.sendQueue.PopTimeout(batch.Remaining(delay))
+			if !ok {
+				break
+			}
+			node.send(data, batch)
+		}
+		node.flush(batch)
+	}
+	log.Debug("Sender worker for %s finished", node.Name)
+}
 
-	log.Info("Starting sender worker for %s", ipAddr)
-	for data := range node.sendChan {
-		marshaled, err := data.Encode()
-		if err != nil {
-			log.Debug("Error encoding data for %s: %s", node.Addr, err)
+// encode and send some data to this node, adding it to the batch (if any)
+// when it is a frame and the node accepts batches
+func (node *Node) send(data Encodeable, batch *Batch) {
+	marshaled, err := data.Encode()
+	if err != nil {
+		log.Debug("Error encoding data for %s: %s", node.Name, err)
+		return
+	}
+	meta := node.Meta()
+	marshaled = node.manager.compressor.Compress(data, marshaled, meta)
+	if !node.allowed(data, len(marshaled)) {
+		log.Debug("Rate limit exceeded for %s: dropping packet", node.Name)
+		return
+	}
+	if packet, _ := ethernetPacketIn(data); packet != nil {
+		node.manager.captures.Capture(CAPTURE_OVERLAY_OUT, node.Name, packet, nil)
+	}
+	if batch != nil && compressible(data) && meta.HasFeature(FEATURE_BATCH) {
+		if batch.Add(marshaled) {
+			return
 		}
-		err = node.manager.members.SendTo(ipAddr, marshaled)
-		if err != nil {
-			log.Debug("Error sending to %s: %s", node.Addr, err)
+		node.flush(batch)
+		if batch.Add(marshaled) {
+			return
 		}
 	}
+	node.flush(batch) // keep the order of the data sent
+	_, isKeepalive := data.(*Keepalive)
+	node.sendBuffer(marshaled, !isKeepalive)
+}
+
+// send the frames in a batch (if any)
+func (node *Node) flush(batch *Batch) {
+	if batch == nil || batch.Len() == 0 {
+		return
+	}
+	if batch.Len() > 1 {
+		metrics.Inc("batching.batches")
+		metrics.Add("batching.frames", int64(batch.Len()))
+	}
+	node.sendBuffer(batch.Bytes(), true)
+	batch.Reset()
+}
+
+// send a buffer to this node, optionally accounting it as traffic for the
+// keepalives
+func (node *Node) sendBuffer(buf []byte, traffic bool) {
+	udpAddr := node.sendAddr()
+	if err := node.manager.members.SendTo(udpAddr, buf); err != nil {
+		log.Debug("Error sending to %s: %s", udpAddr, err)
+		return
+	}
+	if traffic {
+		node.manager.keepaliver.Sent(node.Name)
+	}
+}
+
+// Check the rate limits for some data we are about to send to this node
+// Only Ethernet packets (direct or relayed) are limited.
+func (node *Node) allowed(data Encodeable, size int) bool {
+	packet, from := ethernetPacketIn(data)
+	if packet == nil {
+		return true
+	}
+	srcMac := ""
+	if from == node.manager.localName {
+		srcMac = packet.SrcMAC.String()
+	}
+	return node.manager.ratelimit.Allow(node.Name, srcMac, packet.Vlan(), !isUnicastMac(packet.DstMAC), size)
+}
+
+// get the Ethernet packet in some data (direct or relayed) and the node that
+// originated it (or nil if it is not a packet)
+func ethernetPacketIn(data Encodeable) (*EthernetPacket, string) {
+	switch d := data.(type) {
+	case *EthernetPacket:
+		return d, d.From
+	case *RelayedPacket:
+		return &d.Packet, d.From
+	}
+	return nil, ""
 }
 
 // Compare to another node, returning "true" if they are equal
-func (node Node) Equal(other *memberlist.Node) bool {
+func (node *Node) Equal(other *memberlist.Node) bool {
 	if bytes.Compare(node.Node.Addr, other.Addr) != 0 {
 		return false
 	}
@@ -97,3 +320,28 @@ func (node Node) Equal(other *memberlist.Node) bool {
 	}
 	return true
 }
+
+// The information about a peer, as exposed in the control API
+type PeerInfo struct {
+	Name       string        `json:"name"`
+	Addr       string        `json:"addr"`
+	DirectAddr string        `json:"direct_addr,omitempty"`
+	Meta       *NodeMeta     `json:"meta"`
+	Queue      SendQueueInfo `json:"queue"`
+}
+
+// Get the information about this node
+func (node *Node) Info() PeerInfo {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	info := PeerInfo{
+		Name:  node.Name,
+		Addr:  node.Node.Address(),
+		Meta:  node.meta,
+		Queue: node.sendQueue.Info(),
+	}
+	if node.directAddr != nil {
+		info.DirectAddr = node.directAddr.String()
+	}
+	return info
+}
@@ -1,11 +1,17 @@
 package divsd
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
+
 	"github.com/hashicorp/memberlist"
+	"github.com/inercia/divs/divsd/nat"
 	"github.com/inercia/divs/divsd/rendezvous"
 )
 
@@ -15,6 +21,9 @@ const JOINED_CHAN_LEN = 10
 // discovered channel length
 const DISCOVERED_CHAN_LEN = 10
 
+// default timeout for broadcasting our leave to the cluster
+const DEFAULT_LEAVE_TIMEOUT = 5 * time.Second
+
 // Unknown destination mac
 var ERR_UNKNOWN_DST_MAC = fmt.Errorf("Unknown destination mac")
 
@@ -25,12 +34,36 @@ type NodesManager struct {
 	config         *Config
 	devManager     *DevManager
 	members        *memberlist.Memberlist
+	membersConfig  *memberlist.Config
 	membersExtAddr net.UDPAddr
+	localAddr6     string // our global IPv6 address (as [IP]:port), if any
+	localName      string
+	keyring        *memberlist.Keyring
+	rendezvous     *rendezvous.Rendezvous
 
-	discoveredChan chan string // we send to this channel possible, discovered peers
-	joinedChan     chan string // we send to this channel new, joined peers
+	discoveredChan chan string   // we send to this channel possible, discovered peers
+	joinedChan     chan string   // we send to this channel new, joined peers
+	stopChan       chan struct{} // closed when we are leaving the cluster
 
-	macsToNodes map[string]*Node
+	nodes      map[string]*Node
+	macTable   *MacTable
+	localMacs  map[MacKey]bool
+	via        string // the relay other nodes must use for reaching us
+	broadcasts *memberlist.TransmitLimitedQueue
+	puncher    *Puncher
+	keepaliver *Keepaliver
+	security   *PortSecurity
+	filter     *Filter
+	ratelimit  *RateLimiter
+	storm      *StormControl
+	groups     *GroupTable
+	captures   *CaptureManager
+	mirror     *Mirror
+	compressor *Compressor
+	site       string      // the site and region labels (see SetLabels)
+	region     string      //
+	relay      relayConfig // the relay settings (see SetRelay)
+	mutex      sync.RWMutex
 }
 
 // Create a new peers manager
@@ -40,7 +73,39 @@ func NewNodesManager(config *Config) (*NodesManager, error) {
 		config:         config,
 		joinedChan:     make(chan string, JOINED_CHAN_LEN),
 		discoveredChan: make(chan string, DISCOVERED_CHAN_LEN),
-		macsToNodes:    make(map[string]*Node),
+		stopChan:       make(chan struct{}),
+		nodes:          make(map[string]*Node),
+		macTable:       NewMacTable(),
+		groups:         NewGroupTable(),
+		captures:       NewCaptureManager(config.CaptureDir()),
+		localMacs:      make(map[MacKey]bool),
+	}
+	d.puncher = NewPuncher(&d)
+	d.keepaliver = NewKeepaliver(&d)
+	filter, err := NewFilter(config.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter rules: %s", err)
+	}
+	d.filter = filter
+	if d.mirror, err = NewMirror(config, &d); err != nil {
+		return nil, fmt.Errorf("Invalid port mirroring: %s", err)
+	}
+	d.ratelimit = NewRateLimiter(config)
+	d.storm = NewStormControl(config.Storm)
+	d.compressor = NewCompressor(config.Compression)
+	d.groups.SetConfig(config.Snooping)
+	d.SetLabels(config.Global.Site, config.Global.Region)
+	d.SetRelay(config.Relay)
+	d.storm.OnBlock = func(node string) {
+		d.macTable.RemoveNode(node)
+	}
+	d.security = NewPortSecurity(config)
+	d.security.OnQuarantine = func(node string) {
+		d.macTable.RemoveNode(node)
+	}
+	d.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       d.numNodes,
+		RetransmitMult: BROADCASTS_RETRANSMIT_MULT,
 	}
 	return &d, nil
 }
@@ -58,49 +123,200 @@ func (nm *NodesManager) Start(membersExtAddr net.UDPAddr) (err error) {
 
 	extIp := nm.membersExtAddr.IP.String()
 	extPort := nm.membersExtAddr.Port
-	log.Debug("Memberlist external IP/Port: %s:%d", extIp, extPort)
+	log.Debug("Memberlist external IP/Port: %s", net.JoinHostPort(extIp, strconv.Itoa(extPort)))
 
 	membersConfig := memberlist.DefaultWANConfig()
-	membersConfig.BindAddr = nm.config.Global.BindIP
+	membersConfig.BindAddr = bindIP(nm.config.Global.BindIP)
 	membersConfig.BindPort = extPort
+	if ip := nm.membersExtAddr.IP; ip != nil && !ip.IsUnspecified() {
+		membersConfig.AdvertiseAddr = extIp
+		membersConfig.AdvertisePort = extPort
+	} else if bindSupportsIPv6(membersConfig.BindAddr) && net.ParseIP(membersConfig.BindAddr).IsUnspecified() {
+		// memberlist would advertise "::" otherwise
+		if ip := localAdvertiseIP(); ip != nil {
+			membersConfig.AdvertiseAddr = ip.String()
+			membersConfig.AdvertisePort = extPort
+		}
+	}
+	if bindSupportsIPv6(membersConfig.BindAddr) {
+		if ip := globalIPv6(); ip != nil {
+			nm.localAddr6 = net.JoinHostPort(ip.String(), strconv.Itoa(extPort))
+			log.Info("Global IPv6 address: %s", nm.localAddr6)
+		}
+	}
 	membersConfig.Delegate = nm
 	membersConfig.Events = nm
 	membersConfig.LogOutput = loggerWritter
+	if len(nm.config.Global.Name) > 0 {
+		membersConfig.Name = nm.config.Global.Name
+	}
+	nm.localName = membersConfig.Name
+
+	if nm.keyring, err = newKeyring(nm.config.Crypto.Key); err != nil {
+		return fmt.Errorf("Invalid encryption keys: %s", err)
+	}
+	if nm.keyring != nil {
+		log.Info("Encryption enabled with %d keys", len(nm.config.Crypto.Key))
+		membersConfig.Keyring = nm.keyring
+	}
 
 	members, err := memberlist.Create(membersConfig)
 	if err != nil {
-		return fmt.Errorf("Failed to create memberlist: " + err.Error())
+		return fmt.Errorf("Failed to create memberlist: %s", err)
 	}
 	nm.members = members
+	nm.membersConfig = membersConfig
 
 	// start reading from the "discoveredChan" channel and, for each new peer
 	// discovered, instruct the "memberlist" to "join" it
+	// The channel is never closed (as the discovery could still be sending to
+	// it): we stop reading when leaving the cluster.
 	go func() {
-		for address := range nm.discoveredChan {
-			go func(a string) {
-				// Join an existing cluster by specifying at least one known member.
-				_, err := nm.members.Join([]string{a})
-				if err != nil {
-					log.Error("Failed to join node at %s: %s", a, err.Error())
-				}
-				// we will continue in NotifyJoin()...
-			}(address)
+		for {
+			select {
+			case address := <-nm.discoveredChan:
+				go func(a string) {
+					// Join an existing cluster by specifying at least one known member.
+					_, err := nm.members.Join([]string{a})
+					if err != nil {
+						log.Error("Failed to join node at %s: %s", a, err.Error())
+					}
+					// we will continue in NotifyJoin()...
+				}(address)
+			case <-nm.stopChan:
+				return
+			}
 		}
 	}()
 
 	serviceId := nm.config.Global.Serial.ToHex()
 	bindIp := nm.config.Global.BindIP
 	dhtPort := nm.config.Discover.Port
-	rendezvous.Start(serviceId, bindIp, dhtPort, nm.membersExtAddr.String(), nm.discoveredChan)
+	nm.rendezvous = rendezvous.Start(serviceId, bindIp, dhtPort, nm.membersExtAddr.String(), nm.discoveredChan)
 
+	nm.JoinPeers(nm.config.Discover.Peer)
+	if len(nm.config.Filter.Shared) > 0 {
+		nm.PublishRules(nm.config.Filter.Shared)
+	}
+	go nm.updateRelay()
+	if nm.config.Nat.Keepalive {
+		go nm.keepaliver.Run()
+	}
+	if nm.config.Nat.Recheck > 0 {
+		go nm.externalAddrWorker(time.Duration(nm.config.Nat.Recheck) * time.Second)
+	}
+	go nm.groupsExpirer()
+	return nm.mirror.Start()
+}
+
+// get the number of nodes in the cluster
+func (nm *NodesManager) numNodes() int {
+	if nm.members == nil {
+		return 1
+	}
+	return nm.members.NumMembers()
+}
+
+// Join some static peers, as IP:port
+func (nm *NodesManager) JoinPeers(peers []string) {
+	go func() {
+		for _, peer := range peers {
+			log.Info("Joining static peer %s", peer)
+			select {
+			case nm.discoveredChan <- peer:
+			case <-nm.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Update the encryption keys
+// New keys are added to the keyring. Removing keys, changing the primary key
+// or enabling the encryption require a restart.
+func (nm *NodesManager) UpdateKeys(encoded []string) error {
+	if nm.keyring == nil {
+		return ERR_RESTART_REQUIRED
+	}
+	keys, err := decodeKeys(encoded)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 || bytes.Compare(keys[0], nm.keyring.GetPrimaryKey()) != 0 {
+		return ERR_RESTART_REQUIRED
+	}
+
+	current := nm.keyring.GetKeys()
+	for _, c := range current {
+		found := false
+		for _, k := range keys {
+			if bytes.Compare(c, k) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ERR_RESTART_REQUIRED
+		}
+	}
+
+	for _, k := range keys[1:] {
+		if err := nm.keyring.AddKey(k); err != nil {
+			return err
+		}
+	}
+	log.Info("Keyring updated: %d keys installed", len(nm.keyring.GetKeys()))
 	return nil
 }
 
-// wait some time for some peers
-func (nm *NodesManager) Stop() (err error) {
+// Leave the cluster
+// Our departure is broadcasted to the other nodes (so they can purge our MACs
+// immediately) and the discovery is stopped. We can still send data to other
+// nodes until Stop() is invoked.
+func (nm *NodesManager) Leave(ctx context.Context) (err error) {
+	close(nm.stopChan)
+
+	if nm.members != nil {
+		log.Info("Leaving the cluster...")
+		err = nm.members.Leave(timeoutFromContext(ctx, DEFAULT_LEAVE_TIMEOUT))
+		if err != nil {
+			log.Warning("Could not leave the cluster gracefully: %s", err)
+		}
+	}
+
 	log.Debug("Signaling stop for discovery")
-	close(nm.discoveredChan)
-	return nil
+	if nm.rendezvous != nil {
+		nm.rendezvous.Leave()
+	}
+	return err
+}
+
+// Stop the nodes manager
+// All the send queues are drained (or until the context is done) before
+// shutting down the memberlist.
+func (nm *NodesManager) Stop(ctx context.Context) (err error) {
+	nm.mutex.Lock()
+	nodes := nm.nodes
+	nm.nodes = make(map[string]*Node)
+	nm.mutex.Unlock()
+	nm.macTable.Clear()
+	nm.captures.StopAll()
+	nm.mirror.Stop()
+
+	log.Debug("Draining send queues for %d nodes", len(nodes))
+	for _, node := range nodes {
+		if err = node.Drain(ctx); err != nil {
+			log.Warning("Could not drain the send queue for %s: %s", node.Name, err)
+			break
+		}
+	}
+
+	if nm.members != nil {
+		if shutdownErr := nm.members.Shutdown(); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
 }
 
 // Join a new peer
@@ -140,33 +356,359 @@ func (this *NodesManager) WaitForNodes() error {
 	return nil
 }
 
-// Wait for some peers
+// Wait for peers until we leave the cluster
 func (this *NodesManager) WaitForNodesForever() error {
 	log.Debug("Waiting for peers to be discovered...")
 	for {
-		<-this.joinedChan
-		log.Debug("[WaitForNodesForever] node joined")
+		select {
+		case <-this.joinedChan:
+			log.Debug("[WaitForNodesForever] node joined")
+		case <-this.stopChan:
+			return nil
+		}
 	}
-	return nil
 }
 
 // Sends a packet to the corresponding Node
-// If no valid Node is found for this packet, it is silently discarded
+// Broadcast, multicast and unknown unicast packets are flooded to all the nodes
+// in the same VLAN.
 func (nm *NodesManager) SendPacket(packet *EthernetPacket) error {
+	vlan := packet.Vlan()
+	packet.From = nm.localName
+	if nm.mirror.Active() {
+		to := ""
+		if entry, found := nm.macTable.Lookup(vlan, packet.DstMAC.String()); found {
+			to = entry.Node
+		}
+		nm.mirror.Mirror(nm.localName, to, packet)
+	}
+
+	// multicast is only sent to the nodes with receivers (when they are known)
+	if snooping, _ := nm.groups.Snooping(); snooping && !isUnicastMac(packet.DstMAC) {
+		if members, registered := nm.groups.Members(vlan, packet.DstMAC); registered {
+			metrics.Inc("snooping.pruned")
+			return nm.floodTo(vlan, packet, func(node *Node) bool {
+				return members[node.Name] || !node.Meta().HasFeature(FEATURE_IGMP)
+			})
+		}
+	}
+
 	// check if we have a valid destination node for this packet
-	destMac := packet.DstMAC.String()
-	node, found := nm.macsToNodes[destMac]
+	if isUnicastMac(packet.DstMAC) {
+		destMac := packet.DstMAC.String()
+		if entry, found := nm.macTable.Lookup(vlan, destMac); found {
+			nm.mutex.RLock()
+			node, found := nm.nodes[entry.Node]
+			nm.mutex.RUnlock()
+			if found {
+				return nm.sendToNode(node, packet)
+			}
+		}
+		log.Debug("Unknown destination %s in VLAN %d: flooding", destMac, vlan)
+	}
+	return nm.flood(vlan, packet)
+}
+
+// Send a packet to all the nodes that carry a VLAN
+func (nm *NodesManager) flood(vlan uint16, packet *EthernetPacket) error {
+	return nm.floodTo(vlan, packet, nil)
+}
+
+// Send a packet to the nodes that carry a VLAN and that are accepted by a
+// function (or all of them, if nil)
+func (nm *NodesManager) floodTo(vlan uint16, packet *EthernetPacket, accept func(node *Node) bool) error {
+	nm.mutex.RLock()
+	nodes := make([]*Node, 0, len(nm.nodes))
+	for _, node := range nm.nodes {
+		if node.CarriesVlan(vlan) && !nm.storm.Blocked(node.Name) && (accept == nil || accept(node)) {
+			nodes = append(nodes, node)
+		}
+	}
+	nm.mutex.RUnlock()
+
+	for _, node := range nodes {
+		if err := nm.sendToNode(node, packet); err != nil {
+			log.Debug("Could not send to %s: %s", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// Deliver a packet received from other node to the TAP device, checking the
+// sender can originate packets with that source MAC
+func (nm *NodesManager) deliver(from string, packet *EthernetPacket) {
+	nm.captures.Capture(CAPTURE_OVERLAY_IN, from, packet, nil)
+	if !nm.checkSender(from, packet.Vlan(), packet.SrcMAC.String()) {
+		return
+	}
+	if !nm.security.Check(from, packet.Vlan(), packet.SrcMAC.String()) {
+		return
+	}
+	if !nm.filter.Check(FILTER_IN, packet) {
+		return
+	}
+	if !nm.stormCheckReceived(from, packet) {
+		return
+	}
+	nm.mirror.Mirror(from, nm.localName, packet)
+	if snooping, _ := nm.groups.Snooping(); snooping && isGroupQuery(packet) {
+		nm.groups.Queried(packet.Vlan(), time.Now()) // the querier is behind other node
+	}
+	packet, ok := nm.devManager.vlans.Egress(packet)
+	if !ok {
+		log.Debug("Dropping packet: VLAN not carried by the TAP device")
+		return
+	}
+	frame, err := packet.Bytes()
+	if err != nil {
+		log.Debug("Could not serialize packet: %s", err)
+		return
+	}
+	nm.captures.Capture(CAPTURE_TAP_OUT, "", packet, frame)
+	if err := nm.devManager.Write(frame); err != nil {
+		log.Debug("Could not deliver packet: %s", err)
+	}
+}
+
+// Check the node a packet (or a MAC announcement) claims to come from, as the
+// sender fills that in itself: it must be a live member of the switch, and
+// when other live member has announced the source MAC, that node must be the
+// sender (so nodes cannot be blamed for the frames sent by others)
+// Returns `false` if it must be dropped.
+func (nm *NodesManager) checkSender(from string, vlan uint16, mac string) bool {
+	nm.mutex.RLock()
+	_, live := nm.nodes[from]
+	nm.mutex.RUnlock()
+	if !live || from == nm.localName {
+		log.Debug("Dropping packet from %s: not a member of the switch", nodeLabel(from))
+		metrics.Inc("security.spoofed")
+		return false
+	}
+	if entry, found := nm.macTable.Lookup(vlan, mac); found && entry.Node != from {
+		nm.mutex.RLock()
+		_, ownerLive := nm.nodes[entry.Node]
+		nm.mutex.RUnlock()
+		if ownerLive {
+			log.Debug("Dropping packet from %s: MAC %s is at %s", from, mac, entry.Node)
+			metrics.Inc("security.spoofed")
+			return false
+		}
+	}
+	return true
+}
+
+// Check the local node can originate a frame with some source MAC in a VLAN,
+// returning `false` if it must be dropped (see the port security)
+func (nm *NodesManager) CheckLocalMac(vlan uint16, mac net.HardwareAddr) bool {
+	return nm.security.Check(nm.localName, vlan, mac.String())
+}
+
+// Check the storm control for a frame read from the TAP device, returning
+// `false` if it must be dropped
+func (nm *NodesManager) StormCheck(packet *EthernetPacket) bool {
+	known := false
+	if isUnicastMac(packet.DstMAC) {
+		_, known = nm.macTable.Lookup(packet.Vlan(), packet.DstMAC.String())
+	}
+	return nm.storm.Check(nm.localName, stormClass(packet.DstMAC, known))
+}
+
+// check the storm control for a packet received from other node: unicast
+// packets for MACs that are not behind this node have been flooded
+func (nm *NodesManager) stormCheckReceived(from string, packet *EthernetPacket) bool {
+	if nm.storm.Blocked(nm.localName) {
+		return false // the local port is blocked in both directions
+	}
+	known := false
+	if isUnicastMac(packet.DstMAC) {
+		nm.mutex.RLock()
+		known = nm.localMacs[MacKey{packet.Vlan(), packet.DstMAC.String()}]
+		nm.mutex.RUnlock()
+	}
+	return nm.storm.Check(from, stormClass(packet.DstMAC, known))
+}
+
+// send a mirrored frame to a node, returning `false` if it is unknown
+func (nm *NodesManager) sendMirrored(name string, mp *MirroredPacket) bool {
+	nm.mutex.RLock()
+	node, found := nm.nodes[name]
+	nm.mutex.RUnlock()
 	if !found {
-		log.Debug("Trying to send to unknown peer %s", node)
-		return ERR_UNKNOWN_DST_MAC
+		return false
+	}
+	return node.Send(mp) == nil
+}
+
+// Snoop the IGMP/MLD reports in a frame read from the TAP device, announcing
+// the groups the local node joins or leaves
+func (nm *NodesManager) SnoopPacket(packet *EthernetPacket) {
+	snooping, timeout := nm.groups.Snooping()
+	if !snooping || isUnicastMac(packet.DstMAC) {
+		return
+	}
+	vlan := packet.Vlan()
+	if isGroupQuery(packet) {
+		nm.groups.Queried(vlan, time.Now())
+		return
+	}
+	receiver := packet.SrcMAC.String()
+	expires := time.Now().Add(timeout)
+	for _, r := range snoopReports(packet) {
+		if nm.groups.Report(nm.localName, receiver, vlan, r, expires) {
+			nm.announceGroup(GroupMembership{Vlan: vlan, Group: r.group.String()}, r.join)
+		}
+	}
+}
+
+// announce the local node joins (or leaves) a multicast group
+func (nm *NodesManager) announceGroup(g GroupMembership, join bool) {
+	if join {
+		log.Debug("Local receivers for group %s in VLAN %d", g.Group, g.Vlan)
+	} else {
+		log.Debug("No more local receivers for group %s in VLAN %d", g.Group, g.Vlan)
+	}
+	key := fmt.Sprintf("group:%d/%s", g.Vlan, g.Group)
+	nm.Broadcast(key, GroupAnnounce{Node: nm.localName, Group: g, Join: join})
+}
+
+// process a group membership announcement from other node
+func (nm *NodesManager) handleGroupAnnounce(announce *GroupAnnounce) {
+	if announce.Node == nm.localName {
+		return
+	}
+	if announce.Join {
+		nm.groups.Join(announce.Node, announce.Group)
+	} else {
+		nm.groups.Leave(announce.Node, announce.Group)
+	}
+}
+
+// periodically remove the local receivers that have not reported their groups
+func (nm *NodesManager) groupsExpirer() {
+	ticker := time.NewTicker(GROUPS_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, g := range nm.groups.Expire(nm.localName, now) {
+				nm.announceGroup(g, false)
+			}
+		case <-nm.stopChan:
+			return
+		}
 	}
-	return node.Send(packet)
+}
+
+// Get the multicast groups table
+func (nm *NodesManager) Groups() []GroupEntry {
+	return nm.groups.Entries()
+}
+
+// Check the filter rules for a frame read from the TAP device, returning
+// `false` if it must be dropped
+func (nm *NodesManager) FilterPacket(packet *EthernetPacket) bool {
+	return nm.filter.Check(FILTER_OUT, packet)
+}
+
+// Publish some filter rules to all the nodes in the switch, replacing the
+// rules previously shared
+func (nm *NodesManager) PublishRules(rules []string) error {
+	rs := &RuleSet{Version: time.Now().UnixNano(), Origin: nm.localName, Rules: rules}
+	if _, err := nm.filter.SetRuleSet(rs); err != nil {
+		return err
+	}
+	log.Info("Publishing %d filter rules to the switch", len(rules))
+	return nm.Broadcast("rules", rs)
+}
+
+// Use the filter rules shared by some other node, if they are newer than the
+// ones we have, and gossip them to other nodes
+func (nm *NodesManager) mergeRules(rs *RuleSet) {
+	accepted, err := nm.filter.SetRuleSet(rs)
+	if err != nil {
+		log.Warning("Invalid filter rules from %s: %s", rs.Origin, err)
+		return
+	}
+	if accepted {
+		log.Info("Using %d filter rules shared by %s", len(rs.Rules), rs.Origin)
+		nm.Broadcast("rules", rs)
+	}
+}
+
+// Learn a MAC address in a VLAN that is behind this node, announcing it to
+// the other nodes if it is new
+func (nm *NodesManager) LearnLocalMac(vlan uint16, mac net.HardwareAddr) {
+	if !isUnicastMac(mac) {
+		return
+	}
+	key := MacKey{vlan, mac.String()}
+
+	nm.mutex.Lock()
+	known := nm.localMacs[key]
+	nm.localMacs[key] = true
+	nm.mutex.Unlock()
+
+	if !known {
+		nm.storm.LearnMac(vlan, key.MAC, nm.localName)
+		log.Debug("New local MAC %s in VLAN %d: announcing it", key.MAC, vlan)
+		nm.Broadcast(fmt.Sprintf("mac:%d/%s", vlan, key.MAC), MacAnnounce{MAC: key.MAC, Node: nm.localName, Vlan: vlan})
+	}
+}
+
+// Learn that a MAC in a VLAN is located at some other node
+func (nm *NodesManager) learnRemoteMac(vlan uint16, mac string, nodeName string) {
+	if nodeName == nm.localName {
+		return
+	}
+	// the MAC comes from the peer: use it only in canonical form
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		log.Debug("Ignoring invalid MAC '%s' from %s", mac, nodeLabel(nodeName))
+		return
+	}
+	mac = hw.String()
+	nm.mutex.RLock()
+	_, live := nm.nodes[nodeName]
+	nm.mutex.RUnlock()
+	if !live {
+		log.Debug("Ignoring MAC %s from %s: not a member of the switch", mac, nodeLabel(nodeName))
+		return
+	}
+	if !nm.security.Check(nodeName, vlan, mac) {
+		return
+	}
+	if !nm.storm.LearnMac(vlan, mac, nodeName) {
+		return
+	}
+
+	nm.mutex.Lock()
+	node, found := nm.nodes[nodeName]
+	delete(nm.localMacs, MacKey{vlan, mac}) // the MAC could have moved to the other node
+	nm.mutex.Unlock()
+	nm.ratelimit.ForgetMac(vlan, mac)
+
+	via := ""
+	if found {
+		via = node.Meta().Via
+	}
+	if nm.macTable.Learn(vlan, mac, nodeName, via) {
+		if len(via) > 0 {
+			log.Debug("MAC %s in VLAN %d is at %s via %s", mac, vlan, nodeName, via)
+		} else {
+			log.Debug("MAC %s in VLAN %d is at %s", mac, vlan, nodeName)
+		}
+	}
+}
+
+// Get the MAC database
+func (nm *NodesManager) Macs() []MacEntry {
+	return nm.macTable.Entries()
 }
 
 // Sends some data to some other node
 func (nm *NodesManager) SendTo(packet []byte, node *Node) error {
 	log.Debug("Sending packet to %v", node)
-	addr := net.IPAddr{node.Addr, ""}
+	addr := net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
 	err := nm.members.SendTo(&addr, packet)
 	if err != nil {
 		return fmt.Errorf("error when sending data to peer %s", node)
@@ -174,12 +716,89 @@ func (nm *NodesManager) SendTo(packet []byte, node *Node) error {
 	return nil
 }
 
+// Get the metadata for the local node
+func (nm *NodesManager) LocalMeta() *NodeMeta {
+	meta := &NodeMeta{
+		Name:         nm.localName,
+		Version:      VERSION,
+		Features:     append([]string{}, FEATURES...),
+		Capabilities: []string{},
+		NatType:      nat.DetectedType().String(),
+	}
+	if snooping, _ := nm.groups.Snooping(); snooping {
+		meta.Features = append(meta.Features, FEATURE_IGMP)
+	}
+	if nm.compressor.Enabled() {
+		meta.Features = append(meta.Features, FEATURE_SNAPPY)
+	}
+	if nm.config.Batching.Enabled {
+		meta.Features = append(meta.Features, FEATURE_BATCH)
+	}
+	nm.mutex.RLock()
+	meta.Site = nm.site
+	meta.Region = nm.region
+	if nm.relay.Enabled {
+		meta.Capabilities = append(meta.Capabilities, CAP_RELAY)
+	}
+	meta.Via = nm.via
+	if nm.membersExtAddr.Port != 0 {
+		meta.Addr = nm.membersExtAddr.String()
+	}
+	meta.Addr6 = nm.localAddr6
+	nm.mutex.RUnlock()
+	if nm.devManager != nil {
+		meta.Vlans = nm.devManager.vlans.String()
+		if mac := nm.devManager.HardwareAddr(); mac != nil {
+			meta.TapMAC = mac.String()
+		}
+	}
+	return meta
+}
+
+// Set the site and region labels published in the metadata
+func (nm *NodesManager) SetLabels(site string, region string) {
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+	nm.site, nm.region = site, region
+}
+
+// Set the relay settings
+func (nm *NodesManager) SetRelay(c relayConfig) {
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+	nm.relay = c
+}
+
+// Broadcast the (updated) local metadata to the cluster
+func (nm *NodesManager) UpdateMeta() error {
+	if nm.members == nil {
+		return nil
+	}
+	return nm.members.UpdateNode(DEFAULT_LEAVE_TIMEOUT)
+}
+
+// Get the information we have about all the peers
+func (nm *NodesManager) Peers() []PeerInfo {
+	nm.mutex.RLock()
+	defer nm.mutex.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(nm.nodes))
+	for _, node := range nm.nodes {
+		peers = append(peers, node.Info())
+	}
+	return peers
+}
+
 // NodeMeta is used to retrieve meta-data about the current node
 // when broadcasting an alive message. It's length is limited to
 // the given byte size. This metadata is available in the Node structure.
 func (nm *NodesManager) NodeMeta(limit int) []byte {
 	log.Debug("Current node meta-data requested")
-	res := make([]byte, 0)
+	res, err := nm.LocalMeta().Encode(limit)
+	if err != nil {
+		log.Error("Could not encode the local metadata: %s", err)
+		return make([]byte, 0)
+	}
 	return res
 }
 
@@ -189,6 +808,11 @@ func (nm *NodesManager) NodeMeta(limit int) []byte {
 // slice may be modified after the call returns, so it should be copied if needed.
 func (nm *NodesManager) NotifyMsg(buf []byte) {
 	log.Debug("User data received")
+	buf, err := nm.compressor.Decompress(buf)
+	if err != nil {
+		log.Debug("Could not decompress message: %s", err)
+		return
+	}
 	messageType, message, err := getTypeAndEncodedMsg(buf)
 	if err != nil {
 		log.Error("Could not receive message: %s", err)
@@ -198,8 +822,84 @@ func (nm *NodesManager) NotifyMsg(buf []byte) {
 	switch messageType {
 	case MSG_DIVS_PKG_ETH:
 		log.Debug("Data packet received: %d bytes", len(message))
-		// TODO: send the message to the TAP device... maybe we should enqueue it
-		// TODO: and then a worker could perform the real delivery
+		var pkt EthernetPacket
+		if err := decodeMsg(message, &pkt); err != nil {
+			log.Debug("Could not decode data packet: %s", err)
+			return
+		}
+		nm.deliver(pkt.From, &pkt)
+	case MSG_DIVS_MAC_ANNOUNCE:
+		var announce MacAnnounce
+		if err := decodeMsg(message, &announce); err != nil {
+			log.Debug("Could not decode MAC announcement: %s", err)
+			return
+		}
+		nm.learnRemoteMac(announcedVlan(announce.Vlan), announce.MAC, announce.Node)
+	case MSG_DIVS_RELAY:
+		var rp RelayedPacket
+		if err := decodeMsg(message, &rp); err != nil {
+			log.Debug("Could not decode relayed packet: %s", err)
+			return
+		}
+		nm.handleRelayed(&rp)
+	case MSG_DIVS_PUNCH_REQUEST:
+		var req PunchRequest
+		if err := decodeMsg(message, &req); err == nil {
+			nm.puncher.handleRequest(&req)
+		}
+	case MSG_DIVS_PUNCH_SYNC:
+		var sync PunchSync
+		if err := decodeMsg(message, &sync); err == nil {
+			nm.puncher.handleSync(&sync)
+		}
+	case MSG_DIVS_PUNCH_PROBE:
+		var probe PunchProbe
+		if err := decodeMsg(message, &probe); err == nil {
+			nm.puncher.handleProbe(&probe)
+		}
+	case MSG_DIVS_PUNCH_ACK:
+		var ack PunchAck
+		if err := decodeMsg(message, &ack); err == nil {
+			nm.puncher.handleAck(&ack)
+		}
+	case MSG_DIVS_KEEPALIVE:
+		var ka Keepalive
+		if err := decodeMsg(message, &ka); err == nil {
+			nm.keepaliver.handleKeepalive(&ka)
+		}
+	case MSG_DIVS_RULES:
+		var rs RuleSet
+		if err := decodeMsg(message, &rs); err == nil {
+			nm.mergeRules(&rs)
+		}
+	case MSG_DIVS_GROUP:
+		var announce GroupAnnounce
+		if err := decodeMsg(message, &announce); err == nil {
+			nm.handleGroupAnnounce(&announce)
+		}
+	case MSG_DIVS_MIRROR:
+		var mp MirroredPacket
+		if err := decodeMsg(message, &mp); err == nil {
+			nm.mirror.Receive(&mp)
+		}
+	case MSG_DIVS_BATCH:
+		msgs, err := unpackBatch(message)
+		if err != nil {
+			log.Debug("Could not unpack batch: %s", err)
+			return
+		}
+		for _, msg := range msgs {
+			if msg[0]&^MSG_FLAG_COMPRESSED == byte(MSG_DIVS_BATCH) {
+				log.Debug("Dropping nested batch")
+				continue
+			}
+			nm.NotifyMsg(msg)
+		}
+	case MSG_DIVS_KEEPALIVE_ACK:
+		var ack KeepaliveAck
+		if err := decodeMsg(message, &ack); err == nil {
+			nm.keepaliver.handleAck(&ack)
+		}
 	default:
 		log.Error("Unknown message received: %s", messageType)
 	}
@@ -211,9 +911,7 @@ func (nm *NodesManager) NotifyMsg(buf []byte) {
 // The total byte size of the resulting data to send must not exceed
 // the limit.
 func (nm *NodesManager) GetBroadcasts(overhead, limit int) [][]byte {
-	log.Debug("Use data can be broadcasted: collecting!")
-	res := make([][]byte, 0)
-	return res
+	return nm.broadcasts.GetBroadcasts(overhead, limit)
 }
 
 // LocalState is used for a TCP Push/Pull. This is sent to
@@ -221,13 +919,24 @@ func (nm *NodesManager) GetBroadcasts(overhead, limit int) [][]byte {
 // data can be sent here. See MergeRemoteState as well. The `join`
 // boolean indicates this is for a join instead of a push/pull.
 func (nm *NodesManager) LocalState(join bool) []byte {
-	res := make([]byte, 0)
 	if join {
 		log.Debug("Gathering local state for joining")
-		// TODO: local state info
 	} else {
 		log.Debug("Gathering local state for TCP Push/Pull")
-		// TODO: local state info
+	}
+
+	state := MacsState{Node: nm.localName, MACs: []string{}, Vlans: []uint16{}, Rules: nm.filter.RuleSet(), Groups: nm.groups.NodeGroups(nm.localName)}
+	nm.mutex.RLock()
+	for key := range nm.localMacs {
+		state.MACs = append(state.MACs, key.MAC)
+		state.Vlans = append(state.Vlans, key.Vlan)
+	}
+	nm.mutex.RUnlock()
+
+	res, err := state.Encode()
+	if err != nil {
+		log.Error("Could not encode local state: %s", err)
+		return make([]byte, 0)
 	}
 	return res
 }
@@ -238,27 +947,79 @@ func (nm *NodesManager) LocalState(join bool) []byte {
 // boolean indicates this is for a join instead of a push/pull.
 func (nm *NodesManager) MergeRemoteState(buf []byte, join bool) {
 	log.Debug("[MergeRemoteState] merging remote state")
-	// TODO: merge remote state
+	messageType, message, err := getTypeAndEncodedMsg(buf)
+	if err != nil || messageType != MSG_DIVS_MACS_STATE {
+		log.Debug("Unknown remote state received")
+		return
+	}
+
+	var state MacsState
+	if err := decodeMsg(message, &state); err != nil {
+		log.Debug("Could not decode remote state: %s", err)
+		return
+	}
+	for i, mac := range state.MACs {
+		vlan := uint16(DEFAULT_VLAN)
+		if i < len(state.Vlans) {
+			vlan = announcedVlan(state.Vlans[i])
+		}
+		nm.learnRemoteMac(vlan, mac, state.Node)
+	}
+	if state.Rules != nil {
+		nm.mergeRules(state.Rules)
+	}
+	if state.Node != nm.localName {
+		nm.groups.SetNode(state.Node, state.Groups)
+	}
 }
 
 // NotifyJoin is invoked when a node is detected to have joined the memberlist.
 // The Node argument must not be modified.
 func (nm *NodesManager) NotifyJoin(node *memberlist.Node) {
-	newNodeAddr := fmt.Sprintf("%s:%d", node.Addr, node.Port)
+	newNodeAddr := node.Address()
 	log.Debug("[NotifyJoin] new node joined: %s", newNodeAddr)
-	nm.joinedChan <- newNodeAddr
+	if node.Name != nm.localName {
+		nm.mutex.Lock()
+		if savedNode, found := nm.nodes[node.Name]; found {
+			savedNode.Update(node)
+		} else {
+			nm.nodes[node.Name] = NewNode(node, nm)
+		}
+		nm.mutex.Unlock()
+	}
+
+	select {
+	case nm.joinedChan <- newNodeAddr:
+	default:
+		// nobody is waiting for new nodes
+	}
 	// TODO: something else to do when someone else joins?
+	if node.Name != nm.localName {
+		go nm.updateRelay()
+	}
 }
 
 // NotifyLeave is invoked when a node is detected to have left.
 // The Node argument must not be modified.
 func (nm *NodesManager) NotifyLeave(node *memberlist.Node) {
 	log.Debug("[NotifyLeave] node %s has been declared as unreachable", node)
-	// TODO: remove all the MACs for this node that has left
-	for savedMac, savedNode := range nm.macsToNodes {
-		if savedNode.Equal(node) {
-			delete(nm.macsToNodes, savedMac)
-		}
+	nm.mutex.Lock()
+	defer nm.mutex.Unlock()
+
+	// remove all the MACs for this node that has left
+	nm.macTable.RemoveNode(node.Name)
+	if savedNode, found := nm.nodes[node.Name]; found {
+		savedNode.Close()
+		delete(nm.nodes, node.Name)
+	}
+	nm.puncher.Forget(node.Name)
+	nm.keepaliver.Forget(node.Name)
+	nm.security.Forget(node.Name)
+	nm.ratelimit.Forget(node.Name)
+	nm.storm.Forget(node.Name)
+	nm.groups.RemoveNode(node.Name)
+	if node.Name == nm.via {
+		go nm.updateRelay()
 	}
 }
 
@@ -267,5 +1028,12 @@ func (nm *NodesManager) NotifyLeave(node *memberlist.Node) {
 // must not be modified.
 func (nm *NodesManager) NotifyUpdate(node *memberlist.Node) {
 	log.Debug("[NotifyUpdate] node %s has updated", node)
-	// TODO: what should we do here?
+	nm.mutex.RLock()
+	savedNode, found := nm.nodes[node.Name]
+	nm.mutex.RUnlock()
+	if found {
+		savedNode.Update(node)
+		nm.macTable.SetVia(node.Name, savedNode.Meta().Via)
+		go nm.updateRelay()
+	}
 }
@@ -0,0 +1,110 @@
+package divsd
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types
+const (
+	PCAPNG_SECTION_HEADER  = 0x0A0D0D0A
+	PCAPNG_INTERFACE_DESC  = 0x00000001
+	PCAPNG_ENHANCED_PACKET = 0x00000006
+	PCAPNG_BYTE_ORDER      = 0x1A2B3C4D
+)
+
+// pcapng options
+const (
+	PCAPNG_OPT_END     = 0
+	PCAPNG_OPT_COMMENT = 1
+	PCAPNG_OPT_IF_NAME = 2
+)
+
+// the link type for Ethernet
+const PCAPNG_LINKTYPE_ETHERNET = 1
+
+// A pcapng writer, with an interface for each capture point
+// See https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+type PcapngWriter struct {
+	w io.Writer
+}
+
+// Create a new pcapng writer, writing the section header and the interfaces
+func NewPcapngWriter(w io.Writer, interfaces []string) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], PCAPNG_BYTE_ORDER)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // version 1.0
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff) // unknown section length
+	if err := pw.writeBlock(PCAPNG_SECTION_HEADER, shb, nil); err != nil {
+		return nil, err
+	}
+
+	for _, name := range interfaces {
+		idb := make([]byte, 8)
+		binary.LittleEndian.PutUint16(idb[0:], PCAPNG_LINKTYPE_ETHERNET)
+		binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length
+		opts := pcapngOption(nil, PCAPNG_OPT_IF_NAME, name)
+		if err := pw.writeBlock(PCAPNG_INTERFACE_DESC, idb, opts); err != nil {
+			return nil, err
+		}
+	}
+	return pw, nil
+}
+
+// Write a frame captured in an interface, with an optional comment
+func (pw *PcapngWriter) WritePacket(iface int, ts time.Time, frame []byte, comment string) error {
+	usecs := uint64(ts.UnixNano() / int64(time.Microsecond))
+	epb := make([]byte, 20, 20+len(frame)+3)
+	binary.LittleEndian.PutUint32(epb[0:], uint32(iface))
+	binary.LittleEndian.PutUint32(epb[4:], uint32(usecs>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(usecs))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(frame)))
+	epb = append(epb, frame...)
+	epb = pad32(epb)
+
+	var opts []byte
+	if len(comment) > 0 {
+		opts = pcapngOption(nil, PCAPNG_OPT_COMMENT, comment)
+	}
+	return pw.writeBlock(PCAPNG_ENHANCED_PACKET, epb, opts)
+}
+
+// write a block: type, total length, body, options and total length again
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte, opts []byte) error {
+	if len(opts) > 0 {
+		opts = append(opts, 0, 0, 0, 0) // PCAPNG_OPT_END, with no value
+	}
+	total := 12 + len(body) + len(opts)
+	block := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], uint32(total))
+	block = append(block, body...)
+	block = append(block, opts...)
+	block = block[:total]
+	binary.LittleEndian.PutUint32(block[total-4:], uint32(total))
+	_, err := pw.w.Write(block)
+	return err
+}
+
+// append an option with a string value
+func pcapngOption(opts []byte, code uint16, value string) []byte {
+	hdr := make([]byte, 4)
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	opts = append(opts, hdr...)
+	opts = append(opts, value...)
+	return pad32(opts)
+}
+
+// pad some data to 32 bits
+func pad32(data []byte) []byte {
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
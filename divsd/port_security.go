@@ -0,0 +1,253 @@
+package divsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions on port security violations
+const (
+	SECURITY_ACTION_DROP       = "drop"       // drop the frame
+	SECURITY_ACTION_LOG        = "log"        // log the violation, but accept the frame
+	SECURITY_ACTION_QUARANTINE = "quarantine" // drop everything from the node for a while
+)
+
+// default time (in seconds) a node is quarantined
+const DEFAULT_QUARANTINE_TIME = 300
+
+// time a MAC accepted from a node is kept without seeing it: older MACs do not
+// count for the maximum number of MACs of the node
+const SECURITY_MAC_AGE = 5 * time.Minute
+
+// parse a MAC address or an OUI (the first three octets of a MAC), returning
+// it in canonical form
+func parseMacOrOui(s string) (res string, isOui bool, err error) {
+	s = strings.TrimSpace(s)
+	if len(s) == len("00:00:00") {
+		mac, err := net.ParseMAC(s + s[2:3] + "00" + s[2:3] + "00" + s[2:3] + "00")
+		if err != nil {
+			return "", false, err
+		}
+		return mac.String()[:len("00:00:00")], true, nil
+	}
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return "", false, fmt.Errorf("invalid MAC address '%s'", s)
+	}
+	return mac.String(), false, nil
+}
+
+// A port security policy: the MACs a node may originate
+type securityPolicy struct {
+	macs       map[string]bool // MACs allowed (any if both this and ouis are empty)
+	ouis       map[string]bool // OUIs allowed
+	maxMacs    int
+	action     string
+	quarantine time.Duration
+}
+
+func newSecurityPolicy(c securityConfig) *securityPolicy {
+	p := &securityPolicy{
+		macs:       make(map[string]bool),
+		ouis:       make(map[string]bool),
+		maxMacs:    c.MaxMacs,
+		action:     c.Action,
+		quarantine: time.Duration(c.Quarantine) * time.Second,
+	}
+	for _, s := range c.Mac {
+		if mac, isOui, err := parseMacOrOui(s); err == nil {
+			if isOui {
+				p.ouis[mac] = true
+			} else {
+				p.macs[mac] = true
+			}
+		}
+	}
+	return p
+}
+
+// check if a MAC is in the allowlist
+func (p *securityPolicy) allows(mac string) bool {
+	if len(p.macs) == 0 && len(p.ouis) == 0 {
+		return true
+	}
+	if len(mac) < len("00:00:00") {
+		return p.macs[mac]
+	}
+	return p.macs[mac] || p.ouis[mac[:len("00:00:00")]]
+}
+
+// The port security: it checks the MACs nodes (including the local node)
+// originate, and it takes the configured action on violations
+type PortSecurity struct {
+	OnQuarantine func(node string) // invoked when a node is quarantined
+
+	config      *Config                         // a copy of the port security settings
+	policies    map[string]*securityPolicy      // the policies used for each node
+	learned     map[string]map[MacKey]time.Time // the MACs accepted from each node (and when they were seen)
+	quarantined map[string]time.Time            // quarantined nodes, and until when (zero: until it leaves)
+	mutex       sync.Mutex
+}
+
+// Create a new port security checker
+func NewPortSecurity(config *Config) *PortSecurity {
+	ps := &PortSecurity{
+		learned:     make(map[string]map[MacKey]time.Time),
+		quarantined: make(map[string]time.Time),
+	}
+	ps.SetConfig(config)
+	return ps
+}
+
+// Set the port security settings (from the [security] and [node] sections)
+// The MACs already accepted and the quarantines are kept: the new policies
+// apply to the MACs seen from now on.
+func (ps *PortSecurity) SetConfig(config *Config) {
+	c := &Config{Security: config.Security, Node: make(map[string]*nodeConfig)}
+	for name, sc := range config.Node {
+		nc := *sc
+		c.Node[name] = &nc
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.config = c
+	ps.policies = make(map[string]*securityPolicy)
+}
+
+// get the policy for a node
+func (ps *PortSecurity) policy(node string) *securityPolicy {
+	p, found := ps.policies[node]
+	if !found {
+		p = newSecurityPolicy(ps.config.NodeSecurity(node))
+		ps.policies[node] = p
+	}
+	return p
+}
+
+// check if a node is quarantined, lifting expired quarantines
+func (ps *PortSecurity) isQuarantined(node string, now time.Time) bool {
+	until, found := ps.quarantined[node]
+	if !found {
+		return false
+	}
+	if !until.IsZero() && now.After(until) {
+		log.Info("Quarantine for %s lifted", node)
+		delete(ps.quarantined, node)
+		return false
+	}
+	return true
+}
+
+// Check if a node can originate a frame (or announce a MAC) in a VLAN,
+// returning `false` if it must be dropped
+func (ps *PortSecurity) Check(node string, vlan uint16, mac string) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	now := time.Now()
+	if ps.isQuarantined(node, now) {
+		metrics.Inc("security.dropped")
+		return false
+	}
+
+	key := MacKey{vlan, mac}
+	learned, found := ps.learned[node]
+	if !found {
+		learned = make(map[MacKey]time.Time)
+		ps.learned[node] = learned
+	}
+	if _, found := learned[key]; found {
+		learned[key] = now
+		return true
+	}
+
+	p := ps.policy(node)
+	if p.maxMacs > 0 && len(learned) >= p.maxMacs {
+		// forget the MACs we have not seen in a while
+		for k, seen := range learned {
+			if now.Sub(seen) > SECURITY_MAC_AGE {
+				delete(learned, k)
+			}
+		}
+	}
+	violation := ""
+	if !p.allows(key.MAC) {
+		violation = fmt.Sprintf("MAC %s not allowed", key.MAC)
+	} else if p.maxMacs > 0 && len(learned) >= p.maxMacs {
+		violation = fmt.Sprintf("MAC %s exceeds the limit of %d MACs", key.MAC, p.maxMacs)
+	}
+	if len(violation) == 0 || p.action == SECURITY_ACTION_LOG {
+		if len(violation) > 0 {
+			metrics.Inc("security.violations")
+			log.Warning("Port security violation by %s: %s", nodeLabel(node), violation)
+		}
+		// the MAC could have moved from other node
+		for other, otherLearned := range ps.learned {
+			if other != node {
+				delete(otherLearned, key)
+			}
+		}
+		learned[key] = now
+		return true
+	}
+
+	metrics.Inc("security.violations")
+	metrics.Inc("security.dropped")
+	if p.action == SECURITY_ACTION_QUARANTINE {
+		until := time.Time{}
+		if p.quarantine > 0 {
+			until = now.Add(p.quarantine)
+		}
+		ps.quarantined[node] = until
+		metrics.Inc("security.quarantined")
+		log.Warning("Port security violation by %s: %s: node quarantined", nodeLabel(node), violation)
+		if ps.OnQuarantine != nil {
+			ps.OnQuarantine(node)
+		}
+	} else {
+		log.Debug("Port security violation by %s: %s: frame dropped", nodeLabel(node), violation)
+	}
+	return false
+}
+
+// Return `true` if a node has been quarantined
+func (ps *PortSecurity) Quarantined(node string) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.isQuarantined(node, time.Now())
+}
+
+// Forget the MACs accepted from a node that has left (and lift any quarantine
+// that lasts as long as the node is in the switch)
+func (ps *PortSecurity) Forget(node string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	delete(ps.learned, node)
+	if until, found := ps.quarantined[node]; found && until.IsZero() {
+		delete(ps.quarantined, node)
+	}
+}
+
+// get a label for a node in log messages
+func nodeLabel(node string) string {
+	if len(node) == 0 {
+		return "unknown node"
+	}
+	return node
+}
+
+// get the names of the nodes with [node] sections, sorted
+func sortedNodeNames(nodes map[string]*nodeConfig) []string {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
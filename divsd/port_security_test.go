@@ -0,0 +1,161 @@
+package divsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestParseMacOrOui(t *testing.T) {
+	for s, expected := range map[string]string{
+		"00:16:3E:01:02:03": "00:16:3e:01:02:03",
+		"00-16-3e":          "00:16:3e",
+		"00:16:3e":          "00:16:3e",
+	} {
+		if res, _, err := parseMacOrOui(s); err != nil || res != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", s, expected, res, err)
+		}
+	}
+	for _, s := range []string{"00:16", "00:16:3g", "00:16:3e:01:02:03:04:05"} {
+		if _, _, err := parseMacOrOui(s); err == nil {
+			t.Errorf("invalid MAC %s not detected", s)
+		}
+	}
+}
+
+func TestPortSecurity(t *testing.T) {
+	c := NewConfig()
+	c.Security.Mac = []string{"00:16:3e", "02:00:00:00:00:01"}
+	c.Node = map[string]*nodeConfig{
+		"limited":  {MaxMacs: 1},
+		"logged":   {Action: SECURITY_ACTION_LOG},
+		"isolated": {Action: SECURITY_ACTION_QUARANTINE},
+	}
+	ps := NewPortSecurity(c)
+
+	// allowlist, with MACs and OUIs
+	if !ps.Check("node1", 1, "00:16:3e:11:22:33") || !ps.Check("node1", 1, "02:00:00:00:00:01") {
+		t.Fatalf("allowed MAC dropped")
+	}
+	if ps.Check("node1", 1, "02:00:00:00:00:02") {
+		t.Fatalf("MAC not allowed accepted")
+	}
+
+	// maximum number of MACs
+	if !ps.Check("limited", 1, "00:16:3e:00:00:01") || !ps.Check("limited", 1, "00:16:3e:00:00:01") {
+		t.Fatalf("first MAC dropped")
+	}
+	if ps.Check("limited", 1, "00:16:3e:00:00:02") {
+		t.Fatalf("MACs limit not enforced")
+	}
+
+	// MACs not seen in a while do not count for the limit
+	ps.learned["limited"][MacKey{1, "00:16:3e:00:00:01"}] = time.Now().Add(-SECURITY_MAC_AGE - time.Second)
+	if !ps.Check("limited", 1, "00:16:3e:00:00:02") {
+		t.Fatalf("MAC dropped after the previous one aged out")
+	}
+	if ps.Check("limited", 1, "00:16:3e:00:00:01") {
+		t.Fatalf("MACs limit not enforced after a MAC aged out")
+	}
+
+	// violations are only logged
+	if !ps.Check("logged", 1, "02:00:00:00:00:02") {
+		t.Fatalf("violation not accepted with the 'log' action")
+	}
+
+	// quarantine
+	quarantined := ""
+	ps.OnQuarantine = func(node string) { quarantined = node }
+	if ps.Check("isolated", 1, "02:00:00:00:00:02") || quarantined != "isolated" {
+		t.Fatalf("node not quarantined")
+	}
+	if ps.Check("isolated", 1, "00:16:3e:00:00:03") {
+		t.Fatalf("allowed MAC accepted from a quarantined node")
+	}
+	ps.quarantined["isolated"] = time.Now().Add(-time.Second)
+	if !ps.Check("isolated", 1, "00:16:3e:00:00:03") || ps.Quarantined("isolated") {
+		t.Fatalf("quarantine not lifted")
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	nm, err := NewNodesManager(NewConfig())
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	nm.localName = "local"
+	for _, name := range []string{"node1", "node2"} {
+		nm.nodes[name] = &Node{Node: &memberlist.Node{Name: name}, meta: &NodeMeta{}}
+	}
+	nm.macTable.Learn(1, "02:00:00:00:00:02", "node2", "")
+
+	for _, test := range []struct {
+		from, mac string
+		expected  bool
+	}{
+		{"node1", "02:00:00:00:00:01", true},
+		{"node2", "02:00:00:00:00:02", true},
+		{"node1", "02:00:00:00:00:02", false}, // the MAC is at node2
+		{"", "02:00:00:00:00:01", false},      // from an old node
+		{"node3", "02:00:00:00:00:01", false}, // not a member
+		{"local", "02:00:00:00:00:01", false},
+	} {
+		if nm.checkSender(test.from, 1, test.mac) != test.expected {
+			t.Errorf("%s from '%s': expected %t", test.mac, test.from, test.expected)
+		}
+	}
+
+	// the owner of a MAC is not trusted once it has left
+	delete(nm.nodes, "node2")
+	if !nm.checkSender("node1", 1, "02:00:00:00:00:02") {
+		t.Errorf("MAC moved from a node that left dropped")
+	}
+}
+
+func TestMalformedMacAnnounce(t *testing.T) {
+	c := NewConfig()
+	c.Security.Mac = []string{"00:16:3e"}
+	nm, err := NewNodesManager(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	nm.localName = "local"
+	nm.nodes["node1"] = &Node{Node: &memberlist.Node{Name: "node1"}, meta: &NodeMeta{}}
+
+	// malformed MACs are ignored (and they are not checked by the port security)
+	for _, mac := range []string{"x", "", "00:16", "00:16:3e:01:02:03:04:05"} {
+		buf, _ := MacAnnounce{MAC: mac, Node: "node1", Vlan: 1}.Encode()
+		nm.NotifyMsg(buf)
+	}
+	if entries := nm.Macs(); len(entries) != 0 {
+		t.Fatalf("malformed MACs learned: %v", entries)
+	}
+	if ps := NewPortSecurity(c); ps.Check("node1", 1, "x") {
+		t.Errorf("short MAC accepted")
+	}
+
+	// valid MACs are learned in canonical form
+	buf, _ := MacAnnounce{MAC: "00-16-3E-01-02-03", Node: "node1", Vlan: 1}.Encode()
+	nm.NotifyMsg(buf)
+	if _, found := nm.macTable.Lookup(1, "00:16:3e:01:02:03"); !found {
+		t.Errorf("valid MAC not learned")
+	}
+}
+
+func TestPortSecuritySetConfig(t *testing.T) {
+	c := NewConfig()
+	c.Security.Mac = []string{"00:16:3e"}
+	ps := NewPortSecurity(c)
+	if ps.Check("node1", 1, "02:00:00:00:00:01") {
+		t.Fatalf("MAC not allowed accepted")
+	}
+
+	// the new policies apply to the MACs seen after the change
+	c = NewConfig()
+	c.Node = map[string]*nodeConfig{"node1": {Mac: []string{"02:00:00:00:00:01"}}}
+	ps.SetConfig(c)
+	if !ps.Check("node1", 1, "02:00:00:00:00:01") {
+		t.Fatalf("MAC allowed by the new config dropped")
+	}
+}
@@ -0,0 +1,270 @@
+package divsd
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/inercia/divs/divsd/nat"
+)
+
+// minimum time between hole punching attempts with the same peer
+const PUNCH_RETRY_INTERVAL = 5 * time.Minute
+
+// number of probes sent to each address when punching
+const PUNCH_PROBES_NUM = 5
+
+// interval between probes
+const PUNCH_PROBE_INTERVAL = 200 * time.Millisecond
+
+// number of ports probed when predicting the port of a symmetric NAT
+const PUNCH_PREDICTION_RANGE = 16
+
+// time a hole punching session is kept waiting for probes
+const PUNCH_SESSION_TTL = 30 * time.Second
+
+// How two nodes can establish a direct path
+type punchStrategy int
+
+const (
+	// both nodes send probes to the external address of the other
+	PUNCH_SIMULTANEOUS punchStrategy = iota
+	// the node behind the symmetric NAT opens a mapping by sending probes and
+	// the other node probes a range of ports around its external port
+	PUNCH_PORT_PREDICTION
+	// there is no way to establish a direct path: keep using the relay
+	PUNCH_IMPOSSIBLE
+)
+
+func (s punchStrategy) String() string {
+	switch s {
+	case PUNCH_SIMULTANEOUS:
+		return "simultaneous"
+	case PUNCH_PORT_PREDICTION:
+		return "port-prediction"
+	}
+	return "impossible"
+}
+
+// Choose the hole punching strategy for the types of NAT of two nodes
+func choosePunchStrategy(a nat.NatType, b nat.NatType) punchStrategy {
+	if a == nat.NAT_TYPE_BLOCKED || b == nat.NAT_TYPE_BLOCKED {
+		return PUNCH_IMPOSSIBLE
+	}
+
+	aSym := !a.DirectlyReachable()
+	bSym := !b.DirectlyReachable()
+	switch {
+	case aSym && bSym:
+		return PUNCH_IMPOSSIBLE
+	case aSym || bSym:
+		// a port-restricted NAT only accepts packets from the exact port
+		// we have sent to, so we cannot probe a range of ports
+		if a == nat.NAT_TYPE_PORT_RESTRICTED || b == nat.NAT_TYPE_PORT_RESTRICTED {
+			return PUNCH_IMPOSSIBLE
+		}
+		return PUNCH_PORT_PREDICTION
+	}
+	return PUNCH_SIMULTANEOUS
+}
+
+// a hole punching session with a peer
+type punchSession struct {
+	peer     string
+	peerAddr *net.UDPAddr
+	peerNat  nat.NatType
+	started  time.Time
+}
+
+// The hole puncher tries to upgrade relayed paths to direct paths.
+// Two nodes that are using a relay for communicating ask that relay (that has
+// a live connection to both) to coordinate the punching: both nodes then send
+// simultaneous UDP probes to the other, and the first probe that gets through
+// establishes the direct path.
+type Puncher struct {
+	nm       *NodesManager
+	attempts map[string]time.Time // last attempt per peer
+	sessions map[uint64]*punchSession
+	mutex    sync.Mutex
+}
+
+// Create a new hole puncher
+func NewPuncher(nm *NodesManager) *Puncher {
+	return &Puncher{
+		nm:       nm,
+		attempts: make(map[string]time.Time),
+		sessions: make(map[uint64]*punchSession),
+	}
+}
+
+// Try to establish a direct path with a node we reach through a relay
+// The coordinator must have a live connection with both nodes.
+func (p *Puncher) Punch(dst *Node, coordinator *Node) {
+	strategy := choosePunchStrategy(nat.DetectedType(), nat.ParseNatType(dst.Meta().NatType))
+	if strategy == PUNCH_IMPOSSIBLE {
+		return
+	}
+
+	p.mutex.Lock()
+	if last, found := p.attempts[dst.Name]; found && time.Since(last) < PUNCH_RETRY_INTERVAL {
+		p.mutex.Unlock()
+		return
+	}
+	p.attempts[dst.Name] = time.Now()
+	p.mutex.Unlock()
+
+	log.Debug("Trying to punch a direct path to %s through %s (%s)", dst.Name, coordinator.Name, strategy)
+	req := PunchRequest{Session: uint64(rand.Int63()), From: p.nm.localName, To: dst.Name}
+	if err := coordinator.Send(&req); err != nil {
+		log.Debug("Could not send punch request to %s: %s", coordinator.Name, err)
+	}
+}
+
+// Forget about previous attempts with a peer
+func (p *Puncher) Forget(peer string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.attempts, peer)
+}
+
+// Coordinate a hole punching between two nodes
+func (p *Puncher) handleRequest(req *PunchRequest) {
+	p.nm.mutex.RLock()
+	from, fromFound := p.nm.nodes[req.From]
+	to, toFound := p.nm.nodes[req.To]
+	p.nm.mutex.RUnlock()
+	if !fromFound || !toFound {
+		log.Debug("Cannot coordinate punching between %s and %s: unknown nodes", req.From, req.To)
+		return
+	}
+
+	log.Debug("Coordinating punching between %s and %s", req.From, req.To)
+	to.Send(&PunchSync{
+		Session:  req.Session,
+		Peer:     from.Name,
+		PeerAddr: from.externalAddr().String(),
+		PeerNat:  from.Meta().NatType,
+	})
+	from.Send(&PunchSync{
+		Session:  req.Session,
+		Peer:     to.Name,
+		PeerAddr: to.externalAddr().String(),
+		PeerNat:  to.Meta().NatType,
+	})
+}
+
+// Start probing a peer, as instructed by the coordinator
+func (p *Puncher) handleSync(msg *PunchSync) {
+	peerAddr, err := net.ResolveUDPAddr("udp", msg.PeerAddr)
+	if err != nil {
+		log.Debug("Invalid address for punching %s: %s", msg.Peer, msg.PeerAddr)
+		return
+	}
+	session := &punchSession{
+		peer:     msg.Peer,
+		peerAddr: peerAddr,
+		peerNat:  nat.ParseNatType(msg.PeerNat),
+		started:  time.Now(),
+	}
+
+	strategy := choosePunchStrategy(nat.DetectedType(), session.peerNat)
+	if strategy == PUNCH_IMPOSSIBLE {
+		log.Debug("Cannot punch a path to %s", msg.Peer)
+		return
+	}
+
+	p.mutex.Lock()
+	p.expireSessions()
+	p.sessions[msg.Session] = session
+	p.mutex.Unlock()
+
+	// when the peer is behind a symmetric NAT, it will use a new external
+	// port for sending to us: we try to guess it by probing a range of ports
+	targets := []*net.UDPAddr{peerAddr}
+	if strategy == PUNCH_PORT_PREDICTION && !session.peerNat.DirectlyReachable() {
+		for i := 1; i < PUNCH_PREDICTION_RANGE && peerAddr.Port+i <= 65535; i++ {
+			targets = append(targets, &net.UDPAddr{IP: peerAddr.IP, Port: peerAddr.Port + i})
+		}
+	}
+
+	go p.sendProbes(msg.Session, targets)
+}
+
+// send the probes to some addresses
+func (p *Puncher) sendProbes(session uint64, targets []*net.UDPAddr) {
+	for i := 0; i < PUNCH_PROBES_NUM; i++ {
+		for _, target := range targets {
+			probe := PunchProbe{Session: session, From: p.nm.localName, ToAddr: target.String()}
+			if data, err := probe.Encode(); err == nil {
+				p.nm.members.SendTo(target, data)
+			}
+		}
+		time.Sleep(PUNCH_PROBE_INTERVAL)
+	}
+}
+
+// A probe from a peer has got through
+func (p *Puncher) handleProbe(probe *PunchProbe) {
+	p.mutex.Lock()
+	session, found := p.sessions[probe.Session]
+	p.mutex.Unlock()
+	if !found || session.peer != probe.From {
+		log.Debug("Probe from %s for unknown session", probe.From)
+		return
+	}
+
+	// the probe tells us the address where the peer can reach us. We can
+	// answer to the peer only if its external address is stable (ie, it is
+	// not behind a symmetric NAT): in that case we have a direct path too.
+	if !session.peerNat.DirectlyReachable() {
+		return
+	}
+	p.upgrade(session.peer, session.peerAddr)
+
+	ack := PunchAck{Session: probe.Session, From: p.nm.localName, ProbeAddr: probe.ToAddr}
+	if data, err := ack.Encode(); err == nil {
+		p.nm.members.SendTo(session.peerAddr, data)
+	}
+}
+
+// A peer has received one of our probes
+func (p *Puncher) handleAck(ack *PunchAck) {
+	p.mutex.Lock()
+	session, found := p.sessions[ack.Session]
+	p.mutex.Unlock()
+	if !found || session.peer != ack.From {
+		log.Debug("Punch ack from %s for unknown session", ack.From)
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", ack.ProbeAddr)
+	if err != nil {
+		return
+	}
+	p.upgrade(session.peer, addr)
+}
+
+// upgrade the path to a peer to a direct path
+func (p *Puncher) upgrade(peer string, addr *net.UDPAddr) {
+	p.nm.mutex.RLock()
+	node, found := p.nm.nodes[peer]
+	p.nm.mutex.RUnlock()
+	if !found {
+		return
+	}
+
+	if current := node.DirectAddr(); current == nil || current.String() != addr.String() {
+		log.Info("Direct path to %s established at %s", peer, addr)
+		node.SetDirectAddr(addr)
+	}
+}
+
+// remove the old sessions
+func (p *Puncher) expireSessions() {
+	for id, session := range p.sessions {
+		if time.Since(session.started) > PUNCH_SESSION_TTL {
+			delete(p.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package divsd
+
+import (
+	"testing"
+
+	"github.com/inercia/divs/divsd/nat"
+)
+
+func TestChoosePunchStrategy(t *testing.T) {
+	cases := []struct {
+		a, b     nat.NatType
+		expected punchStrategy
+	}{
+		{nat.NAT_TYPE_FULL_CONE, nat.NAT_TYPE_PORT_RESTRICTED, PUNCH_SIMULTANEOUS},
+		{nat.NAT_TYPE_UNKNOWN, nat.NAT_TYPE_RESTRICTED, PUNCH_SIMULTANEOUS},
+		{nat.NAT_TYPE_SYMMETRIC, nat.NAT_TYPE_RESTRICTED, PUNCH_PORT_PREDICTION},
+		{nat.NAT_TYPE_FULL_CONE, nat.NAT_TYPE_SYMMETRIC, PUNCH_PORT_PREDICTION},
+		{nat.NAT_TYPE_SYMMETRIC, nat.NAT_TYPE_PORT_RESTRICTED, PUNCH_IMPOSSIBLE},
+		{nat.NAT_TYPE_SYMMETRIC, nat.NAT_TYPE_SYMMETRIC, PUNCH_IMPOSSIBLE},
+		{nat.NAT_TYPE_NONE, nat.NAT_TYPE_BLOCKED, PUNCH_IMPOSSIBLE},
+	}
+
+	for _, c := range cases {
+		if s := choosePunchStrategy(c.a, c.b); s != c.expected {
+			t.Errorf("%s/%s: expected %s, got %s", c.a, c.b, c.expected, s)
+		}
+	}
+}
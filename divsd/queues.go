@@ -0,0 +1,271 @@
+package divsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/gopacket/layers"
+)
+
+// Priority classes for the data sent to other nodes, from the highest to the
+// lowest priority
+const (
+	PRIO_CONTROL     = iota // control messages (keepalives, hole punching...)
+	PRIO_ARP                // ARP and IPv6 neighbor discovery
+	PRIO_INTERACTIVE        // IP packets with a high DSCP (like EF or AF4x)
+	PRIO_BULK               // everything else
+	NUM_PRIO
+)
+
+var prioNames = []string{"control", "arp", "interactive", "bulk"}
+
+// Scheduling modes
+const (
+	QOS_MODE_STRICT   = "strict"   // always send from the highest priority class first
+	QOS_MODE_WEIGHTED = "weighted" // weighted round robin between the classes
+)
+
+// Drop policies for full queues
+const (
+	QOS_DROP_TAIL = "tail" // drop the new data
+	QOS_DROP_HEAD = "head" // drop the oldest data in the queue
+)
+
+// default weights for the weighted scheduling
+const DEFAULT_QOS_WEIGHTS = "8,4,2,1"
+
+// the lowest DSCP considered interactive (CS3 and above, including AF3x, AF4x
+// and EF)
+const DSCP_INTERACTIVE = 24
+
+// parse the weights for the priority classes, as "control,arp,interactive,bulk"
+func parseQosWeights(s string) ([NUM_PRIO]int, error) {
+	var weights [NUM_PRIO]int
+	fields := strings.Split(s, ",")
+	if len(fields) != NUM_PRIO {
+		return weights, fmt.Errorf("%d weights expected", NUM_PRIO)
+	}
+	for i, f := range fields {
+		w, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || w <= 0 {
+			return weights, fmt.Errorf("invalid weight '%s'", f)
+		}
+		weights[i] = w
+	}
+	return weights, nil
+}
+
+// get the DSCP of an IP packet (or -1 if it is not an IP packet)
+func packetDscp(etherType layers.EthernetType, payload []byte) int {
+	switch {
+	case etherType == layers.EthernetTypeIPv4 && len(payload) >= 20:
+		return int(payload[1] >> 2)
+	case etherType == layers.EthernetTypeIPv6 && len(payload) >= 40:
+		return int((payload[0]&0x0f)<<2 | payload[1]>>6)
+	}
+	return -1
+}
+
+// check if a IPv6 packet is a neighbor discovery message
+func isNeighborDiscovery(payload []byte) bool {
+	if len(payload) < 41 || layers.IPProtocol(payload[6]) != layers.IPProtocolICMPv6 {
+		return false
+	}
+	icmpType := payload[40]
+	return icmpType >= 133 && icmpType <= 137 // router/neighbor solicitation/advertisement, redirect
+}
+
+// Get the priority class of an Ethernet packet, optionally using the DSCP of
+// IP packets
+func classifyPacket(pkt *EthernetPacket, useDscp bool) int {
+	etherType, payload := pkt.EthernetType, pkt.Payload
+	if tag, ok := pkt.dot1q(); ok {
+		etherType, payload = tag.Type, tag.Payload
+	}
+	switch {
+	case etherType == layers.EthernetTypeARP:
+		return PRIO_ARP
+	case etherType == layers.EthernetTypeIPv6 && isNeighborDiscovery(payload):
+		return PRIO_ARP
+	case useDscp && packetDscp(etherType, payload) >= DSCP_INTERACTIVE:
+		return PRIO_INTERACTIVE
+	}
+	return PRIO_BULK
+}
+
+// Get the priority class of some data sent to a node
+func classify(data Encodeable, useDscp bool) int {
+	switch d := data.(type) {
+	case *EthernetPacket:
+		return classifyPacket(d, useDscp)
+	case *RelayedPacket:
+		return classifyPacket(&d.Packet, useDscp)
+	case *MirroredPacket:
+		return PRIO_BULK
+	}
+	return PRIO_CONTROL
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// A send queue for a node, with a queue for each priority class
+// Enqueuing never blocks: when the queue for a class is full, the data is
+// dropped following the drop policy.
+type SendQueue struct {
+	mode    string
+	policy  string
+	useDscp bool
+	limit   int
+	weights [NUM_PRIO]int
+	credits [NUM_PRIO]int
+	queues  [NUM_PRIO][]Encodeable
+	dropped [NUM_PRIO]uint64
+	closed  bool
+	notify  chan struct{} // signaled when there is something to send
+	mutex   sync.Mutex
+}
+
+// Create a new send queue
+func NewSendQueue(c qosConfig) *SendQueue {
+	weights, err := parseQosWeights(c.Weights)
+	if err != nil {
+		weights, _ = parseQosWeights(DEFAULT_QOS_WEIGHTS)
+	}
+	return &SendQueue{
+		mode:    c.Mode,
+		policy:  c.Drop,
+		useDscp: c.Dscp,
+		limit:   c.Queue,
+		weights: weights,
+		credits: weights,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Enqueue some data, returning `false` if it has been dropped
+func (q *SendQueue) Push(data Encodeable) bool {
+	class := classify(data, q.useDscp)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return false
+	}
+	if len(q.queues[class]) >= q.limit {
+		atomic.AddUint64(&q.dropped[class], 1)
+		metrics.Inc("qos.dropped." + prioNames[class])
+		if q.policy != QOS_DROP_HEAD {
+			return false
+		}
+		q.queues[class][0] = nil
+		q.queues[class] = q.queues[class][1:]
+	}
+	q.queues[class] = append(q.queues[class], data)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// get the next class to send from (or -1 if everything is empty)
+func (q *SendQueue) next() int {
+	if q.mode == QOS_MODE_STRICT {
+		for class := 0; class < NUM_PRIO; class++ {
+			if len(q.queues[class]) > 0 {
+				return class
+			}
+		}
+		return -1
+	}
+
+	// weighted round robin: each class can send as many items as its weight,
+	// and the credits are refilled when no class with data has credits left
+	for round := 0; round < 2; round++ {
+		for class := 0; class < NUM_PRIO; class++ {
+			if len(q.queues[class]) > 0 && q.credits[class] > 0 {
+				q.credits[class]--
+				return class
+			}
+		}
+		q.credits = q.weights
+	}
+	return -1
+}
+
+// Dequeue the next data to send, waiting until there is something
+// Returns `false` when the queue has been closed and everything has been sent.
+func (q *SendQueue) Pop() (Encodeable, bool) {
+	return q.pop(nil)
+}
+
+// Dequeue the next data to send, waiting until there is something or until
+// some time has passed
+// Returns `false` on timeouts, and when the queue has been closed and
+// everything has been sent.
+func (q *SendQueue) PopTimeout(timeout time.Duration) (Encodeable, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return q.pop(timer.C)
+}
+
+// dequeue the next data, waiting until there is something (or until the
+// timeout channel, if any, fires)
+func (q *SendQueue) pop(timeout <-chan time.Time) (Encodeable, bool) {
+	for {
+		q.mutex.Lock()
+		if class := q.next(); class >= 0 {
+			data := q.queues[class][0]
+			q.queues[class][0] = nil
+			q.queues[class] = q.queues[class][1:]
+			q.mutex.Unlock()
+			return data, true
+		}
+		closed := q.closed
+		q.mutex.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-q.notify:
+		case <-timeout:
+			return nil, false
+		}
+	}
+}
+
+// Close the queue: no more data can be enqueued, and the data already
+// enqueued can still be dequeued
+func (q *SendQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// The state of a send queue, as exposed in the control API
+type SendQueueInfo struct {
+	Queued  map[string]int    `json:"queued"`
+	Dropped map[string]uint64 `json:"dropped"`
+}
+
+// Get the state of the queue
+func (q *SendQueue) Info() SendQueueInfo {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	info := SendQueueInfo{Queued: make(map[string]int), Dropped: make(map[string]uint64)}
+	for class := 0; class < NUM_PRIO; class++ {
+		info.Queued[prioNames[class]] = len(q.queues[class])
+		info.Dropped[prioNames[class]] = atomic.LoadUint64(&q.dropped[class])
+	}
+	return info
+}
@@ -0,0 +1,108 @@
+package divsd
+
+import (
+	"testing"
+
+	"code.google.com/p/gopacket/layers"
+)
+
+func TestClassifyPacket(t *testing.T) {
+	arp := newTestPacket()
+	arp.EthernetType = layers.EthernetTypeARP
+	if class := classify(arp, true); class != PRIO_ARP {
+		t.Errorf("ARP: unexpected class %d", class)
+	}
+
+	ef := newTestTCPPacket(t, 10, "192.168.1.1", 5060)
+	tag, _ := ef.dot1q()
+	tag.Payload[1] = 46 << 2 // EF
+	if class := classify(ef, true); class != PRIO_INTERACTIVE {
+		t.Errorf("EF: unexpected class %d", class)
+	}
+	if class := classify(ef, false); class != PRIO_BULK {
+		t.Errorf("EF without DSCP classification: unexpected class %d", class)
+	}
+	if class := classify(&RelayedPacket{Packet: *newTestTCPPacket(t, 0, "192.168.1.1", 80)}, true); class != PRIO_BULK {
+		t.Errorf("relayed packet: unexpected class %d", class)
+	}
+	if class := classify(&Keepalive{}, true); class != PRIO_CONTROL {
+		t.Errorf("keepalive: unexpected class %d", class)
+	}
+}
+
+func TestSendQueueStrict(t *testing.T) {
+	c := NewConfig().Qos
+	c.Mode = QOS_MODE_STRICT
+	c.Queue = 2
+	q := NewSendQueue(c)
+
+	bulk := newTestPacket()
+	for i := 0; i < 3; i++ {
+		if ok := q.Push(bulk); ok != (i < 2) {
+			t.Fatalf("push %d: unexpected result %t", i, ok)
+		}
+	}
+	keepalive := &Keepalive{}
+	q.Push(keepalive)
+
+	// control messages go first, and nothing blocks
+	if data, _ := q.Pop(); data != keepalive {
+		t.Fatalf("keepalive not sent first")
+	}
+	q.Close()
+	if q.Push(keepalive) {
+		t.Fatalf("data enqueued in a closed queue")
+	}
+	for i := 0; i < 2; i++ {
+		if data, ok := q.Pop(); !ok || data != bulk {
+			t.Fatalf("enqueued data lost after closing the queue")
+		}
+	}
+	if _, ok := q.Pop(); ok {
+		t.Fatalf("data dequeued from an empty closed queue")
+	}
+	if info := q.Info(); info.Dropped["bulk"] != 1 {
+		t.Errorf("unexpected drops: %v", info.Dropped)
+	}
+}
+
+func TestSendQueueWeighted(t *testing.T) {
+	c := NewConfig().Qos
+	c.Weights = "1,1,3,1"
+	c.Drop = QOS_DROP_HEAD
+	q := NewSendQueue(c)
+
+	bulk := newTestPacket()
+	interactive := newTestTCPPacket(t, 0, "192.168.1.1", 22)
+	interactive.Payload[1] = 46 << 2
+	for i := 0; i < 8; i++ {
+		q.Push(bulk)
+		q.Push(interactive)
+	}
+
+	// 3 interactive packets for each bulk packet
+	classes := ""
+	for i := 0; i < 8; i++ {
+		data, _ := q.Pop()
+		if data == bulk {
+			classes += "b"
+		} else {
+			classes += "i"
+		}
+	}
+	if classes != "iiibiiib" {
+		t.Errorf("unexpected scheduling: %s", classes)
+	}
+
+	// with the head drop policy, the oldest data is dropped
+	c.Queue = 1
+	q = NewSendQueue(c)
+	other := newTestPacket()
+	q.Push(bulk)
+	if !q.Push(other) {
+		t.Fatalf("new data dropped with the head drop policy")
+	}
+	if data, _ := q.Pop(); data != other {
+		t.Errorf("oldest data not dropped")
+	}
+}
@@ -0,0 +1,184 @@
+package divsd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// the minimum capacity (in bytes) of a rate limit bucket, so the largest frame
+// can always get through
+const RATELIMIT_MIN_BURST = TAP_BUFFER_LEN
+
+// the maximum number of local MACs with their own budgets: the traffic from
+// other MACs shares a single budget while the table is full
+const RATELIMIT_MAX_MACS = 4096
+
+// the interval for forgetting the budgets of the MACs that have been idle
+const RATELIMIT_PURGE_INTERVAL = time.Minute
+
+// A pair of token buckets: one for unicast traffic and another one for
+// broadcast/multicast traffic (nil when there is no limit)
+type rateBudget struct {
+	unicast   *ratelimit.Bucket
+	broadcast *ratelimit.Bucket
+}
+
+// create a token bucket for some kilobytes per second (or nil for no limit)
+func newRateBucket(kbps int) *ratelimit.Bucket {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1024
+	capacity := int64(rate)
+	if capacity < RATELIMIT_MIN_BURST {
+		capacity = RATELIMIT_MIN_BURST
+	}
+	return ratelimit.NewBucketWithRate(rate, capacity)
+}
+
+func newRateBudget(unicast, broadcast int) *rateBudget {
+	return &rateBudget{
+		unicast:   newRateBucket(unicast),
+		broadcast: newRateBucket(broadcast),
+	}
+}
+
+// check if the budget is full (so it is the same as a new one)
+func (b *rateBudget) full() bool {
+	for _, bucket := range []*ratelimit.Bucket{b.unicast, b.broadcast} {
+		if bucket != nil && bucket.Available() < bucket.Capacity() {
+			return false
+		}
+	}
+	return true
+}
+
+// get the bucket for some kind of traffic
+func (b *rateBudget) bucket(broadcast bool) *ratelimit.Bucket {
+	if broadcast {
+		return b.broadcast
+	}
+	return b.unicast
+}
+
+// The rate limiter for the traffic sent to other nodes: the traffic is limited
+// globally, for each remote node (with the limits in its [node] section, if
+// any) and for each local source MAC (in each VLAN), with separate budgets for
+// broadcast/multicast traffic. Packets exceeding any of the budgets are dropped.
+type RateLimiter struct {
+	config   *Config // a copy of the rate limits
+	global   *rateBudget
+	nodes    map[string]*rateBudget
+	macs     map[MacKey]*rateBudget
+	overflow *rateBudget // shared by the MACs that do not fit in `macs`
+	purged   time.Time   // when the idle MACs were forgotten
+	mutex    sync.Mutex
+}
+
+// Create a new rate limiter
+func NewRateLimiter(config *Config) *RateLimiter {
+	rl := &RateLimiter{}
+	rl.SetConfig(config)
+	return rl
+}
+
+// Replace the rate limits (from the [ratelimit] and [node] sections),
+// resetting all the budgets
+func (rl *RateLimiter) SetConfig(config *Config) {
+	c := &Config{Ratelimit: config.Ratelimit, Node: make(map[string]*nodeConfig)}
+	for name, nc := range config.Node {
+		cp := *nc
+		c.Node[name] = &cp
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.config = c
+	rl.global = newRateBudget(c.Ratelimit.Global, c.Ratelimit.GlobalBroadcast)
+	rl.nodes = make(map[string]*rateBudget)
+	rl.macs = make(map[MacKey]*rateBudget)
+	rl.overflow = newRateBudget(c.Ratelimit.Mac, c.Ratelimit.MacBroadcast)
+	rl.purged = time.Now()
+}
+
+// Check if we can send some bytes to a node, consuming them from the budgets
+// The source MAC is only limited for packets originated in this node (so it
+// must be empty for packets we are relaying).
+func (rl *RateLimiter) Allow(node string, srcMac string, vlan uint16, broadcast bool, size int) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	buckets := make([]*ratelimit.Bucket, 0, 3)
+	if b := rl.global.bucket(broadcast); b != nil {
+		buckets = append(buckets, b)
+	}
+	budget, found := rl.nodes[node]
+	if !found {
+		budget = newRateBudget(rl.config.NodeRateLimits(node))
+		rl.nodes[node] = budget
+	}
+	if b := budget.bucket(broadcast); b != nil {
+		buckets = append(buckets, b)
+	}
+	if len(srcMac) > 0 && (rl.config.Ratelimit.Mac > 0 || rl.config.Ratelimit.MacBroadcast > 0) {
+		if b := rl.macBudget(MacKey{vlan, srcMac}).bucket(broadcast); b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+
+	// do not consume anything unless all the budgets allow the packet
+	for _, b := range buckets {
+		if b.Available() < int64(size) {
+			metrics.Inc("ratelimit.dropped")
+			if broadcast {
+				metrics.Inc("ratelimit.dropped_broadcast")
+			}
+			return false
+		}
+	}
+	for _, b := range buckets {
+		b.TakeAvailable(int64(size))
+	}
+	return true
+}
+
+// get the budget for a local MAC, creating it if there is room for it
+func (rl *RateLimiter) macBudget(key MacKey) *rateBudget {
+	if budget, found := rl.macs[key]; found {
+		return budget
+	}
+	now := time.Now()
+	elapsed := now.Sub(rl.purged)
+	if elapsed >= RATELIMIT_PURGE_INTERVAL || (len(rl.macs) >= RATELIMIT_MAX_MACS && elapsed >= time.Second) {
+		// the budgets that have been refilled are the same as new ones
+		for k, budget := range rl.macs {
+			if budget.full() {
+				delete(rl.macs, k)
+			}
+		}
+		rl.purged = now
+	}
+	if len(rl.macs) >= RATELIMIT_MAX_MACS {
+		metrics.Inc("ratelimit.overflow")
+		return rl.overflow
+	}
+	budget := newRateBudget(rl.config.Ratelimit.Mac, rl.config.Ratelimit.MacBroadcast)
+	rl.macs[key] = budget
+	return budget
+}
+
+// Forget the budget for a node that has left
+func (rl *RateLimiter) Forget(node string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	delete(rl.nodes, node)
+}
+
+// Forget the budget for a local MAC
+func (rl *RateLimiter) ForgetMac(vlan uint16, mac string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	delete(rl.macs, MacKey{vlan, mac})
+}
@@ -0,0 +1,86 @@
+package divsd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(&Config{Ratelimit: rateLimitConfig{Node: 10, MacBroadcast: 20}})
+
+	// each node has its own budget (10KB, plus the minimum burst)
+	if !rl.Allow("node1", "", 1, false, RATELIMIT_MIN_BURST) {
+		t.Fatalf("first packet to node1 dropped")
+	}
+	if rl.Allow("node1", "", 1, false, RATELIMIT_MIN_BURST) {
+		t.Errorf("packet to node1 over the budget not dropped")
+	}
+	if !rl.Allow("node2", "", 1, false, RATELIMIT_MIN_BURST) {
+		t.Errorf("packet to node2 dropped")
+	}
+
+	// broadcasts do not use the unicast budget
+	if !rl.Allow("node1", "", 1, true, RATELIMIT_MIN_BURST) {
+		t.Errorf("broadcast to node1 dropped")
+	}
+
+	// broadcasts from a local MAC are limited, whatever the destination is
+	mac := "02:00:00:00:00:01"
+	sent := 0
+	for _, node := range []string{"node3", "node4", "node5", "node6"} {
+		if rl.Allow(node, mac, 1, true, 10*1024) {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Errorf("unexpected number of broadcasts sent from %s: %d", mac, sent)
+	}
+	if !rl.Allow("node6", "02:00:00:00:00:02", 1, true, 10*1024) {
+		t.Errorf("broadcast from other MAC dropped")
+	}
+	if !rl.Allow("node6", mac, 2, true, 10*1024) {
+		t.Errorf("broadcast from %s in other VLAN dropped", mac)
+	}
+	rl.ForgetMac(1, mac)
+	if !rl.Allow("node6", mac, 1, true, 10*1024) {
+		t.Errorf("broadcast from %s dropped after forgetting it", mac)
+	}
+
+	// new limits reset the budgets
+	rl.SetConfig(&Config{})
+	for i := 0; i < 10; i++ {
+		if !rl.Allow("node1", mac, 1, false, RATELIMIT_MIN_BURST) {
+			t.Fatalf("packet dropped without limits")
+		}
+	}
+}
+
+func TestRateLimiterNodes(t *testing.T) {
+	c := &Config{Ratelimit: rateLimitConfig{Node: 10}}
+	c.Node = map[string]*nodeConfig{"node1": {Ratelimit: 100}}
+	rl := NewRateLimiter(c)
+
+	// node1 has its own limit, the other nodes the one in [ratelimit]
+	if !rl.Allow("node1", "", 1, false, 50*1024) {
+		t.Errorf("packet to node1 under its limit dropped")
+	}
+	if rl.Allow("node2", "", 1, false, 50*1024) {
+		t.Errorf("packet to node2 over the limit not dropped")
+	}
+}
+
+func TestRateLimiterMacsOverflow(t *testing.T) {
+	rl := NewRateLimiter(&Config{Ratelimit: rateLimitConfig{Mac: 10}})
+	for i := 0; i < RATELIMIT_MAX_MACS+10; i++ {
+		mac := fmt.Sprintf("02:00:00:00:%02x:%02x", i>>8, i&0xff)
+		rl.Allow("node1", mac, 1, false, RATELIMIT_MIN_BURST)
+	}
+	if len(rl.macs) != RATELIMIT_MAX_MACS {
+		t.Fatalf("unexpected number of MACs with budgets: %d", len(rl.macs))
+	}
+
+	// the MACs that do not fit share a budget
+	if rl.Allow("node1", "02:00:00:01:00:00", 1, false, RATELIMIT_MIN_BURST) {
+		t.Errorf("packet from a MAC over the shared budget not dropped")
+	}
+}
@@ -0,0 +1,154 @@
+package divsd
+
+import (
+	"github.com/inercia/divs/divsd/nat"
+)
+
+// maximum number of relays a packet can go through
+const RELAY_MAX_HOPS = 2
+
+// Choose a relay for reaching the local node, among the peers that provide the
+// relay capability and are directly reachable. Relays in the same site (or
+// region) are preferred, and ties are broken by name so all the nodes with the
+// same view choose the same relay.
+func chooseRelay(local *NodeMeta, peers []*NodeMeta) string {
+	best := ""
+	bestScore := -1
+	for _, peer := range peers {
+		if !peer.HasCapability(CAP_RELAY) || len(peer.Via) > 0 {
+			continue
+		}
+		if !nat.ParseNatType(peer.NatType).DirectlyReachable() {
+			continue
+		}
+
+		score := 0
+		if len(local.Site) > 0 && peer.Site == local.Site {
+			score += 2
+		}
+		if len(local.Region) > 0 && peer.Region == local.Region {
+			score += 1
+		}
+		if score > bestScore || (score == bestScore && peer.Name < best) {
+			best = peer.Name
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// Update the relay other nodes must use for reaching us
+// A relay is needed when we are behind a NAT that does not allow other nodes
+// to reach us directly (ie, a symmetric NAT), unless a relay has been forced
+// in the configuration.
+func (nm *NodesManager) updateRelay() {
+	nm.mutex.RLock()
+	via := nm.relay.Via
+	nm.mutex.RUnlock()
+	if len(via) == 0 && !nat.DetectedType().DirectlyReachable() {
+		peers := []*NodeMeta{}
+		for _, peer := range nm.Peers() {
+			peers = append(peers, peer.Meta)
+		}
+		via = chooseRelay(nm.LocalMeta(), peers)
+		if len(via) == 0 {
+			log.Warning("Behind a %s NAT but no relay available: we will not be reachable",
+				nat.DetectedType())
+		}
+	}
+
+	nm.mutex.Lock()
+	changed := via != nm.via
+	nm.via = via
+	nm.mutex.Unlock()
+
+	if changed {
+		if len(via) > 0 {
+			log.Info("Using relay %s for being reachable", via)
+		} else {
+			log.Info("Not using a relay")
+		}
+		if err := nm.UpdateMeta(); err != nil {
+			log.Warning("Could not update the node metadata: %s", err)
+		}
+	}
+}
+
+// Get the next hop for sending to a node: the node itself, or a relay when
+// that node (or this node) is not directly reachable
+func (nm *NodesManager) nextHop(dst *Node) *Node {
+	if dst.DirectAddr() != nil || dst.ipv6Addr() != nil {
+		return dst // we have punched a direct path, or we can use IPv6
+	}
+
+	nm.mutex.RLock()
+	defer nm.mutex.RUnlock()
+
+	via := nm.via
+	if len(via) == 0 {
+		via = dst.Meta().Via
+	}
+	if len(via) == 0 || via == dst.Name || via == nm.localName {
+		return dst
+	}
+	if relay, found := nm.nodes[via]; found {
+		return relay
+	}
+	log.Debug("Relay %s for %s not found: trying to send directly", via, dst.Name)
+	return dst
+}
+
+// Send an ethernet packet to a node, through a relay if necessary
+func (nm *NodesManager) sendToNode(dst *Node, packet *EthernetPacket) error {
+	if !dst.Meta().HasFeature(FEATURE_VLAN) {
+		packet = packet.Untag() // only packets in the default VLAN get here
+	}
+	hop := nm.nextHop(dst)
+	if hop == dst {
+		return dst.Send(packet)
+	}
+
+	// try to upgrade to a direct path, coordinated by the relay
+	nm.puncher.Punch(dst, hop)
+	return hop.Send(&RelayedPacket{From: nm.localName, To: dst.Name, Packet: *packet})
+}
+
+// Process a relayed packet: deliver it if we are the final destination, or
+// forward it otherwise
+func (nm *NodesManager) handleRelayed(rp *RelayedPacket) {
+	if rp.To == nm.localName {
+		log.Debug("Packet from %s received through a relay", rp.From)
+		nm.deliver(rp.From, &rp.Packet)
+		return
+	}
+
+	nm.mutex.RLock()
+	enabled := nm.relay.Enabled
+	nm.mutex.RUnlock()
+	if !enabled {
+		log.Debug("Dropping packet from %s to %s: relay not enabled", rp.From, rp.To)
+		return
+	}
+	if rp.Hops >= RELAY_MAX_HOPS {
+		log.Debug("Dropping packet from %s to %s: too many hops", rp.From, rp.To)
+		return
+	}
+
+	nm.mutex.RLock()
+	dst, found := nm.nodes[rp.To]
+	nm.mutex.RUnlock()
+	if !found {
+		log.Debug("Dropping packet from %s to unknown node %s", rp.From, rp.To)
+		return
+	}
+
+	rp.Hops++
+	hop := dst
+	if via := dst.Meta().Via; len(via) > 0 && via != nm.localName {
+		hop = nm.nextHop(dst)
+	}
+	log.Debug("Relaying packet from %s to %s (through %s)", rp.From, rp.To, hop.Name)
+	if err := hop.Send(rp); err != nil {
+		log.Debug("Could not relay packet to %s: %s", rp.To, err)
+	}
+}
@@ -0,0 +1,29 @@
+package divsd
+
+import (
+	"testing"
+)
+
+func TestChooseRelay(t *testing.T) {
+	local := &NodeMeta{Name: "local", Site: "bcn", Region: "eu"}
+	peers := []*NodeMeta{
+		{Name: "no-relay", Site: "bcn", Region: "eu"},
+		{Name: "symmetric", Site: "bcn", Region: "eu", Capabilities: []string{CAP_RELAY}, NatType: "symmetric"},
+		{Name: "relayed", Site: "bcn", Region: "eu", Capabilities: []string{CAP_RELAY}, Via: "other"},
+		{Name: "relay-b", Region: "us", Capabilities: []string{CAP_RELAY}},
+		{Name: "relay-a", Region: "us", Capabilities: []string{CAP_RELAY}},
+	}
+
+	if relay := chooseRelay(local, peers); relay != "relay-a" {
+		t.Fatalf("unexpected relay %s", relay)
+	}
+
+	peers = append(peers, &NodeMeta{Name: "relay-z", Region: "eu", Capabilities: []string{CAP_RELAY}, NatType: "full-cone"})
+	if relay := chooseRelay(local, peers); relay != "relay-z" {
+		t.Fatalf("relay in the same region not preferred: %s", relay)
+	}
+
+	if relay := chooseRelay(local, peers[:3]); relay != "" {
+		t.Fatalf("unexpected relay %s", relay)
+	}
+}
@@ -0,0 +1,301 @@
+package divsd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/inercia/divs/divsd/nat"
+)
+
+// a function that applies a changed setting to a running server
+type reloadFunc func(s *Server, config *Config) error
+
+// The settings that can be changed in a running server, with the functions
+// that apply them. Any other setting requires a restart.
+var reloaders = map[string]reloadFunc{
+	"global.loglevel": func(s *Server, config *Config) error {
+		if err := SetLogLevel(config.Global.LogLevel); err != nil {
+			return err
+		}
+		s.config.Global.LogLevel = config.Global.LogLevel
+		return nil
+	},
+	"global.site": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Global.Site = config.Global.Site
+			sw.nodesManager.SetLabels(sw.config.Global.Site, sw.config.Global.Region)
+			return sw.nodesManager.UpdateMeta()
+		})
+	},
+	"global.region": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Global.Region = config.Global.Region
+			sw.nodesManager.SetLabels(sw.config.Global.Site, sw.config.Global.Region)
+			return sw.nodesManager.UpdateMeta()
+		})
+	},
+	"relay.enabled": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Relay.Enabled = config.Relay.Enabled
+			sw.nodesManager.SetRelay(sw.config.Relay)
+			return sw.nodesManager.UpdateMeta()
+		})
+	},
+	"relay.via": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Relay.Via = config.Relay.Via
+			sw.nodesManager.SetRelay(sw.config.Relay)
+			sw.nodesManager.updateRelay()
+			return nil
+		})
+	},
+	"discover.peer": func(s *Server, config *Config) error {
+		newPeers := []string{}
+		for _, peer := range config.Discover.Peer {
+			if !containsString(s.config.Discover.Peer, peer) {
+				newPeers = append(newPeers, peer)
+			}
+		}
+		s.switches[DEFAULT_SWITCH].nodesManager.JoinPeers(newPeers)
+		s.config.Discover.Peer = config.Discover.Peer
+		return nil
+	},
+	"nat.stunserver": func(s *Server, config *Config) error {
+		nat.SetStunServers(config.Nat.StunServer)
+		s.config.Nat.StunServer = config.Nat.StunServer
+		return nil
+	},
+	"crypto.key": func(s *Server, config *Config) error {
+		if err := s.switches[DEFAULT_SWITCH].nodesManager.UpdateKeys(config.Crypto.Key); err != nil {
+			return err
+		}
+		s.config.Crypto.Key = config.Crypto.Key
+		return nil
+	},
+	"filter.default": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Filter.Default = config.Filter.Default
+			return sw.nodesManager.filter.SetRules(config.Filter.Default, sw.config.Filter.Rule)
+		})
+	},
+	"filter.rule": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Filter.Rule = config.Filter.Rule
+			return sw.nodesManager.filter.SetRules(sw.config.Filter.Default, config.Filter.Rule)
+		})
+	},
+	"filter.shared": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Filter.Shared = config.Filter.Shared
+			return sw.nodesManager.PublishRules(config.Filter.Shared)
+		})
+	},
+	"security.mac":              reloadPortSecurity,
+	"security.maxmacs":          reloadPortSecurity,
+	"security.action":           reloadPortSecurity,
+	"security.quarantine":       reloadPortSecurity,
+	"node":                      reloadNodes,
+	"ratelimit.global":          reloadRateLimits,
+	"ratelimit.node":            reloadRateLimits,
+	"ratelimit.mac":             reloadRateLimits,
+	"ratelimit.globalbroadcast": reloadRateLimits,
+	"ratelimit.nodebroadcast":   reloadRateLimits,
+	"ratelimit.macbroadcast":    reloadRateLimits,
+	"storm.broadcast":           reloadStormControl,
+	"storm.multicast":           reloadStormControl,
+	"storm.unknown":             reloadStormControl,
+	"storm.flaps":               reloadStormControl,
+	"storm.flapwindow":          reloadStormControl,
+	"storm.action":              reloadStormControl,
+	"storm.block":               reloadStormControl,
+	"snooping.enabled": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Snooping.Enabled = config.Snooping.Enabled
+			sw.nodesManager.groups.SetConfig(sw.config.Snooping)
+			return sw.nodesManager.UpdateMeta()
+		})
+	},
+	"snooping.timeout": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Snooping.Timeout = config.Snooping.Timeout
+			sw.nodesManager.groups.SetConfig(sw.config.Snooping)
+			return nil
+		})
+	},
+	"compression.enabled": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Compression = config.Compression
+			sw.nodesManager.compressor.SetConfig(config.Compression)
+			return sw.nodesManager.UpdateMeta()
+		})
+	},
+	"compression.min": func(s *Server, config *Config) error {
+		return s.forEachSwitch(func(sw *Switch) error {
+			sw.config.Compression = config.Compression
+			sw.nodesManager.compressor.SetConfig(config.Compression)
+			return nil
+		})
+	},
+	"switch": func(s *Server, config *Config) error {
+		// switches removed (or changed) are stopped, and new ones are started
+		ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_LEAVE_TIMEOUT)
+		defer cancel()
+		// switches added with the control API are kept, so they must not
+		// conflict with the switches in the new configuration
+		all := *config
+		all.Switch = make(map[string]*switchConfig)
+		for name, sc := range config.Switch {
+			all.Switch[name] = sc
+		}
+		for name, sc := range s.dynamic {
+			if _, found := config.Switch[name]; found {
+				return fmt.Errorf("switch %s was added with the control API", name)
+			}
+			all.Switch[name] = sc
+		}
+		if err := all.Validate(); err != nil {
+			return err
+		}
+
+		for name, sc := range s.config.Switch {
+			if newSc, found := config.Switch[name]; !found || !reflect.DeepEqual(sc, newSc) {
+				if err := s.removeSwitch(ctx, name); err != nil {
+					log.Warning("Error when stopping switch %s: %s", name, err)
+				}
+			}
+		}
+		s.config.Switch = config.Switch
+		for _, name := range sortedSwitchNames(config.Switch) {
+			if _, running := s.switches[name]; !running {
+				if err := s.addSwitch(name, s.config.SwitchConfig(name)); err != nil {
+					return fmt.Errorf("switch %s: %s", name, err)
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// apply the new port security settings (all of them, as the policies are
+// rebuilt anyway)
+func reloadPortSecurity(s *Server, config *Config) error {
+	return s.forEachSwitch(func(sw *Switch) error {
+		sw.config.Security = config.Security
+		sw.config.Node = config.Node
+		sw.nodesManager.security.SetConfig(config)
+		return nil
+	})
+}
+
+// apply the new [node] sections: the port security and the rate limits
+func reloadNodes(s *Server, config *Config) error {
+	if err := reloadPortSecurity(s, config); err != nil {
+		return err
+	}
+	return reloadRateLimits(s, config)
+}
+
+// apply the new rate limits (all of them, as the budgets are reset anyway)
+func reloadRateLimits(s *Server, config *Config) error {
+	return s.forEachSwitch(func(sw *Switch) error {
+		sw.config.Ratelimit = config.Ratelimit
+		sw.nodesManager.ratelimit.SetConfig(config)
+		return nil
+	})
+}
+
+// apply the new storm control settings
+func reloadStormControl(s *Server, config *Config) error {
+	return s.forEachSwitch(func(sw *Switch) error {
+		sw.config.Storm = config.Storm
+		sw.nodesManager.storm.SetConfig(config.Storm)
+		return nil
+	})
+}
+
+// apply a change to all the switches
+func (s *Server) forEachSwitch(apply func(sw *Switch) error) error {
+	for _, sw := range s.sortedSwitches() {
+		if err := apply(sw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the list of settings (as "section.key") that are different in two configurations
+func diffConfig(oldConfig *Config, newConfig *Config) []string {
+	changed := []string{}
+
+	oldV := reflect.ValueOf(oldConfig).Elem()
+	newV := reflect.ValueOf(newConfig).Elem()
+	for i := 0; i < oldV.NumField(); i++ {
+		sectionName := strings.ToLower(oldV.Type().Field(i).Name)
+		oldSection := oldV.Field(i)
+		newSection := newV.Field(i)
+
+		if oldSection.Kind() != reflect.Struct {
+			if !reflect.DeepEqual(oldSection.Interface(), newSection.Interface()) {
+				changed = append(changed, sectionName)
+			}
+			continue
+		}
+
+		for j := 0; j < oldSection.NumField(); j++ {
+			if !reflect.DeepEqual(oldSection.Field(j).Interface(), newSection.Field(j).Interface()) {
+				key := sectionName + "." + strings.ToLower(oldSection.Type().Field(j).Name)
+				changed = append(changed, key)
+			}
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// Reload the configuration
+// The settings that can be changed safely are applied to the running server,
+// and the list of changed settings that require a restart is returned. The
+// settings that could not be applied are returned as ConfigErrors.
+func (s *Server) Reload(config *Config) (restart []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return nil, ERR_SERVER_CLOSED
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// a setting that cannot be applied does not stop the reload: the errors
+	// are returned (with the settings that failed) once all the other
+	// settings have been applied
+	errs := ConfigErrors{}
+	changed := diffConfig(s.config, config)
+	log.Info("Reloading configuration: %d settings changed", len(changed))
+	for _, key := range changed {
+		reloader, found := reloaders[key]
+		if !found {
+			restart = append(restart, key)
+			continue
+		}
+
+		log.Debug("Applying new value for %s", key)
+		switch err := reloader(s, config); err {
+		case nil:
+		case ERR_RESTART_REQUIRED:
+			restart = append(restart, key)
+		default:
+			log.Error("Could not apply new value for %s: %s", key, err)
+			errs.add(key, "%s", err)
+		}
+	}
+	if len(errs) > 0 {
+		return restart, errs
+	}
+	return restart, nil
+}
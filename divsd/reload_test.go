@@ -0,0 +1,110 @@
+package divsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := NewConfig()
+	old.Global.Port = 7946
+	old.Discover.Peer = []string{"10.0.0.1:7946"}
+
+	new := NewConfig()
+	new.Global.Port = 7946
+	new.Global.LogLevel = "debug"
+	new.Discover.Peer = []string{"10.0.0.1:7946", "10.0.0.2:7946"}
+	new.Tun.NumReaders = 4
+
+	changed := diffConfig(old, new)
+	expected := []string{"discover.peer", "global.loglevel", "tun.numreaders"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Fatalf("Unexpected changes: %v", changed)
+	}
+
+	if len(diffConfig(new, new)) != 0 {
+		t.Fatalf("Changes detected in the same config")
+	}
+}
+
+func TestReloadContinuesOnErrors(t *testing.T) {
+	s := &Server{config: NewConfig(), switches: map[string]*Switch{}}
+
+	// the settings after the one that fails are still applied
+	saved := map[string]reloadFunc{"global.region": reloaders["global.region"], "global.site": reloaders["global.site"]}
+	defer func() {
+		for key, f := range saved {
+			reloaders[key] = f
+		}
+	}()
+	reloaders["global.region"] = func(s *Server, config *Config) error {
+		return fmt.Errorf("failed")
+	}
+	reloaders["global.site"] = func(s *Server, config *Config) error {
+		s.config.Global.Site = config.Global.Site
+		return nil
+	}
+
+	config := NewConfig()
+	config.Global.Region = "eu"
+	config.Global.Site = "dc1"
+	config.Global.Host = "example.com"
+	restart, err := s.Reload(config)
+	if !reflect.DeepEqual(restart, []string{"global.host"}) {
+		t.Errorf("unexpected settings requiring a restart: %v", restart)
+	}
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Key != "global.region" {
+		t.Errorf("unexpected errors: %v", err)
+	}
+	if s.config.Global.Site != "dc1" {
+		t.Errorf("setting after the failed one not applied")
+	}
+}
+
+// get the settings marked as [reloadable] in the sample configuration file:
+// the markers apply to the settings in the same paragraph, and a marker for a
+// section with a name (like [node "x"]) applies to the whole section
+func documentedReloadable(t *testing.T, path string) map[string]bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read %s: %s", path, err)
+	}
+	sectionRe := regexp.MustCompile(`^;?\[([a-z]+)( "[^"]*")?\]$`)
+	settingRe := regexp.MustCompile(`^;?([a-z0-9]+) *=`)
+
+	res := map[string]bool{}
+	section, named := "", false
+	for _, paragraph := range strings.Split(string(data), "\n\n") {
+		marked := strings.Contains(paragraph, "[reloadable")
+		for _, line := range strings.Split(paragraph, "\n") {
+			if m := sectionRe.FindStringSubmatch(line); m != nil {
+				section, named = m[1], len(m[2]) > 0
+				if marked && named {
+					res[section] = true
+				}
+			} else if m := settingRe.FindStringSubmatch(line); m != nil && marked && !named {
+				res[section+"."+m[1]] = true
+			}
+		}
+	}
+	return res
+}
+
+func TestReloadableDocumented(t *testing.T) {
+	documented := documentedReloadable(t, "../conf/etc/divsd.conf")
+	for key := range reloaders {
+		if !documented[key] {
+			t.Errorf("%s can be reloaded, but it is not marked as [reloadable]", key)
+		}
+	}
+	for key := range documented {
+		if _, found := reloaders[key]; !found {
+			t.Errorf("%s is marked as [reloadable], but it cannot be reloaded", key)
+		}
+	}
+}
@@ -15,7 +15,6 @@ var ERR_CAN_NOT_DISCOVER_DHT = errors.New("Could not discover with DHT")
 
 const DEFAULT_DHT_NODE = "213.239.195.138:40000"
 
-//
 const DISCOVERY_MIN_PEERS = 1
 
 type DhtService struct {
@@ -23,6 +22,9 @@ type DhtService struct {
 	ih            dht.InfoHash
 	discoveryAddr string
 
+	dht      *dht.DHT
+	stopChan chan struct{}
+
 	announcing  bool
 	discovering bool
 }
@@ -52,6 +54,7 @@ func NewDhtService(discoveryAddr string, id string) (*DhtService, error) {
 		id:            id,
 		ih:            ih,
 		discoveryAddr: discoveryAddr,
+		stopChan:      make(chan struct{}),
 	}
 	return &d, nil
 }
@@ -76,13 +79,22 @@ func (srv *DhtService) AnnounceAndDiscover(external string, discoveries chan str
 	log.Debug("Adding DHT node %s...", DEFAULT_DHT_NODE)
 	dhtService.AddNode(DEFAULT_DHT_NODE)
 
+	srv.dht = dhtService
+	srv.discovering = true
+
 	go dhtService.DoDHT()
 	go srv.peersDiscoveryWorker(dhtService, discoveries) // obtain peers from the DHT network
 
 	return nil
 }
 
+// Stop discovering peers and leave the DHT network
 func (srv *DhtService) Leave() error {
+	if srv.discovering {
+		close(srv.stopChan)
+		srv.dht.Stop()
+		srv.discovering = false
+	}
 	return nil
 }
 
@@ -100,11 +112,18 @@ func (srv *DhtService) peersDiscoveryWorker(d *dht.DHT, discoveries chan string)
 					address := dht.DecodePeerAddress(x)
 
 					// TODO: we should do some challenge/response
-					discoveries <- address
+					select {
+					case discoveries <- address:
+					case <-srv.stopChan:
+						return
+					}
 				}
 			}
 		case <-time.After(5 * time.Second):
 			// nothing to do
+		case <-srv.stopChan:
+			log.Debug("Stopping DHT peers discovery")
+			return
 		}
 
 		if time.Now().Unix()-lastPeersRequestTime >= 5 {
@@ -5,12 +5,12 @@ import (
 	"net"
 	"strconv"
 
+	"github.com/inercia/divs/divsd/nat"
 	"github.com/oleksandr/bonjour"
 )
 
 const PROTOCOL = "tcp"
 
-
 ////////////////////////////////////////////////////////////////////////////////
 
 type MdnsService struct {
@@ -19,7 +19,8 @@ type MdnsService struct {
 	resolver         *bonjour.Resolver
 	registerStopChan chan<- bool
 	discoveryAddr    string
-	discoveriesChan  chan *bonjour.ServiceEntry
+	discoveriesChan  chan *bonjour.ServiceEntry // written by the resolver: never closed
+	stopChan         chan struct{}              // closed when leaving
 	discovering      bool
 	announced        bool
 }
@@ -37,6 +38,7 @@ func NewMdnsService(discoveryAddr string, id string) (*MdnsService, error) {
 		resolver:        resolver,
 		discoveryAddr:   discoveryAddr,
 		discoveriesChan: make(chan *bonjour.ServiceEntry),
+		stopChan:        make(chan struct{}),
 		announced:       false,
 		discovering:     false,
 	}
@@ -64,22 +66,27 @@ func (srv *MdnsService) AnnounceAndDiscover(external string, discoveries chan st
 
 	// Create the mDNS server, defer shutdown
 	go func(results chan *bonjour.ServiceEntry) {
-		for entry := range results {
-			var entryHostName string
-			if entry.AddrIPv4 == nil || entry.AddrIPv4.IsUnspecified() {
-				entryHostName = entry.HostName
-			} else {
-				entryHostName = entry.AddrIPv4.String()
+		for {
+			var entry *bonjour.ServiceEntry
+			select {
+			case entry = <-results:
+			case <-srv.stopChan:
+				return
 			}
-
-			entryAddr := fmt.Sprintf("%s:%d", entryHostName, entry.Port)
-			log.Debug("Located a peer with mDNS: %s", entryAddr)
-
-			// check if we have discovered ourselves...
-			if localIPs.IsLocal(entryHostName) && entry.Port == port {
-				log.Debug("... skipped: it was this node (%s:%d)", entryHostName, port)
-			} else {
-				discoveries <- entryAddr
+			for _, entryHostName := range entryHosts(entry) {
+				entryAddr := net.JoinHostPort(entryHostName, strconv.Itoa(entry.Port))
+				log.Debug("Located a peer with mDNS: %s", entryAddr)
+
+				// check if we have discovered ourselves...
+				if localIPs.IsLocal(entryHostName) && entry.Port == port {
+					log.Debug("... skipped: it was this node (%s)", entryAddr)
+				} else {
+					select {
+					case discoveries <- entryAddr:
+					case <-srv.stopChan:
+						return
+					}
+				}
 			}
 		}
 	}(srv.discoveriesChan)
@@ -88,6 +95,7 @@ func (srv *MdnsService) AnnounceAndDiscover(external string, discoveries chan st
 	err = srv.resolver.Browse(srv.fullId, "local.", srv.discoveriesChan)
 	if err != nil {
 		log.Error("Could not start mDNS discovery: %s", err)
+		close(srv.stopChan) // nothing will be forwarded
 		return err
 	} else {
 		srv.discovering = true
@@ -96,6 +104,23 @@ func (srv *MdnsService) AnnounceAndDiscover(external string, discoveries chan st
 	return nil
 }
 
+// Get the hosts we can use for joining a peer discovered with mDNS: its global
+// IPv6 address (preferred, as we avoid NAT) and its IPv4 address, or the
+// host name when there are no addresses
+func entryHosts(entry *bonjour.ServiceEntry) []string {
+	hosts := []string{}
+	if nat.IsGlobalIPv6(entry.AddrIPv6) {
+		hosts = append(hosts, entry.AddrIPv6.String())
+	}
+	if entry.AddrIPv4 != nil && !entry.AddrIPv4.IsUnspecified() {
+		hosts = append(hosts, entry.AddrIPv4.String())
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, entry.HostName)
+	}
+	return hosts
+}
+
 // Stop announcing the service and stop discovering peers...
 func (srv *MdnsService) Leave() error {
 	if srv.announced {
@@ -103,7 +128,16 @@ func (srv *MdnsService) Leave() error {
 		srv.announced = false
 	}
 	if srv.discovering {
-		close(srv.discoveriesChan)
+		// the resolver could still be sending entries: we stop forwarding
+		// them, and we discard them until the resolver exits
+		close(srv.stopChan)
+		for exited := false; !exited; {
+			select {
+			case srv.resolver.Exit <- true:
+				exited = true
+			case <-srv.discoveriesChan:
+			}
+		}
 		srv.discovering = false
 	}
 
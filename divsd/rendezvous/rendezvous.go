@@ -6,17 +6,17 @@ package rendezvous
 
 import (
 	"net"
-	"fmt"
-	logging "github.com/op/go-logging"
-	"github.com/inercia/divs/divsd/nat"
+	"strconv"
+	"sync"
 
+	"github.com/inercia/divs/divsd/nat"
+	logging "github.com/op/go-logging"
 )
 
 const LOG_MODULE = "divs"
 
 var log = logging.MustGetLogger(LOG_MODULE)
 
-
 type LocalIPs map[string]bool
 
 func NewLocalIps() *LocalIPs {
@@ -60,32 +60,130 @@ type RendezvousService interface {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func Start(serviceId string, bindIp string, dhtPort int, externalAddr string, discoveredChan chan string) {
+// The collection of rendezvous services started for a service ID
+type Rendezvous struct {
+	serviceId      string
+	bindIp         string
+	dhtPort        int
+	discoveredChan chan string
+
+	services   []RendezvousService
+	generation int // incremented every time the services are restarted
+	left       bool
+	mutex      sync.Mutex
+}
+
+// check if the services for a generation must still be running
+func (r *Rendezvous) current(generation int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return !r.left && r.generation == generation
+}
+
+// start a rendezvous service, unless we have already left (or the services
+// have been restarted in the meantime)
+// Creating a service can take a while (obtaining an external address...), so
+// it is done without holding the lock: if we have left (or restarted) in the
+// meantime, the service is left as soon as it has been created.
+func (r *Rendezvous) start(generation int, create func() (RendezvousService, error)) {
+	if !r.current(generation) {
+		return
+	}
+	srv, err := create()
+	if err != nil {
+		return
+	}
+
+	r.mutex.Lock()
+	if !r.left && r.generation == generation {
+		r.services = append(r.services, srv)
+		r.mutex.Unlock()
+		return
+	}
+	r.mutex.Unlock()
+	if err := srv.Leave(); err != nil {
+		log.Warning("Error when leaving rendezvous: %s", err)
+	}
+}
+
+// leave all the services. The caller must be holding the lock.
+func (r *Rendezvous) leaveServices() {
+	for _, srv := range r.services {
+		if err := srv.Leave(); err != nil {
+			log.Warning("Error when leaving rendezvous: %s", err)
+		}
+	}
+	r.services = nil
+	r.generation++
+}
+
+// Leave all the rendezvous services
+// Once this method returns, nothing else will be sent to the discoveries channel
+// by the services started (the ones still being created are left as soon as
+// they have been created).
+func (r *Rendezvous) Leave() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.left = true
+	r.leaveServices()
+	return nil
+}
+
+// Announce ourselves at a new external address, restarting all the services
+func (r *Rendezvous) Announce(externalAddr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.left {
+		return
+	}
+	log.Info("Announcing new external address %s", externalAddr)
+	r.leaveServices()
+	r.announce(r.generation, externalAddr)
+}
+
+// start the rendezvous services (mDNS and DHT), announcing an external address
+func (r *Rendezvous) announce(generation int, externalAddr string) {
 	localIPs := NewLocalIps()
 
 	// create the MDNS service
-	go func() {
-		mdnsService, err := NewMdnsService("", serviceId)
+	go r.start(generation, func() (RendezvousService, error) {
+		mdnsService, err := NewMdnsService("", r.serviceId)
 		if err != nil {
 			log.Error("Could not start the mDNS service")
-		} else {
-			mdnsService.AnnounceAndDiscover(externalAddr, discoveredChan, localIPs)
+			return nil, err
 		}
-	}()
+		mdnsService.AnnounceAndDiscover(externalAddr, r.discoveredChan, localIPs)
+		return mdnsService, nil
+	})
 
 	// create the DHT service by previously obtaining an external TCP address
-	go func() {
-		defaultAddr := fmt.Sprintf("%s:%d", bindIp, dhtPort)
+	go r.start(generation, func() (RendezvousService, error) {
+		defaultAddr := net.JoinHostPort(r.bindIp, strconv.Itoa(r.dhtPort))
 		dhtAddr, err := nat.NewExternalTCPAddr(defaultAddr)
 		if err != nil {
 			log.Error("Could not obtain an external port for the DHT service")
-		} else {
-			dhtService, err := NewDhtService(dhtAddr.String(), serviceId)
-			if err != nil {
-				log.Error("Could not start the DHT service")
-			} else {
-				dhtService.AnnounceAndDiscover(externalAddr, discoveredChan, localIPs)
-			}
+			return nil, err
+		}
+		dhtService, err := NewDhtService(dhtAddr.String(), r.serviceId)
+		if err != nil {
+			log.Error("Could not start the DHT service")
+			return nil, err
 		}
-	}()
+		dhtService.AnnounceAndDiscover(externalAddr, r.discoveredChan, localIPs)
+		return dhtService, nil
+	})
+}
+
+// Start the rendezvous services (mDNS and DHT) for a service ID
+func Start(serviceId string, bindIp string, dhtPort int, externalAddr string, discoveredChan chan string) *Rendezvous {
+	r := &Rendezvous{
+		serviceId:      serviceId,
+		bindIp:         bindIp,
+		dhtPort:        dhtPort,
+		discoveredChan: discoveredChan,
+	}
+	r.announce(r.generation, externalAddr)
+	return r
 }
@@ -1,69 +1,288 @@
 package divsd
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"os"
 	"sync"
+
 	"github.com/inercia/divs/divsd/nat"
 )
 
-// The DiVS server starts the nodes manager (for the p2p network) and the devices
-// manager (for the TAP device)
+// The DiVS server starts the switches (each one with a nodes manager, for the
+// p2p network, and a devices manager, for the TAP device) and the control API
 type Server struct {
 	config *Config
 
-	nodesManager *NodesManager
-	devManager   *DevManager
+	switches map[string]*Switch       // the switches hosted, by name
+	dynamic  map[string]*switchConfig // switches added with the control API (not in the config file)
+	control  *ControlServer
 
-	mutex sync.RWMutex
+	stopped  bool
+	doneChan chan struct{} // closed when the shutdown has been completed
+	mutex    sync.RWMutex
 }
 
 // Creates a new server.
 func New(config *Config) (s *Server, err error) {
-	// Initialize the device manager
-	devManager, err := NewDevManager(config)
-	if err != nil {
-		return nil, err
+	s = &Server{
+		config:   config,
+		switches: make(map[string]*Switch),
+		dynamic:  make(map[string]*switchConfig),
+		doneChan: make(chan struct{}),
 	}
 
-	// Initialize the nodes manager
-	nodesManager, err := NewNodesManager(config)
-	if err != nil {
+	// the default switch, plus any additional switch configured
+	if s.switches[DEFAULT_SWITCH], err = NewSwitch(DEFAULT_SWITCH, config); err != nil {
 		return nil, err
 	}
-
-	nodesManager.SetDevManager(devManager)
-	devManager.SetNodesManager(nodesManager)
-
-	s = &Server{
-		config:       config,
-		devManager:   devManager,
-		nodesManager: nodesManager,
+	for _, name := range sortedSwitchNames(config.Switch) {
+		if s.switches[name], err = NewSwitch(name, config.SwitchConfig(name)); err != nil {
+			return nil, fmt.Errorf("switch %s: %s", name, err)
+		}
 	}
+	s.control = NewControlServer(s)
 
 	return s, nil
 }
 
 // Starts the server.
+// This method blocks until the server is shut down with Shutdown(), returning
+// ERR_SERVER_CLOSED once the shutdown has been completed.
 func (s *Server) ListenAndServe() error {
-	// obtain a externally-reachable IP/port for memberlist management
-	defaultExternalAddr := fmt.Sprintf("%s:%d", s.config.Global.Host, s.config.Global.Port)
-	membersExternalAddr, err := nat.NewExternalUDPAddr(defaultExternalAddr)
-	if membersExternalAddr.Port == 0 {
-		log.Fatalf("FATAL: external port obtained is 0")
+	// configure the NAT traversal mechanisms
+	if err := nat.SetResolvers(s.config.Nat.Resolvers()); err != nil {
+		return err
 	}
+	if len(s.config.Nat.Gateway) > 0 {
+		nat.SetGateway(net.ParseIP(s.config.Nat.Gateway))
+	}
+	nat.SetStunServers(s.config.Nat.StunServer)
 
-	// start the peers manager
-	if err = s.nodesManager.Start(membersExternalAddr); err != nil {
-		log.Fatalf("Error when initialing peers manager: %s", err)
+	for _, sw := range s.Switches() {
+		if err := sw.Start(); err != nil {
+			log.Fatalf("FATAL: could not start switch %s: %s", sw.Name, err)
+		}
 	}
 
-	// and the devices manager
-	if err = s.devManager.Start(); err != nil {
-		log.Fatalf("Error when initialing tun/tap device manager: %s", err)
+	if len(s.config.Control.Listen) > 0 {
+		if err := s.control.Start(s.config.Control.Listen); err != nil {
+			log.Error("Could not start the control API: %s", err)
+		}
 	}
 
-	if err := s.nodesManager.WaitForNodesForever(); err != nil {
+	if err := s.defaultSwitch().nodesManager.WaitForNodesForever(); err != nil {
 		return err
 	}
+
+	<-s.doneChan
+	return ERR_SERVER_CLOSED
+}
+
+// get the default switch
+func (s *Server) defaultSwitch() *Switch {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.switches[DEFAULT_SWITCH]
+}
+
+// Get a switch by name
+func (s *Server) Switch(name string) (*Switch, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sw, found := s.switches[name]
+	if !found {
+		return nil, ERR_UNKNOWN_SWITCH
+	}
+	return sw, nil
+}
+
+// Get all the switches, sorted by name (with the default switch first)
+func (s *Server) Switches() []*Switch {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sortedSwitches()
+}
+
+// get all the switches, sorted by name (with the default switch first)
+func (s *Server) sortedSwitches() []*Switch {
+	res := []*Switch{s.switches[DEFAULT_SWITCH]}
+	for _, name := range sortedSwitchNames(s.allSwitchConfigs()) {
+		if sw, found := s.switches[name]; found {
+			res = append(res, sw)
+		}
+	}
+	return res
+}
+
+// get the settings for all the additional switches: the ones in the config
+// file and the ones added with the control API
+func (s *Server) allSwitchConfigs() map[string]*switchConfig {
+	res := make(map[string]*switchConfig, len(s.config.Switch)+len(s.dynamic))
+	for name, sc := range s.config.Switch {
+		res[name] = sc
+	}
+	for name, sc := range s.dynamic {
+		res[name] = sc
+	}
+	return res
+}
+
+// Add a new switch to a running server, starting it
+// Switches added this way are kept when the configuration is reloaded.
+// Starting a switch can take a while (with the NAT traversal...), so the name
+// is reserved and the switch is started without holding the lock.
+func (s *Server) AddSwitch(name string, sc *switchConfig) error {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return ERR_SERVER_CLOSED
+	}
+
+	// validate the configuration with the new switch
+	config := *s.config
+	config.Switch = s.allSwitchConfigs()
+	if _, found := config.Switch[name]; found || name == DEFAULT_SWITCH {
+		s.mutex.Unlock()
+		return fmt.Errorf("switch %s already exists", name)
+	}
+	config.Switch[name] = sc
+	if err := config.Validate(); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	s.dynamic[name] = sc
+	s.mutex.Unlock()
+
+	sw, err := s.startSwitch(name, config.SwitchConfig(name))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil && s.stopped {
+		s.stopSwitch(context.Background(), sw)
+		err = ERR_SERVER_CLOSED
+	}
+	if err != nil {
+		delete(s.dynamic, name)
+		return err
+	}
+	s.switches[name] = sw
 	return nil
 }
+
+// create and start a switch
+func (s *Server) addSwitch(name string, config *Config) error {
+	sw, err := s.startSwitch(name, config)
+	if err != nil {
+		return err
+	}
+	s.switches[name] = sw
+	return nil
+}
+
+// create and start a switch, without adding it to the server
+func (s *Server) startSwitch(name string, config *Config) (*Switch, error) {
+	sw, err := NewSwitch(name, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := sw.Start(); err != nil {
+		sw.Stop(context.Background())
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Stop and remove a switch from a running server
+// The default switch cannot be removed.
+func (s *Server) RemoveSwitch(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return ERR_SERVER_CLOSED
+	}
+	if name == DEFAULT_SWITCH {
+		return fmt.Errorf("the default switch cannot be removed")
+	}
+	if err := s.removeSwitch(ctx, name); err != nil {
+		return err
+	}
+
+	if _, found := s.dynamic[name]; found {
+		delete(s.dynamic, name)
+		return nil
+	}
+	switches := map[string]*switchConfig{}
+	for other, sc := range s.config.Switch {
+		if other != name {
+			switches[other] = sc
+		}
+	}
+	s.config.Switch = switches
+	return nil
+}
+
+// stop and remove a switch
+func (s *Server) removeSwitch(ctx context.Context, name string) error {
+	sw, found := s.switches[name]
+	if !found {
+		return ERR_UNKNOWN_SWITCH
+	}
+	delete(s.switches, name)
+	return s.stopSwitch(ctx, sw)
+}
+
+// stop a switch, removing the port mappings for its ports
+func (s *Server) stopSwitch(ctx context.Context, sw *Switch) error {
+	err := sw.Stop(ctx)
+
+	// the ports of the switch are not used any more
+	nat.RemovePortMappings(sw.config.Global.Port)
+	if sw.config.Discover.Port != 0 {
+		nat.RemovePortMappings(sw.config.Discover.Port)
+	}
+	return err
+}
+
+// Shutdown the server gracefully
+// We broadcast our leave to the cluster (so peers purge our MACs immediately),
+// stop the TAP device, drain the send queues and remove the pidfile. If the
+// context is done before the send queues have been drained, the remaining
+// data is discarded and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	defer close(s.doneChan)
+
+	log.Info("Shutting down...")
+	s.control.Stop()
+
+	// leave all the clusters, stop the TAP devices and drain the send queues
+	for _, sw := range s.sortedSwitches() {
+		if swErr := sw.Stop(ctx); swErr != nil {
+			log.Warning("Error when stopping switch %s: %s", sw.Name, swErr)
+			err = swErr
+		}
+	}
+
+	// remove the port mappings in the NAT gateway
+	nat.RemoveMappings()
+
+	if len(s.config.Global.Pidfile) > 0 {
+		log.Debug("Removing pidfile %s", s.config.Global.Pidfile)
+		if rmErr := os.Remove(s.config.Global.Pidfile); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Warning("Could not remove pidfile: %s", rmErr)
+		}
+	}
+
+	log.Info("Shutdown completed")
+	return err
+}
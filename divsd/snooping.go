@@ -0,0 +1,498 @@
+package divsd
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/gopacket/layers"
+)
+
+// the protocol feature of nodes that snoop (and announce) multicast groups:
+// multicast traffic is always sent to nodes without this feature
+const FEATURE_IGMP = "igmp"
+
+// default time (in seconds) a local receiver stays in a group without
+// reporting it again (the IGMP/MLD group membership interval)
+const DEFAULT_GROUP_TIMEOUT = 260
+
+// interval for expiring the local receivers
+const GROUPS_EXPIRE_INTERVAL = 10 * time.Second
+
+// IGMP message types
+const (
+	IGMP_QUERY     = 0x11
+	IGMP_V1_REPORT = 0x12
+	IGMP_V2_REPORT = 0x16
+	IGMP_V2_LEAVE  = 0x17
+	IGMP_V3_REPORT = 0x22
+)
+
+// MLD message types (ICMPv6)
+const (
+	MLD_QUERY     = 130
+	MLD_V1_REPORT = 131
+	MLD_V1_DONE   = 132
+	MLD_V2_REPORT = 143
+)
+
+// IGMPv3/MLDv2 group record types
+const (
+	GROUP_RECORD_IS_INCLUDE = 1
+	GROUP_RECORD_IS_EXCLUDE = 2
+	GROUP_RECORD_TO_INCLUDE = 3
+	GROUP_RECORD_TO_EXCLUDE = 4
+	GROUP_RECORD_ALLOW      = 5
+)
+
+// A membership report for a group found in a IGMP/MLD packet
+type groupReport struct {
+	group net.IP
+	join  bool // false for leaving the group
+}
+
+// get the report for a IGMPv3/MLDv2 group record, given the record type and
+// the number of sources
+func recordReport(group net.IP, recordType int, numSources int) (groupReport, bool) {
+	switch recordType {
+	case GROUP_RECORD_IS_EXCLUDE, GROUP_RECORD_TO_EXCLUDE:
+		return groupReport{group, true}, true
+	case GROUP_RECORD_IS_INCLUDE, GROUP_RECORD_TO_INCLUDE, GROUP_RECORD_ALLOW:
+		// including no sources means leaving the group
+		return groupReport{group, numSources > 0}, recordType != GROUP_RECORD_ALLOW || numSources > 0
+	}
+	return groupReport{}, false
+}
+
+// parse the group records in IGMPv3/MLDv2 reports, with addresses of some length
+func parseGroupRecords(data []byte, num int, addrLen int) []groupReport {
+	reports := []groupReport{}
+	for i := 0; i < num; i++ {
+		if len(data) < 4+addrLen {
+			break
+		}
+		recordType, auxLen := int(data[0]), int(data[1])*4
+		numSources := int(binary.BigEndian.Uint16(data[2:4]))
+		group := net.IP(append([]byte{}, data[4:4+addrLen]...))
+		if r, ok := recordReport(group, recordType, numSources); ok {
+			reports = append(reports, r)
+		}
+		recordLen := 4 + addrLen + numSources*addrLen + auxLen
+		if len(data) < recordLen {
+			break
+		}
+		data = data[recordLen:]
+	}
+	return reports
+}
+
+// parse a IGMP message
+func parseIGMP(data []byte) []groupReport {
+	if len(data) < 8 {
+		return nil
+	}
+	switch data[0] {
+	case IGMP_V1_REPORT, IGMP_V2_REPORT:
+		return []groupReport{{net.IP(append([]byte{}, data[4:8]...)), true}}
+	case IGMP_V2_LEAVE:
+		return []groupReport{{net.IP(append([]byte{}, data[4:8]...)), false}}
+	case IGMP_V3_REPORT:
+		return parseGroupRecords(data[8:], int(binary.BigEndian.Uint16(data[6:8])), net.IPv4len)
+	}
+	return nil
+}
+
+// parse a MLD message
+func parseMLD(data []byte) []groupReport {
+	if len(data) < 8 {
+		return nil
+	}
+	switch data[0] {
+	case MLD_V1_REPORT, MLD_V1_DONE:
+		if len(data) < 8+net.IPv6len {
+			return nil
+		}
+		group := net.IP(append([]byte{}, data[8:8+net.IPv6len]...))
+		return []groupReport{{group, data[0] == MLD_V1_REPORT}}
+	case MLD_V2_REPORT:
+		return parseGroupRecords(data[8:], int(binary.BigEndian.Uint16(data[6:8])), net.IPv6len)
+	}
+	return nil
+}
+
+// Get the group membership reports in a packet (if it is a IGMP or MLD report)
+func snoopReports(pkt *EthernetPacket) []groupReport {
+	data, mld := groupMessage(pkt)
+	if mld {
+		return parseMLD(data)
+	}
+	return parseIGMP(data)
+}
+
+// Return `true` if a packet is a IGMP or MLD query
+func isGroupQuery(pkt *EthernetPacket) bool {
+	data, mld := groupMessage(pkt)
+	if len(data) == 0 {
+		return false
+	}
+	if mld {
+		return data[0] == MLD_QUERY
+	}
+	return data[0] == IGMP_QUERY
+}
+
+// Get the IGMP or MLD message in a packet (nil if there is none), with `true`
+// for MLD messages
+func groupMessage(pkt *EthernetPacket) ([]byte, bool) {
+	etherType, payload := pkt.EthernetType, pkt.Payload
+	if tag, ok := pkt.dot1q(); ok {
+		etherType, payload = tag.Type, tag.Payload
+	}
+
+	switch etherType {
+	case layers.EthernetTypeIPv4:
+		if len(payload) < 20 || payload[9] != byte(layers.IPProtocolIGMP) {
+			return nil, false
+		}
+		hdrLen := int(payload[0]&0x0f) * 4
+		if hdrLen < 20 || len(payload) < hdrLen {
+			return nil, false
+		}
+		return payload[hdrLen:], false
+
+	case layers.EthernetTypeIPv6:
+		if len(payload) < 40 {
+			return nil, false
+		}
+		// MLD messages come after a hop-by-hop options header
+		next, data := layers.IPProtocol(payload[6]), payload[40:]
+		for next == layers.IPProtocolIPv6HopByHop || next == layers.IPProtocolIPv6Destination {
+			if len(data) < 8 {
+				return nil, false
+			}
+			hdrLen := (int(data[1]) + 1) * 8
+			if len(data) < hdrLen {
+				return nil, false
+			}
+			next, data = layers.IPProtocol(data[0]), data[hdrLen:]
+		}
+		if next != layers.IPProtocolICMPv6 {
+			return nil, false
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// Get the multicast MAC for a group IP address
+func groupMac(group net.IP) net.HardwareAddr {
+	if ip4 := group.To4(); ip4 != nil {
+		return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+	}
+	return net.HardwareAddr{0x33, 0x33, group[12], group[13], group[14], group[15]}
+}
+
+// Return `true` for the multicast MACs that are always flooded: the link-local
+// IPv4 groups (224.0.0.x, used by routing protocols and IGMP itself), the IPv6
+// groups like all-nodes/all-routers and the solicited-node groups (used by NDP)
+func floodedGroupMac(mac net.HardwareAddr) bool {
+	if len(mac) != 6 {
+		return true
+	}
+	switch {
+	case mac[0] == 0x01 && mac[1] == 0x00 && mac[2] == 0x5e:
+		return mac[3] == 0 && mac[4] == 0
+	case mac[0] == 0x33 && mac[1] == 0x33:
+		return mac[2] == 0xff || (mac[2] == 0 && mac[3] == 0 && mac[4] == 0)
+	}
+	return true // not a IP multicast MAC
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// An entry in the groups table, as exposed in the control API
+type GroupEntry struct {
+	Vlan  uint16   `json:"vlan"`
+	Group string   `json:"group"`
+	MAC   string   `json:"mac"`
+	Nodes []string `json:"nodes"`
+}
+
+// The multicast groups table: the nodes with receivers for each group (as
+// announced by them), and the receivers behind the local node
+// Hosts only report their groups again when they are queried, so the local
+// receivers only expire in VLANs with a querier (where a query has been seen
+// in the last timeout): otherwise they are kept until they leave their groups.
+type GroupTable struct {
+	members map[GroupMembership]map[string]bool      // group -> nodes
+	byMac   map[MacKey]map[string]int                // group MAC -> nodes (and number of groups)
+	local   map[GroupMembership]map[string]time.Time // local groups -> receivers (and when they expire)
+	queried map[uint16]time.Time                     // VLAN -> last query seen
+	enabled bool                                     // snooping enabled
+	timeout time.Duration                            // time a local receiver stays without reporting
+	mutex   sync.RWMutex
+}
+
+// Create a new groups table
+func NewGroupTable() *GroupTable {
+	return &GroupTable{
+		members: make(map[GroupMembership]map[string]bool),
+		byMac:   make(map[MacKey]map[string]int),
+		local:   make(map[GroupMembership]map[string]time.Time),
+		queried: make(map[uint16]time.Time),
+	}
+}
+
+// Set the snooping settings
+func (t *GroupTable) SetConfig(c snoopingConfig) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.enabled = c.Enabled
+	t.timeout = time.Duration(c.Timeout) * time.Second
+}
+
+// Get the snooping settings: if it is enabled, and the time a local receiver
+// stays in a group without reporting it
+func (t *GroupTable) Snooping() (bool, time.Duration) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.enabled, t.timeout
+}
+
+// get the MAC key for a group
+func groupKey(g GroupMembership) (MacKey, bool) {
+	ip := net.ParseIP(g.Group)
+	if ip == nil || !ip.IsMulticast() {
+		return MacKey{}, false
+	}
+	return MacKey{g.Vlan, groupMac(ip).String()}, true
+}
+
+// add a node to a group, returning `true` if it was not there
+func (t *GroupTable) join(node string, g GroupMembership) bool {
+	key, ok := groupKey(g)
+	if !ok {
+		return false
+	}
+	nodes, found := t.members[g]
+	if !found {
+		nodes = make(map[string]bool)
+		t.members[g] = nodes
+	}
+	if nodes[node] {
+		return false
+	}
+	nodes[node] = true
+
+	macNodes, found := t.byMac[key]
+	if !found {
+		macNodes = make(map[string]int)
+		t.byMac[key] = macNodes
+	}
+	macNodes[node]++
+	return true
+}
+
+// remove a node from a group, returning `true` if it was there
+func (t *GroupTable) leave(node string, g GroupMembership) bool {
+	nodes, found := t.members[g]
+	if !found || !nodes[node] {
+		return false
+	}
+	delete(nodes, node)
+	if len(nodes) == 0 {
+		delete(t.members, g)
+	}
+
+	key, _ := groupKey(g)
+	if macNodes, found := t.byMac[key]; found {
+		if macNodes[node]--; macNodes[node] <= 0 {
+			delete(macNodes, node)
+		}
+		if len(macNodes) == 0 {
+			delete(t.byMac, key)
+		}
+	}
+	return true
+}
+
+// Add a node to a group, returning `true` if it was not there
+func (t *GroupTable) Join(node string, g GroupMembership) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.join(node, g)
+}
+
+// Remove a node from a group, returning `true` if it was there
+func (t *GroupTable) Leave(node string, g GroupMembership) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.leave(node, g)
+}
+
+// Replace all the groups of a node
+func (t *GroupTable) SetNode(node string, groups []GroupMembership) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	current := make(map[GroupMembership]bool)
+	for _, g := range groups {
+		current[g] = true
+		t.join(node, g)
+	}
+	for g, nodes := range t.members {
+		if nodes[node] && !current[g] {
+			t.leave(node, g)
+		}
+	}
+}
+
+// Remove a node from all the groups
+func (t *GroupTable) RemoveNode(node string) {
+	t.SetNode(node, nil)
+}
+
+// Get the groups of a node
+func (t *GroupTable) NodeGroups(node string) []GroupMembership {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	res := []GroupMembership{}
+	for g, nodes := range t.members {
+		if nodes[node] {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// Get the nodes with receivers for a multicast MAC in a VLAN
+// Returns `false` if the group is not registered (so it must be flooded).
+func (t *GroupTable) Members(vlan uint16, mac net.HardwareAddr) (map[string]bool, bool) {
+	if floodedGroupMac(mac) {
+		return nil, false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	macNodes, found := t.byMac[MacKey{vlan, mac.String()}]
+	if !found {
+		return nil, false
+	}
+	res := make(map[string]bool, len(macNodes))
+	for node := range macNodes {
+		res[node] = true
+	}
+	return res, true
+}
+
+// Process a report from a receiver behind the local node (for a group in a
+// VLAN), returning `true` if the local node joins or leaves the group
+func (t *GroupTable) Report(localNode string, receiver string, vlan uint16, r groupReport, expires time.Time) bool {
+	if !r.group.IsMulticast() || floodedGroupMac(groupMac(r.group)) {
+		return false
+	}
+	g := GroupMembership{Vlan: vlan, Group: r.group.String()}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	receivers, found := t.local[g]
+	if r.join {
+		if !found {
+			receivers = make(map[string]time.Time)
+			t.local[g] = receivers
+		}
+		receivers[receiver] = expires
+		return t.join(localNode, g)
+	}
+
+	if found {
+		delete(receivers, receiver)
+		if len(receivers) > 0 {
+			return false // there are other receivers
+		}
+		delete(t.local, g)
+	}
+	return t.leave(localNode, g)
+}
+
+// Record a IGMP/MLD query seen in a VLAN
+// When there was no querier, the local receivers in the VLAN get a full timeout
+// for reporting their groups again.
+func (t *GroupTable) Queried(vlan uint16, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.hasQuerier(vlan, now) {
+		for g, receivers := range t.local {
+			if g.Vlan != vlan {
+				continue
+			}
+			for receiver, expires := range receivers {
+				if expires.Before(now.Add(t.timeout)) {
+					receivers[receiver] = now.Add(t.timeout)
+				}
+			}
+		}
+	}
+	t.queried[vlan] = now
+}
+
+// check if there is a querier in a VLAN. The caller must be holding the lock.
+func (t *GroupTable) hasQuerier(vlan uint16, now time.Time) bool {
+	queried, found := t.queried[vlan]
+	return found && now.Sub(queried) <= t.timeout
+}
+
+// Expire the local receivers that have not reported their groups for a while
+// (in the VLANs with a querier), returning the groups the local node has left
+func (t *GroupTable) Expire(localNode string, now time.Time) []GroupMembership {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	left := []GroupMembership{}
+	for g, receivers := range t.local {
+		if !t.hasQuerier(g.Vlan, now) {
+			continue
+		}
+		for receiver, expires := range receivers {
+			if now.After(expires) {
+				delete(receivers, receiver)
+			}
+		}
+		if len(receivers) == 0 {
+			delete(t.local, g)
+			if t.leave(localNode, g) {
+				left = append(left, g)
+			}
+		}
+	}
+	return left
+}
+
+// Get all the groups, sorted by VLAN and group
+func (t *GroupTable) Entries() []GroupEntry {
+	t.mutex.RLock()
+	res := make([]GroupEntry, 0, len(t.members))
+	for g, nodes := range t.members {
+		key, _ := groupKey(g)
+		entry := GroupEntry{Vlan: g.Vlan, Group: g.Group, MAC: key.MAC, Nodes: make([]string, 0, len(nodes))}
+		for node := range nodes {
+			entry.Nodes = append(entry.Nodes, node)
+		}
+		sort.Strings(entry.Nodes)
+		res = append(res, entry)
+	}
+	t.mutex.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Vlan != res[j].Vlan {
+			return res[i].Vlan < res[j].Vlan
+		}
+		return res[i].Group < res[j].Group
+	})
+	return res
+}
@@ -0,0 +1,168 @@
+package divsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"code.google.com/p/gopacket/layers"
+)
+
+// build a IPv4 packet with a IGMP message
+func newTestIGMPPacket(igmp []byte) *EthernetPacket {
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 1, byte(layers.IPProtocolIGMP), 0, 0, 10, 0, 0, 1, 224, 0, 0, 22}
+	pkt := newTestPacket()
+	pkt.DstMAC = net.HardwareAddr{0x01, 0x00, 0x5e, 0, 0, 0x16}
+	pkt.Payload = append(ip, igmp...)
+	return pkt
+}
+
+// build a IPv6 packet with a MLD message, after a hop-by-hop options header
+func newTestMLDPacket(mld []byte) *EthernetPacket {
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[6] = byte(layers.IPProtocolIPv6HopByHop)
+	hopByHop := []byte{byte(layers.IPProtocolICMPv6), 0, 5, 2, 0, 0, 1, 0} // router alert
+	pkt := newTestPacket()
+	pkt.EthernetType = layers.EthernetTypeIPv6
+	pkt.DstMAC = net.HardwareAddr{0x33, 0x33, 0, 0, 0, 0x16}
+	pkt.Payload = append(append(ip, hopByHop...), mld...)
+	return pkt
+}
+
+func TestSnoopIGMP(t *testing.T) {
+	reports := snoopReports(newTestIGMPPacket([]byte{IGMP_V2_REPORT, 0, 0, 0, 239, 1, 2, 3}))
+	if len(reports) != 1 || !reports[0].join || reports[0].group.String() != "239.1.2.3" {
+		t.Fatalf("unexpected IGMPv2 report: %+v", reports)
+	}
+	reports = snoopReports(newTestIGMPPacket([]byte{IGMP_V2_LEAVE, 0, 0, 0, 239, 1, 2, 3}))
+	if len(reports) != 1 || reports[0].join {
+		t.Fatalf("unexpected IGMPv2 leave: %+v", reports)
+	}
+
+	// a IGMPv3 report with a join (exclude no sources), a leave (include no
+	// sources) and a join with a source
+	v3 := []byte{IGMP_V3_REPORT, 0, 0, 0, 0, 0, 0, 3,
+		GROUP_RECORD_TO_EXCLUDE, 0, 0, 0, 239, 0, 0, 1,
+		GROUP_RECORD_TO_INCLUDE, 0, 0, 0, 239, 0, 0, 2,
+		GROUP_RECORD_IS_INCLUDE, 0, 0, 1, 232, 0, 0, 3, 10, 0, 0, 9,
+	}
+	reports = snoopReports(newTestIGMPPacket(v3))
+	if len(reports) != 3 {
+		t.Fatalf("unexpected IGMPv3 reports: %+v", reports)
+	}
+	for i, expected := range []bool{true, false, true} {
+		if reports[i].join != expected {
+			t.Errorf("record %d (%s): expected join=%t", i, reports[i].group, expected)
+		}
+	}
+
+	// queries and other protocols are ignored
+	query := newTestIGMPPacket([]byte{IGMP_QUERY, 0, 0, 0, 0, 0, 0, 0})
+	if reports := snoopReports(query); len(reports) != 0 {
+		t.Errorf("unexpected reports in a query: %+v", reports)
+	}
+	if !isGroupQuery(query) || isGroupQuery(newTestIGMPPacket(v3)) || !isGroupQuery(newTestMLDPacket(append([]byte{MLD_QUERY}, make([]byte, 23)...))) {
+		t.Errorf("queries not detected")
+	}
+	if reports := snoopReports(newTestPacket()); len(reports) != 0 {
+		t.Errorf("unexpected reports in a non-IGMP packet: %+v", reports)
+	}
+}
+
+func TestSnoopMLD(t *testing.T) {
+	group := net.ParseIP("ff05::1:3")
+	v2 := append([]byte{MLD_V2_REPORT, 0, 0, 0, 0, 0, 0, 1, GROUP_RECORD_IS_EXCLUDE, 0, 0, 0}, group...)
+	reports := snoopReports(newTestMLDPacket(v2))
+	if len(reports) != 1 || !reports[0].join || !reports[0].group.Equal(group) {
+		t.Fatalf("unexpected MLDv2 report: %+v", reports)
+	}
+
+	done := append([]byte{MLD_V1_DONE, 0, 0, 0, 0, 0, 0, 0}, group...)
+	reports = snoopReports(newTestMLDPacket(done))
+	if len(reports) != 1 || reports[0].join {
+		t.Fatalf("unexpected MLDv1 done: %+v", reports)
+	}
+}
+
+func TestGroupMac(t *testing.T) {
+	for group, expected := range map[string]string{
+		"239.129.2.3": "01:00:5e:01:02:03",
+		"ff05::1:3":   "33:33:00:01:00:03",
+	} {
+		if mac := groupMac(net.ParseIP(group)).String(); mac != expected {
+			t.Errorf("%s: expected %s, got %s", group, expected, mac)
+		}
+	}
+	for _, group := range []string{"224.0.0.251", "ff02::1", "ff02::1:ff00:1"} {
+		if !floodedGroupMac(groupMac(net.ParseIP(group))) {
+			t.Errorf("%s must be flooded", group)
+		}
+	}
+}
+
+func TestGroupTable(t *testing.T) {
+	table := NewGroupTable()
+	table.SetConfig(snoopingConfig{Enabled: true, Timeout: DEFAULT_GROUP_TIMEOUT})
+	mac := groupMac(net.ParseIP("239.1.2.3"))
+	now := time.Now()
+
+	if _, registered := table.Members(DEFAULT_VLAN, mac); registered {
+		t.Fatalf("unknown group registered")
+	}
+
+	// two local receivers: the local node only leaves when both have left
+	join := groupReport{net.ParseIP("239.1.2.3"), true}
+	leave := groupReport{net.ParseIP("239.1.2.3"), false}
+	if !table.Report("local", "02:00:00:00:00:01", DEFAULT_VLAN, join, now.Add(time.Minute)) {
+		t.Fatalf("local node did not join the group")
+	}
+	if table.Report("local", "02:00:00:00:00:02", DEFAULT_VLAN, join, now.Add(2*time.Minute)) {
+		t.Fatalf("local node joined the group twice")
+	}
+	if table.Report("local", "02:00:00:00:00:01", DEFAULT_VLAN, leave, now) {
+		t.Fatalf("local node left the group with receivers")
+	}
+
+	g := GroupMembership{Vlan: DEFAULT_VLAN, Group: "239.1.2.3"}
+	table.Join("node1", g)
+	table.Join("node2", GroupMembership{Vlan: 10, Group: "239.1.2.3"})
+	members, registered := table.Members(DEFAULT_VLAN, mac)
+	if !registered || len(members) != 2 || !members["local"] || !members["node1"] {
+		t.Fatalf("unexpected members: %v", members)
+	}
+
+	// receivers do not expire without a querier, as they are not asked to
+	// report their groups again
+	if left := table.Expire("local", now.Add(3*time.Minute)); len(left) != 0 {
+		t.Fatalf("groups left without a querier: %v", left)
+	}
+
+	// with a querier, the receivers get a full timeout for reporting again, and
+	// then the second receiver expires
+	table.Queried(DEFAULT_VLAN, now.Add(3*time.Minute))
+	later := now.Add(3*time.Minute + time.Duration(DEFAULT_GROUP_TIMEOUT)*time.Second)
+	if left := table.Expire("local", later.Add(-time.Second)); len(left) != 0 {
+		t.Fatalf("unexpected groups left: %v", left)
+	}
+	if left := table.Expire("local", later.Add(time.Second)); len(left) != 0 {
+		t.Fatalf("groups left after the querier has gone: %v", left)
+	}
+	table.Queried(DEFAULT_VLAN, later)
+	if left := table.Expire("local", later.Add(time.Second)); len(left) != 1 || left[0] != g {
+		t.Fatalf("unexpected groups left: %v", left)
+	}
+
+	// the state of node1 replaces its groups
+	table.SetNode("node1", []GroupMembership{{Vlan: DEFAULT_VLAN, Group: "239.4.5.6"}})
+	if _, registered := table.Members(DEFAULT_VLAN, mac); registered {
+		t.Errorf("group without members registered")
+	}
+	if entries := table.Entries(); len(entries) != 2 || entries[0].Group != "239.4.5.6" || entries[1].Vlan != 10 {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+	table.RemoveNode("node2")
+	if groups := table.NodeGroups("node2"); len(groups) != 0 {
+		t.Errorf("unexpected groups for node2: %v", groups)
+	}
+}
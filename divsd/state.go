@@ -0,0 +1,150 @@
+package divsd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// the file (in the state directory) where the state is saved
+const STATE_FILE = "state.json"
+
+// length (in bytes) of the switch secret
+const SWITCH_SECRET_LEN = 32
+
+// No state has been saved yet
+var ERR_NO_STATE = fmt.Errorf("No state found")
+
+// The persistent state of a node: the identity of the switch and the node
+type State struct {
+	Serial   string `json:"serial"`    // the switch serial
+	Secret   string `json:"secret"`    // the switch secret, base64-encoded
+	NodeId   string `json:"node_id"`   // a stable node ID
+	NodeName string `json:"node_name"` // a stable node name
+
+	// keyring and bootstrap peers obtained from a join token
+	Keys  []string `json:"keys,omitempty"`
+	Peers []string `json:"peers,omitempty"`
+}
+
+// Create a new state for a brand-new switch
+func NewState(nodeName string) (*State, error) {
+	st := &State{}
+	if err := st.ResetSwitch(NewSwitchId()); err != nil {
+		return nil, err
+	}
+	if err := st.ResetNode(nodeName); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Load the state from a state directory
+// ERR_NO_STATE is returned when no state has been saved in that directory
+func LoadState(dir string) (*State, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, STATE_FILE))
+	if os.IsNotExist(err) {
+		return nil, ERR_NO_STATE
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("could not parse state file: %s", err)
+	}
+	if st.SwitchId().Empty() {
+		return nil, fmt.Errorf("invalid switch serial in state file")
+	}
+	return st, nil
+}
+
+// Save the state in a state directory, creating the directory if necessary
+func (st *State) Save(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write a temporary file and then rename it, so we never leave a partial state
+	path := filepath.Join(dir, STATE_FILE)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Set a new switch identity, generating a new secret
+func (st *State) ResetSwitch(serial UUID) error {
+	secret := make([]byte, SWITCH_SECRET_LEN)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("could not generate switch secret: %s", err)
+	}
+	st.Serial = serial.String()
+	st.Secret = base64.StdEncoding.EncodeToString(secret)
+	st.Keys = nil
+	st.Peers = nil
+	return nil
+}
+
+// Set the identity of a switch created by some other node
+// The switch secret is only known by the node that created the switch.
+func (st *State) JoinSwitch(serial UUID) {
+	st.Serial = serial.String()
+	st.Secret = ""
+	st.Keys = nil
+	st.Peers = nil
+}
+
+// Set the identity of a switch from a join token
+func (st *State) JoinSwitchWithToken(t *JoinToken) {
+	st.JoinSwitch(t.SwitchId())
+	st.Keys = t.Keys
+	st.Peers = t.Peers
+}
+
+// Set a new node identity
+// The hostname is used as the node name when no name is provided.
+func (st *State) ResetNode(nodeName string) error {
+	if len(nodeName) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("could not obtain hostname: %s", err)
+		}
+		nodeName = hostname
+	}
+	st.NodeId = NewNodeId().String()
+	st.NodeName = nodeName
+	return nil
+}
+
+// Get the switch serial
+func (st *State) SwitchId() UUID {
+	return NewSwitchFromString(st.Serial)
+}
+
+// Get the base64-encoded keys for the switch: the keys obtained from a join
+// token or, in the node that created the switch, the key derived from the secret
+func (st *State) ClusterKeys() ([]string, error) {
+	if len(st.Keys) > 0 {
+		return st.Keys, nil
+	}
+	if len(st.Secret) == 0 {
+		return nil, nil
+	}
+	secret, err := base64.StdEncoding.DecodeString(st.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid switch secret: %s", err)
+	}
+	key := deriveClusterKey(secret, st.Serial)
+	return []string{base64.StdEncoding.EncodeToString(key)}, nil
+}
@@ -0,0 +1,39 @@
+package divsd
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStateSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "divs-state")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := LoadState(dir); err != ERR_NO_STATE {
+		t.Fatalf("unexpected err for empty state dir: %v", err)
+	}
+
+	st, err := NewState("node-a")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if err := st.Save(dir); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	loaded, err := LoadState(dir)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(loaded, st) {
+		t.Fatalf("loaded state %+v is different from saved %+v", loaded, st)
+	}
+	if loaded.SwitchId().String() != st.Serial {
+		t.Fatalf("bad switch serial %s", loaded.SwitchId())
+	}
+}
@@ -0,0 +1,257 @@
+package divsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Actions when a storm or a MAC flap is detected
+const (
+	STORM_ACTION_BLOCK = "block" // block the offending node (or the local port)
+	STORM_ACTION_LOG   = "log"   // just log it
+)
+
+// default window (in seconds) for detecting MAC flaps
+const DEFAULT_FLAP_WINDOW = 10
+
+// default time (in seconds) a node is blocked
+const DEFAULT_STORM_BLOCK_TIME = 60
+
+// Classes of traffic under storm control
+const (
+	STORM_BROADCAST = iota
+	STORM_MULTICAST
+	STORM_UNKNOWN_UNICAST
+	STORM_NONE // traffic not under storm control
+)
+
+var stormClassNames = []string{"broadcast", "multicast", "unknown unicast"}
+
+// get the class of a packet, given if the destination is known
+func stormClass(dst net.HardwareAddr, known bool) int {
+	switch {
+	case isBroadcastMac(dst):
+		return STORM_BROADCAST
+	case !isUnicastMac(dst):
+		return STORM_MULTICAST
+	case !known:
+		return STORM_UNKNOWN_UNICAST
+	}
+	return STORM_NONE
+}
+
+// the packets seen from a source in the current second
+type stormCounter struct {
+	second int64
+	counts [STORM_NONE]int
+}
+
+// the recent moves of a MAC
+type macMoves struct {
+	node  string      // the node where the MAC is now
+	moves []time.Time // when it moved, in the flap window
+}
+
+// A node (or the local port) blocked
+type BlockedNode struct {
+	Node   string    `json:"node"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// The storm control: it blocks the nodes (or the local port) that send too
+// many broadcast, multicast or unknown unicast packets per second, as well as
+// the nodes where a MAC keeps moving to (a sign of a L2 loop)
+type StormControl struct {
+	OnBlock func(node string) // invoked when a node is blocked
+
+	config   stormConfig
+	counters map[string]*stormCounter
+	macs     map[MacKey]*macMoves
+	blocked  map[string]BlockedNode
+	mutex    sync.Mutex
+}
+
+// Create a new storm control
+func NewStormControl(c stormConfig) *StormControl {
+	sc := &StormControl{blocked: make(map[string]BlockedNode)}
+	sc.SetConfig(c)
+	return sc
+}
+
+// Replace the storm control settings, resetting the counters
+func (sc *StormControl) SetConfig(c stormConfig) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.config = c
+	sc.counters = make(map[string]*stormCounter)
+	sc.macs = make(map[MacKey]*macMoves)
+}
+
+// check if a node is blocked, lifting expired blocks
+func (sc *StormControl) isBlocked(node string, now time.Time) bool {
+	b, found := sc.blocked[node]
+	if !found {
+		return false
+	}
+	if now.After(b.Until) {
+		log.Info("Storm control: %s unblocked", node)
+		delete(sc.blocked, node)
+		return false
+	}
+	return true
+}
+
+// block a node for some reason (if that is the configured action)
+func (sc *StormControl) block(node string, reason string, now time.Time) {
+	if sc.config.Action != STORM_ACTION_BLOCK {
+		log.Warning("Storm control: %s: %s", node, reason)
+		return
+	}
+	log.Warning("Storm control: %s: %s: blocked for %d seconds", node, reason, sc.config.Block)
+	metrics.Inc("storm.blocked")
+	sc.blocked[node] = BlockedNode{
+		Node:   node,
+		Reason: reason,
+		Until:  now.Add(time.Duration(sc.config.Block) * time.Second),
+	}
+	if sc.OnBlock != nil {
+		sc.OnBlock(node)
+	}
+}
+
+// get the threshold (in packets per second) for a class of traffic
+func (sc *StormControl) threshold(class int) int {
+	switch class {
+	case STORM_BROADCAST:
+		return sc.config.Broadcast
+	case STORM_MULTICAST:
+		return sc.config.Multicast
+	case STORM_UNKNOWN_UNICAST:
+		return sc.config.Unknown
+	}
+	return 0
+}
+
+// Check a packet of some class from a node (or from the local port),
+// returning `false` if it must be dropped
+func (sc *StormControl) Check(node string, class int) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	now := time.Now()
+	if sc.isBlocked(node, now) {
+		metrics.Inc("storm.dropped")
+		return false
+	}
+	threshold := sc.threshold(class)
+	if threshold <= 0 {
+		return true
+	}
+
+	counter, found := sc.counters[node]
+	if !found || counter.second != now.Unix() {
+		counter = &stormCounter{second: now.Unix()}
+		sc.counters[node] = counter
+	}
+	counter.counts[class]++
+	if counter.counts[class] <= threshold {
+		return true
+	}
+
+	metrics.Inc("storm.dropped")
+	if counter.counts[class] == threshold+1 {
+		metrics.Inc("storm.detected")
+		sc.block(node, fmt.Sprintf("%s storm (more than %d packets per second)", stormClassNames[class], threshold), now)
+	}
+	return false
+}
+
+// Learn that a MAC in a VLAN is now located at some node, detecting MAC flaps
+// Returns `false` if the node is blocked.
+func (sc *StormControl) LearnMac(vlan uint16, mac string, node string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	now := time.Now()
+	if sc.isBlocked(node, now) {
+		return false
+	}
+
+	key := MacKey{vlan, mac}
+	m, found := sc.macs[key]
+	if !found {
+		sc.macs[key] = &macMoves{node: node}
+		return true
+	}
+	if m.node == node {
+		return true
+	}
+	m.node = node
+	if sc.config.Flaps <= 0 {
+		return true
+	}
+
+	// forget the moves outside the window
+	window := time.Duration(sc.config.FlapWindow) * time.Second
+	recent := m.moves[:0]
+	for _, t := range m.moves {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	m.moves = append(recent, now)
+	if len(m.moves) < sc.config.Flaps {
+		return true
+	}
+
+	metrics.Inc("storm.flaps")
+	m.moves = nil
+	sc.block(node, fmt.Sprintf("MAC %s in VLAN %d flapping (%d moves in %d seconds)", mac, vlan, sc.config.Flaps, sc.config.FlapWindow), now)
+	return sc.config.Action != STORM_ACTION_BLOCK
+}
+
+// Return `true` if a node (or the local port) is blocked
+func (sc *StormControl) Blocked(node string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.isBlocked(node, time.Now())
+}
+
+// Unblock a node
+func (sc *StormControl) Unblock(node string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if _, found := sc.blocked[node]; !found {
+		return false
+	}
+	log.Info("Storm control: %s unblocked", node)
+	delete(sc.blocked, node)
+	return true
+}
+
+// Forget the counters for a node that has left
+func (sc *StormControl) Forget(node string) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	delete(sc.counters, node)
+}
+
+// Get the nodes currently blocked, sorted by name
+func (sc *StormControl) BlockedNodes() []BlockedNode {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	now := time.Now()
+	res := []BlockedNode{}
+	for node, b := range sc.blocked {
+		if sc.isBlocked(node, now) {
+			res = append(res, b)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Node < res[j].Node })
+	return res
+}
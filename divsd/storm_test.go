@@ -0,0 +1,98 @@
+package divsd
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStormClass(t *testing.T) {
+	unicast := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	multicast := net.HardwareAddr{0x01, 0x00, 0x5e, 0, 0, 0x01}
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	for _, test := range []struct {
+		mac      net.HardwareAddr
+		known    bool
+		expected int
+	}{
+		{broadcast, false, STORM_BROADCAST},
+		{multicast, false, STORM_MULTICAST},
+		{unicast, false, STORM_UNKNOWN_UNICAST},
+		{unicast, true, STORM_NONE},
+	} {
+		if class := stormClass(test.mac, test.known); class != test.expected {
+			t.Errorf("%s (known=%t): expected class %d, got %d", test.mac, test.known, test.expected, class)
+		}
+	}
+}
+
+func TestStormControl(t *testing.T) {
+	c := NewConfig().Storm
+	c.Broadcast = 10
+	sc := NewStormControl(c)
+	blocked := ""
+	sc.OnBlock = func(node string) { blocked = node }
+
+	for i := 0; i < 10; i++ {
+		if !sc.Check("node1", STORM_BROADCAST) {
+			t.Fatalf("broadcast %d dropped", i)
+		}
+	}
+	// multicast and known unicast are not limited
+	if !sc.Check("node1", STORM_MULTICAST) || !sc.Check("node1", STORM_NONE) {
+		t.Fatalf("packets dropped before the storm")
+	}
+	if sc.Check("node1", STORM_BROADCAST) {
+		t.Fatalf("broadcast storm not detected")
+	}
+	if blocked != "node1" || !sc.Blocked("node1") {
+		t.Fatalf("node1 not blocked")
+	}
+	if sc.Check("node1", STORM_NONE) {
+		t.Errorf("unicast from a blocked node not dropped")
+	}
+	if !sc.Check("node2", STORM_BROADCAST) {
+		t.Errorf("broadcast from node2 dropped")
+	}
+	if nodes := sc.BlockedNodes(); len(nodes) != 1 || nodes[0].Node != "node1" {
+		t.Errorf("unexpected blocked nodes: %+v", nodes)
+	}
+	if !sc.Unblock("node1") || sc.Blocked("node1") {
+		t.Errorf("node1 not unblocked")
+	}
+}
+
+func TestStormControlFlaps(t *testing.T) {
+	c := NewConfig().Storm
+	c.Flaps = 3
+	sc := NewStormControl(c)
+
+	mac := "02:00:00:00:00:01"
+	for i, node := range []string{"node1", "node2", "node1"} {
+		if !sc.LearnMac(DEFAULT_VLAN, mac, node) {
+			t.Fatalf("move %d to %s rejected", i, node)
+		}
+	}
+	// the same MAC in other VLAN is a different MAC
+	if !sc.LearnMac(10, mac, "node2") {
+		t.Fatalf("MAC in VLAN 10 rejected")
+	}
+	if sc.LearnMac(DEFAULT_VLAN, mac, "node2") {
+		t.Fatalf("MAC flap not detected")
+	}
+	if !sc.Blocked("node2") || sc.Blocked("node1") {
+		t.Errorf("unexpected nodes blocked: %+v", sc.BlockedNodes())
+	}
+
+	// with the "log" action, nothing is blocked
+	c.Action = STORM_ACTION_LOG
+	sc = NewStormControl(c)
+	for _, node := range []string{"node1", "node2", "node1", "node2", "node1"} {
+		if !sc.LearnMac(DEFAULT_VLAN, mac, node) {
+			t.Fatalf("move to %s rejected", node)
+		}
+	}
+	if len(sc.BlockedNodes()) != 0 {
+		t.Errorf("nodes blocked with the 'log' action")
+	}
+}
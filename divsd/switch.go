@@ -17,6 +17,11 @@ func NewSwitchId() UUID {
 	return UUID{UUID: uuid.NewUUID()}
 }
 
+// Get a new node id
+func NewNodeId() UUID {
+	return UUID{UUID: uuid.NewUUID()}
+}
+
 // Get a new switch device id from a string
 func NewSwitchFromString(s string) UUID {
 	return UUID{UUID: uuid.Parse(s)}
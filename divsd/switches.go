@@ -0,0 +1,127 @@
+package divsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/inercia/divs/divsd/nat"
+)
+
+// the name of the switch configured in the [global] section
+const DEFAULT_SWITCH = "default"
+
+// Unknown switch
+var ERR_UNKNOWN_SWITCH = fmt.Errorf("Unknown switch")
+
+// A virtual switch hosted by the daemon: a TAP device and a memberlist
+// instance, with its own serial, keyring and MAC table
+type Switch struct {
+	Name         string
+	config       *Config
+	nodesManager *NodesManager
+	devManager   *DevManager
+}
+
+// Create a new switch (without starting it)
+func NewSwitch(name string, config *Config) (*Switch, error) {
+	// Initialize the device manager
+	devManager, err := NewDevManager(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize the nodes manager
+	nodesManager, err := NewNodesManager(config)
+	if err != nil {
+		return nil, err
+	}
+
+	nodesManager.SetDevManager(devManager)
+	devManager.SetNodesManager(nodesManager)
+
+	return &Switch{
+		Name:         name,
+		config:       config,
+		nodesManager: nodesManager,
+		devManager:   devManager,
+	}, nil
+}
+
+// Start the switch: join the p2p network and start the TAP device
+func (sw *Switch) Start() error {
+	log.Info("Starting switch %s (%s)", sw.Name, sw.config.Global.Serial)
+
+	// obtain a externally-reachable IP/port for memberlist management
+	defaultExternalAddr := net.JoinHostPort(sw.config.Global.Host, strconv.Itoa(sw.config.Global.Port))
+	membersExternalAddr, _ := nat.NewExternalUDPAddr(defaultExternalAddr)
+	if membersExternalAddr.Port == 0 {
+		return fmt.Errorf("external port obtained is 0")
+	}
+
+	// start the peers manager
+	if err := sw.nodesManager.Start(membersExternalAddr); err != nil {
+		return fmt.Errorf("Error when initialing peers manager: %s", err)
+	}
+
+	// and the devices manager
+	if err := sw.devManager.Start(); err != nil {
+		return fmt.Errorf("Error when initialing tun/tap device manager: %s", err)
+	}
+
+	// now we know the TAP device details: publish them
+	if err := sw.nodesManager.UpdateMeta(); err != nil {
+		log.Warning("Could not update the node metadata: %s", err)
+	}
+	return nil
+}
+
+// Stop the switch
+// We broadcast our leave to the cluster (so peers purge our MACs immediately),
+// stop the TAP device and drain the send queues.
+func (sw *Switch) Stop(ctx context.Context) error {
+	log.Info("Stopping switch %s", sw.Name)
+
+	// leave the cluster and stop the discovery
+	sw.nodesManager.Leave(ctx)
+
+	// stop reading from the TAP device, so nothing else is enqueued
+	if err := sw.devManager.Stop(ctx); err != nil {
+		log.Warning("Could not stop the TAP device: %s", err)
+	}
+
+	// drain the send queues and shutdown the memberlist
+	return sw.nodesManager.Stop(ctx)
+}
+
+// The information about a switch, as exposed in the control API
+type SwitchInfo struct {
+	Name   string `json:"name"`
+	Serial string `json:"serial"`
+	Port   int    `json:"port"`
+	Tap    string `json:"tap"`
+	Nodes  int    `json:"nodes"`
+}
+
+// Get the information about this switch
+func (sw *Switch) Info() SwitchInfo {
+	return SwitchInfo{
+		Name:   sw.Name,
+		Serial: sw.config.Global.Serial.String(),
+		Port:   sw.config.Global.Port,
+		Tap:    sw.devManager.Name(),
+		Nodes:  len(sw.nodesManager.Peers()),
+	}
+}
+
+// get the names of some switches, sorted
+func sortedSwitchNames(switches map[string]*switchConfig) []string {
+	names := make([]string, 0, len(switches))
+	for name := range switches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
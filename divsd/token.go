@@ -0,0 +1,99 @@
+package divsd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// prefix for join tokens, including the format version
+const JOIN_TOKEN_PREFIX = "divs1-"
+
+// default validity for join tokens
+const DEFAULT_JOIN_TOKEN_TTL = 24 * time.Hour
+
+// Invalid join token
+var ERR_INVALID_TOKEN = fmt.Errorf("Invalid join token")
+
+// Expired join token
+var ERR_EXPIRED_TOKEN = fmt.Errorf("Expired join token")
+
+// A join token: everything a new node needs for joining a switch
+type JoinToken struct {
+	Serial  string   // the switch serial
+	Keys    []string // base64-encoded keyring, the first one being the primary key
+	Peers   []string // (optional) bootstrap addresses, as host:port
+	Expires int64    // expiration time (as Unix time), or 0 if the token never expires
+}
+
+// Create a new join token for a switch
+// The token expires after the given TTL, or never if it is 0.
+func NewJoinToken(serial UUID, keys []string, peers []string, ttl time.Duration) (*JoinToken, error) {
+	if serial.Empty() {
+		return nil, fmt.Errorf("no switch serial")
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys for the switch")
+	}
+	t := &JoinToken{
+		Serial: serial.String(),
+		Keys:   keys,
+		Peers:  peers,
+	}
+	if ttl > 0 {
+		t.Expires = time.Now().Add(ttl).Unix()
+	}
+	return t, nil
+}
+
+// Parse and validate an encoded join token
+func ParseJoinToken(encoded string) (*JoinToken, error) {
+	encoded = strings.TrimSpace(encoded)
+	if !strings.HasPrefix(encoded, JOIN_TOKEN_PREFIX) {
+		return nil, ERR_INVALID_TOKEN
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded[len(JOIN_TOKEN_PREFIX):])
+	if err != nil {
+		return nil, ERR_INVALID_TOKEN
+	}
+
+	t := &JoinToken{}
+	hd := codec.MsgpackHandle{}
+	if err := codec.NewDecoder(bytes.NewReader(data), &hd).Decode(t); err != nil {
+		return nil, ERR_INVALID_TOKEN
+	}
+	if t.SwitchId().Empty() || len(t.Keys) == 0 {
+		return nil, ERR_INVALID_TOKEN
+	}
+	if _, err := decodeKeys(t.Keys); err != nil {
+		return nil, ERR_INVALID_TOKEN
+	}
+	if t.Expired() {
+		return nil, ERR_EXPIRED_TOKEN
+	}
+	return t, nil
+}
+
+// Encode the join token as a string that can be copy-pasted
+func (t *JoinToken) Encode() (string, error) {
+	buf := bytes.NewBuffer(nil)
+	hd := codec.MsgpackHandle{}
+	if err := codec.NewEncoder(buf, &hd).Encode(t); err != nil {
+		return "", err
+	}
+	return JOIN_TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// Return `true` if the token has expired
+func (t *JoinToken) Expired() bool {
+	return t.Expires > 0 && time.Now().Unix() > t.Expires
+}
+
+// Get the switch serial
+func (t *JoinToken) SwitchId() UUID {
+	return NewSwitchFromString(t.Serial)
+}
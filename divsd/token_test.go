@@ -0,0 +1,62 @@
+package divsd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinTokenEncodeParse(t *testing.T) {
+	st, err := NewState("node-a")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	keys, err := st.ClusterKeys()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("unexpected keys %v (err: %v)", keys, err)
+	}
+
+	token, err := NewJoinToken(st.SwitchId(), keys, []string{"203.0.113.10:7946"}, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	encoded, err := token.Encode()
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	parsed, err := ParseJoinToken(encoded)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if !reflect.DeepEqual(parsed, token) {
+		t.Fatalf("parsed token %+v is different from %+v", parsed, token)
+	}
+
+	// the token carries the key derived from the secret, but not the secret
+	if parsed.Serial != st.Serial || !reflect.DeepEqual(parsed.Keys, keys) {
+		t.Fatalf("unexpected serial/keys in the token: %+v", parsed)
+	}
+	secret, _ := base64.StdEncoding.DecodeString(st.Secret)
+	data, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encoded, JOIN_TOKEN_PREFIX))
+	if len(secret) == 0 || bytes.Contains(data, secret) || containsString(parsed.Keys, st.Secret) {
+		t.Fatalf("the switch secret is exposed in the token")
+	}
+
+	if _, err := ParseJoinToken(encoded[:len(encoded)-4]); err != ERR_INVALID_TOKEN {
+		t.Fatalf("truncated token not detected: %v", err)
+	}
+}
+
+func TestJoinTokenExpired(t *testing.T) {
+	keys := []string{"yuGOT0eDpUPyWCP2a6hqVQ=="}
+	token, _ := NewJoinToken(NewSwitchId(), keys, nil, time.Hour)
+	token.Expires = time.Now().Add(-time.Minute).Unix()
+
+	encoded, _ := token.Encode()
+	if _, err := ParseJoinToken(encoded); err != ERR_EXPIRED_TOKEN {
+		t.Fatalf("expired token not detected: %v", err)
+	}
+}
@@ -1,6 +1,14 @@
 package divsd
 
-import "strings"
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"code.google.com/p/gopacket/layers"
+)
 
 // skip the first N fields in a string
 func skipFields(msg string, sep string, num int) string {
@@ -10,3 +18,43 @@ func skipFields(msg string, sep string, num int) string {
 	}
 	return res
 }
+
+// get the time left until the context deadline, or a default value when the
+// context has no deadline
+func timeoutFromContext(ctx context.Context, def time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := deadline.Sub(time.Now()); left > 0 {
+			return left
+		}
+		return 0
+	}
+	return def
+}
+
+// Check if a string is in a list of strings
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy a list of strings, so it does not share the array with the original
+func copyStrings(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	return append([]string{}, list...)
+}
+
+// check if a MAC address is the broadcast address
+func isBroadcastMac(mac net.HardwareAddr) bool {
+	return bytes.Equal(mac, layers.EthernetBroadcast)
+}
+
+// check if a MAC address is a unicast address
+func isUnicastMac(mac net.HardwareAddr) bool {
+	return len(mac) > 0 && mac[0]&0x01 == 0
+}
@@ -1,6 +1,10 @@
 package divsd
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 // A global test for the encoding/decoding functions
 func TestSkipFields(t *testing.T) {
@@ -11,3 +15,15 @@ func TestSkipFields(t *testing.T) {
 		t.Fatalf("Did not get expected string: '%s'", testStr)
 	}
 }
+
+func TestTimeoutFromContext(t *testing.T) {
+	if timeoutFromContext(context.Background(), time.Second) != time.Second {
+		t.Fatalf("Did not get the default timeout")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if left := timeoutFromContext(ctx, time.Second); left <= time.Second || left > time.Hour {
+		t.Fatalf("Unexpected timeout: %s", left)
+	}
+}
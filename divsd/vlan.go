@@ -0,0 +1,296 @@
+package divsd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+)
+
+// the VLAN used for untagged frames from nodes without VLAN support
+const DEFAULT_VLAN = 1
+
+// the highest valid VLAN id
+const MAX_VLAN = 4094
+
+// the protocol feature for nodes that support VLANs
+const FEATURE_VLAN = "vlan"
+
+// VLAN modes for the TAP device
+const (
+	VLAN_MODE_ACCESS = "access" // untagged frames, in one VLAN
+	VLAN_MODE_TRUNK  = "trunk"  // tagged frames, in several VLANs
+)
+
+var ERR_INVALID_VLAN = fmt.Errorf("Invalid VLAN: must be in the range 1-4094")
+
+/////////////////////////////////////////////////////////////////////////////
+
+// A range of VLANs
+type vlanRange struct {
+	from, to uint16
+}
+
+// A set of VLANs
+type VlanSet []vlanRange
+
+// Parse a set of VLANs, where each element is a list of VLANs or VLAN ranges
+// separated by commas (ie, "10,20-30")
+func ParseVlanSet(specs []string) (VlanSet, error) {
+	set := VlanSet{}
+	for _, spec := range specs {
+		for _, s := range strings.Split(spec, ",") {
+			s = strings.TrimSpace(s)
+			if len(s) == 0 {
+				continue
+			}
+			bounds := strings.SplitN(s, "-", 2)
+			from, err := parseVlan(bounds[0])
+			if err != nil {
+				return nil, err
+			}
+			to := from
+			if len(bounds) == 2 {
+				if to, err = parseVlan(bounds[1]); err != nil {
+					return nil, err
+				}
+				if to < from {
+					return nil, fmt.Errorf("Invalid VLAN range '%s'", s)
+				}
+			}
+			set = append(set, vlanRange{from, to})
+		}
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i].from < set[j].from })
+	return set, nil
+}
+
+// parse a VLAN id
+func parseVlan(s string) (uint16, error) {
+	vlan, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || !validVlan(vlan) {
+		return 0, ERR_INVALID_VLAN
+	}
+	return uint16(vlan), nil
+}
+
+// check a VLAN id is valid
+func validVlan(vlan int) bool {
+	return vlan >= 1 && vlan <= MAX_VLAN
+}
+
+// Return `true` if the VLAN is in the set
+func (set VlanSet) Contains(vlan uint16) bool {
+	for _, r := range set {
+		if vlan >= r.from && vlan <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (set VlanSet) String() string {
+	res := make([]string, len(set))
+	for i, r := range set {
+		if r.from == r.to {
+			res[i] = strconv.Itoa(int(r.from))
+		} else {
+			res[i] = fmt.Sprintf("%d-%d", r.from, r.to)
+		}
+	}
+	return strings.Join(res, ",")
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// Get the 802.1Q header of a tagged packet
+func (pkt *EthernetPacket) dot1q() (*layers.Dot1Q, bool) {
+	if pkt.EthernetType != layers.EthernetTypeDot1Q {
+		return nil, false
+	}
+	var tag layers.Dot1Q
+	if err := tag.DecodeFromBytes(pkt.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, false
+	}
+	return &tag, true
+}
+
+// Get the VLAN of a packet in the overlay, where packets are always tagged
+// (except when coming from nodes without VLAN support)
+func (pkt *EthernetPacket) Vlan() uint16 {
+	if tag, ok := pkt.dot1q(); ok && tag.VLANIdentifier != 0 {
+		return tag.VLANIdentifier
+	}
+	return DEFAULT_VLAN
+}
+
+// Get a copy of the packet tagged with a VLAN, keeping the priority of the
+// previous tag (if any)
+func (pkt *EthernetPacket) Tag(vlan uint16) (*EthernetPacket, error) {
+	tag := layers.Dot1Q{VLANIdentifier: vlan, Type: pkt.EthernetType}
+	payload := pkt.Payload
+	if prev, ok := pkt.dot1q(); ok {
+		tag.Priority = prev.Priority
+		tag.DropEligible = prev.DropEligible
+		tag.Type = prev.Type
+		payload = prev.Payload
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, &tag, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	res := &EthernetPacket{Ethernet: layers.Ethernet{
+		SrcMAC:       pkt.SrcMAC,
+		DstMAC:       pkt.DstMAC,
+		EthernetType: layers.EthernetTypeDot1Q,
+	}, From: pkt.From}
+	res.Payload = buf.Bytes()
+	return res, nil
+}
+
+// Get a copy of the packet without the 802.1Q tag
+func (pkt *EthernetPacket) Untag() *EthernetPacket {
+	tag, ok := pkt.dot1q()
+	if !ok {
+		return pkt
+	}
+	res := &EthernetPacket{Ethernet: layers.Ethernet{
+		SrcMAC:       pkt.SrcMAC,
+		DstMAC:       pkt.DstMAC,
+		EthernetType: tag.Type,
+	}, From: pkt.From}
+	res.Payload = tag.Payload
+	return res
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// The VLAN configuration of the TAP device: it translates between the frames
+// in the TAP device and the (tagged) packets in the overlay
+type VlanPort struct {
+	mode    string
+	access  uint16  // VLAN in access mode
+	native  uint16  // VLAN for untagged frames in trunk mode (0 for dropping them)
+	allowed VlanSet // VLANs allowed in trunk mode (nil for all)
+}
+
+// Create a VLAN port from the configuration
+func NewVlanPort(c vlanConfig) (*VlanPort, error) {
+	port := &VlanPort{
+		mode:   c.Mode,
+		access: uint16(c.Access),
+		native: uint16(c.Native),
+	}
+	switch c.Mode {
+	case VLAN_MODE_ACCESS:
+		if !validVlan(c.Access) {
+			return nil, ERR_INVALID_VLAN
+		}
+	case VLAN_MODE_TRUNK:
+		if c.Native != 0 && !validVlan(c.Native) {
+			return nil, ERR_INVALID_VLAN
+		}
+		if len(c.Allowed) > 0 {
+			allowed, err := ParseVlanSet(c.Allowed)
+			if err != nil {
+				return nil, err
+			}
+			port.allowed = allowed
+		}
+	default:
+		return nil, fmt.Errorf("Unknown VLAN mode '%s'", c.Mode)
+	}
+	return port, nil
+}
+
+// Return `true` if the port carries some VLAN
+func (port *VlanPort) Carries(vlan uint16) bool {
+	if port.mode == VLAN_MODE_ACCESS {
+		return vlan == port.access
+	}
+	if vlan == port.native {
+		return true
+	}
+	return port.allowed == nil || port.allowed.Contains(vlan)
+}
+
+// Get the VLANs carried by the port, as published in the node metadata
+// (empty for all)
+func (port *VlanPort) String() string {
+	if port.mode == VLAN_MODE_ACCESS {
+		return strconv.Itoa(int(port.access))
+	}
+	if port.allowed == nil {
+		return ""
+	}
+	set := port.allowed
+	if port.native != 0 && !set.Contains(port.native) {
+		set = append(VlanSet{{port.native, port.native}}, set...)
+	}
+	return set.String()
+}
+
+// Process a frame read from the TAP device, returning the tagged packet that
+// must be sent to the overlay (or `false` if it must be dropped)
+func (port *VlanPort) Ingress(pkt *EthernetPacket) (*EthernetPacket, bool) {
+	vlan := uint16(0)
+	if tag, ok := pkt.dot1q(); ok {
+		vlan = tag.VLANIdentifier
+	} else if pkt.EthernetType == layers.EthernetTypeDot1Q {
+		return nil, false // truncated tag
+	}
+
+	switch {
+	case port.mode == VLAN_MODE_ACCESS && vlan == 0:
+		vlan = port.access
+	case port.mode == VLAN_MODE_ACCESS:
+		return nil, false // tagged frames are not accepted in access ports
+	case vlan == 0: // untagged (or priority-tagged) frame in a trunk
+		if port.native == 0 {
+			return nil, false
+		}
+		vlan = port.native
+	case !port.Carries(vlan):
+		return nil, false
+	}
+
+	res, err := pkt.Tag(vlan)
+	if err != nil {
+		log.Debug("Could not tag frame with VLAN %d: %s", vlan, err)
+		return nil, false
+	}
+	return res, true
+}
+
+// Process a packet from the overlay, returning the frame that must be written
+// to the TAP device (or `false` if it must be dropped)
+func (port *VlanPort) Egress(pkt *EthernetPacket) (*EthernetPacket, bool) {
+	vlan := pkt.Vlan()
+	if !port.Carries(vlan) {
+		return nil, false
+	}
+	if port.mode == VLAN_MODE_ACCESS || vlan == port.native {
+		return pkt.Untag(), true
+	}
+	if _, tagged := pkt.dot1q(); !tagged {
+		res, err := pkt.Tag(vlan)
+		if err != nil {
+			return nil, false
+		}
+		return res, true
+	}
+	return pkt, true
+}
+
+// get the VLAN announced by a node (nodes without VLAN support do not
+// announce any VLAN)
+func announcedVlan(vlan uint16) uint16 {
+	if vlan == 0 {
+		return DEFAULT_VLAN
+	}
+	return vlan
+}
@@ -0,0 +1,139 @@
+package divsd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"code.google.com/p/gopacket/layers"
+)
+
+func newTestPacket() *EthernetPacket {
+	pkt := &EthernetPacket{Ethernet: layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02},
+		EthernetType: layers.EthernetTypeIPv4,
+	}}
+	pkt.Payload = []byte("0123456789")
+	return pkt
+}
+
+func TestVlanSet(t *testing.T) {
+	set, err := ParseVlanSet([]string{"100, 10-20", "5"})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if s := set.String(); s != "5,10-20,100" {
+		t.Fatalf("unexpected set: %s", s)
+	}
+	for vlan, expected := range map[uint16]bool{5: true, 15: true, 21: false, 100: true, 1: false} {
+		if set.Contains(vlan) != expected {
+			t.Errorf("VLAN %d: expected %t", vlan, expected)
+		}
+	}
+	for _, spec := range []string{"0", "4095", "20-10", "a"} {
+		if _, err := ParseVlanSet([]string{spec}); err == nil {
+			t.Errorf("invalid set %q not detected", spec)
+		}
+	}
+}
+
+func TestVlanTagging(t *testing.T) {
+	pkt := newTestPacket()
+	if pkt.Vlan() != DEFAULT_VLAN {
+		t.Fatalf("untagged packet not in the default VLAN")
+	}
+
+	tagged, err := pkt.Tag(10)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if tagged.Vlan() != 10 || tagged.EthernetType != layers.EthernetTypeDot1Q {
+		t.Fatalf("packet not tagged: %v", tagged)
+	}
+
+	// the tag must survive the overlay encoding
+	buf, _ := tagged.Encode()
+	decoded := NewEthernetPacketFromBuffer(buf[1:])
+	if decoded.Vlan() != 10 {
+		t.Fatalf("tag lost in the overlay")
+	}
+
+	untagged := decoded.Untag()
+	if untagged.EthernetType != layers.EthernetTypeIPv4 || !bytes.Equal(untagged.Payload, pkt.Payload) {
+		t.Fatalf("unexpected untagged packet: %v", untagged)
+	}
+}
+
+func TestVlanPortAccess(t *testing.T) {
+	port, err := NewVlanPort(vlanConfig{Mode: VLAN_MODE_ACCESS, Access: 10})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	in, ok := port.Ingress(newTestPacket())
+	if !ok || in.Vlan() != 10 {
+		t.Fatalf("untagged frame not tagged with the access VLAN")
+	}
+	tagged, _ := newTestPacket().Tag(20)
+	if _, ok := port.Ingress(tagged); ok {
+		t.Fatalf("tagged frame accepted in an access port")
+	}
+
+	out, ok := port.Egress(in)
+	if !ok || out.EthernetType != layers.EthernetTypeIPv4 {
+		t.Fatalf("packet not untagged in an access port")
+	}
+	if _, ok := port.Egress(tagged); ok {
+		t.Fatalf("packet from another VLAN delivered")
+	}
+}
+
+func TestVlanPortTrunk(t *testing.T) {
+	port, err := NewVlanPort(vlanConfig{Mode: VLAN_MODE_TRUNK, Native: 1, Allowed: []string{"10-20"}})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if s := port.String(); s != "1,10-20" {
+		t.Fatalf("unexpected VLANs: %s", s)
+	}
+
+	tagged, _ := newTestPacket().Tag(15)
+	if in, ok := port.Ingress(tagged); !ok || in.Vlan() != 15 {
+		t.Fatalf("allowed VLAN not accepted")
+	}
+	if in, ok := port.Ingress(newTestPacket()); !ok || in.Vlan() != 1 {
+		t.Fatalf("untagged frame not in the native VLAN")
+	}
+	other, _ := newTestPacket().Tag(30)
+	if _, ok := port.Ingress(other); ok {
+		t.Fatalf("VLAN not allowed accepted")
+	}
+
+	if out, ok := port.Egress(tagged); !ok || out.Vlan() != 15 {
+		t.Fatalf("tag not preserved in a trunk")
+	}
+	native, _ := newTestPacket().Tag(1)
+	if out, ok := port.Egress(native); !ok || out.EthernetType != layers.EthernetTypeIPv4 {
+		t.Fatalf("native VLAN not untagged")
+	}
+}
+
+func TestMacTableVlans(t *testing.T) {
+	table := NewMacTable()
+	table.Learn(10, "02:00:00:00:00:01", "node1", "")
+	table.Learn(20, "02:00:00:00:00:01", "node2", "")
+
+	if entry, found := table.Lookup(10, "02:00:00:00:00:01"); !found || entry.Node != "node1" {
+		t.Fatalf("unexpected entry in VLAN 10: %v", entry)
+	}
+	if entry, found := table.Lookup(20, "02:00:00:00:00:01"); !found || entry.Node != "node2" {
+		t.Fatalf("unexpected entry in VLAN 20: %v", entry)
+	}
+	if _, found := table.Lookup(30, "02:00:00:00:00:01"); found {
+		t.Fatalf("MAC found in the wrong VLAN")
+	}
+	if entries := table.Entries(); len(entries) != 2 || entries[0].Vlan != 10 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}